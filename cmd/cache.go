@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+
+	"llm-data-analyzer/pkg/cache"
+
+	"github.com/spf13/cobra"
+)
+
+// responseCache is the response cache of the running command, opened by the
+// first client that uses it.
+var responseCache *cache.Cache
+
+var pruneAll bool
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cachePruneCmd.Flags().BoolVar(&pruneAll, "all", false, "Remove all cached responses")
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the response cache",
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove expired responses and shrink the cache to --cache-max-size",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newResponseCache()
+		if err != nil {
+			return err
+		}
+		var result cache.PruneResult
+		if pruneAll {
+			result, err = c.Clear()
+		} else {
+			result, err = c.Prune()
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Removed %d responses (%s), kept %d responses (%s) in %s\n",
+			result.Removed, formatBytes(result.RemovedBytes), result.Kept, formatBytes(result.KeptBytes), c.Dir())
+		return nil
+	},
+}
+
+// newResponseCache creates the cache from the cache flags.
+func newResponseCache() (*cache.Cache, error) {
+	dir := cacheDir
+	if dir == "" {
+		var err error
+		if dir, err = cache.DefaultDir(); err != nil {
+			return nil, err
+		}
+	}
+	c := cache.New(dir)
+	c.TTL = cacheTTL
+	c.MaxBytes = cacheMaxSize << 20
+	c.Refresh = refreshCache
+	return c, nil
+}
+
+// openResponseCache returns the response cache of the command, or nil with
+// --no-cache. The cache is pruned when it is opened, so that it stays within
+// its size limit.
+func openResponseCache() (*cache.Cache, error) {
+	if noCache {
+		return nil, nil
+	}
+	c, err := newResponseCache()
+	if err != nil {
+		return nil, err
+	}
+	if responseCache != nil && responseCache.Dir() == c.Dir() {
+		responseCache.TTL, responseCache.MaxBytes, responseCache.Refresh = c.TTL, c.MaxBytes, c.Refresh
+		return responseCache, nil
+	}
+	if _, err := c.Prune(); err != nil {
+		return nil, err
+	}
+	responseCache = c
+	return c, nil
+}
+
+// formatBytes formats a size in bytes for humans.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
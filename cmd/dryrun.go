@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/extractor"
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/prefilter"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/stats"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// defaultOutputEstimate is the assumed length of an answer when the
+	// endpoint sets no max_output_tokens.
+	defaultOutputEstimate = 500
+	// prefilterOutputEstimate is the assumed length of a yes/no answer.
+	prefilterOutputEstimate = 2
+)
+
+// stageEstimate is the projected work of one stage of a run.
+type stageEstimate struct {
+	name     string
+	endpoint config.EndpointConfig
+	chunks   int
+	requests int
+	input    int
+	output   int
+	// depth is the number of sequential reduce requests.
+	depth int
+}
+
+// cost returns the estimated cost of the stage. The split stage makes no
+// requests.
+func (e stageEstimate) cost() float64 {
+	if e.requests == 0 {
+		return 0
+	}
+	return e.endpoint.Cost(e.input, e.output)
+}
+
+// outputEstimate returns the assumed length of an answer of the endpoint.
+func outputEstimate(endpointConf config.EndpointConfig) int {
+	if endpointConf.MaxOutputTokens > 0 {
+		return endpointConf.MaxOutputTokens
+	}
+	return defaultOutputEstimate
+}
+
+// requestTokens counts the input tokens of a request with the given prompt.
+func requestTokens(s *splitter.Splitter, endpointConf config.EndpointConfig, prompt string) int {
+	return len(s.Encode(endpointConf.SystemPrompt)) + len(s.Encode(prompt))
+}
+
+// runDryRun splits the input and builds the prompts of every stage without
+// calling the LLM, and prints the estimated requests, tokens and cost.
+func runDryRun(cmd *cobra.Command, inputFile string, endpointConf config.EndpointConfig) error {
+	s, err := splitter.NewSplitter(endpointConf.ChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to create splitter: %w", err)
+	}
+
+	if runMode == modeMapOnly {
+		promptBytes, err := os.ReadFile(analysisPromptFile)
+		if err != nil {
+			return fmt.Errorf("failed to read analysis prompt file: %w", err)
+		}
+		estimate, err := estimateMapOnly(inputFile, s, string(promptBytes), endpointConf)
+		if err != nil {
+			return err
+		}
+		return printEstimate(cmd, []stageEstimate{estimate})
+	}
+
+	format, err := resolveFormat(inputFile)
+	if err != nil {
+		return err
+	}
+	chunks, err := splitInput(cmd, s, inputFile, format)
+	if err != nil {
+		return err
+	}
+	split := stageEstimate{name: "split", endpoint: endpointConf, chunks: len(chunks)}
+	for _, chunk := range chunks {
+		split.input += chunk.Tokens
+	}
+	stages, err := estimateMap(s, chunks, endpointConf)
+	if err != nil {
+		return err
+	}
+	reduce, err := estimateReduce(cmd, len(chunks), endpointConf)
+	if err != nil {
+		return err
+	}
+	return printEstimate(cmd, append(append([]stageEstimate{split}, stages...), reduce))
+}
+
+// checkBudget compares the projected usage of the stages with
+// --max-total-tokens and --max-cost before any request is sent: the map stage
+// for the chunks that are still to be analyzed, the reduce stage for all
+// chunks, and the usage the work directory records for the stages that do not
+// start over.
+func checkBudget(cmd *cobra.Command, workDir string, chunks []splitter.Chunk, endpointConf config.EndpointConfig, stages ...string) error {
+	if maxTotalTokens == 0 && maxCost == 0 {
+		return nil
+	}
+	s, err := splitter.NewSplitter(endpointConf.ChunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to create splitter: %w", err)
+	}
+	restarted := map[string]bool{stats.StageReduce: slices.Contains(stages, stats.StageReduce)}
+	var estimates []stageEstimate
+	if slices.Contains(stages, stats.StageMap) {
+		pending := chunks
+		if resume {
+			pending = workdir.Pending(workDir, chunks)
+		} else {
+			restarted[stats.StageMap], restarted[stats.StagePrefilter] = true, true
+		}
+		mapStages, err := estimateMap(s, pending, endpointConf)
+		if err != nil {
+			return err
+		}
+		estimates = append(estimates, mapStages...)
+	}
+	if restarted[stats.StageReduce] {
+		reduce, err := estimateReduce(cmd, len(chunks), endpointConf)
+		if err != nil {
+			return err
+		}
+		estimates = append(estimates, reduce)
+	}
+
+	used, usedCost := 0, 0.0
+	for _, entry := range runStats.Stages() {
+		if !restarted[entry.Stage] {
+			used += entry.InputTokens + entry.OutputTokens
+			usedCost += entry.Cost
+		}
+	}
+	tokens, cost := used, usedCost
+	for _, stage := range estimates {
+		tokens += stage.input + stage.output
+		cost += stage.cost()
+	}
+	if maxTotalTokens > 0 && tokens > maxTotalTokens {
+		return fmt.Errorf("the projected usage of %d tokens, %d of them already used, exceeds --max-total-tokens %d, see --dry-run for the estimate of every stage", tokens, used, maxTotalTokens)
+	}
+	if maxCost > 0 && cost > maxCost {
+		return fmt.Errorf("the projected cost of %.4f, %.4f of it already spent, exceeds --max-cost %.4f, see --dry-run for the estimate of every stage", cost, usedCost, maxCost)
+	}
+	if verbose {
+		cmd.Printf("Projected usage: %d tokens, cost %.4f\n", tokens, cost)
+	}
+	return nil
+}
+
+// estimateMap estimates the prefilter and map stages for the chunks.
+func estimateMap(s *splitter.Splitter, chunks []splitter.Chunk, endpointConf config.EndpointConfig) ([]stageEstimate, error) {
+	promptBytes, err := os.ReadFile(analysisPromptFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read analysis prompt file: %w", err)
+	}
+	analysisPrompt := string(promptBytes)
+	// Without native support, schema.Analyze adds the schema to the prompt.
+	analysisSchema, err := loadSchema(analysisSchemaFile)
+	if err != nil {
+		return nil, err
+	}
+	if analysisSchema != nil && !endpointConf.NativeJSONSchema() {
+		analysisPrompt += "\n\n" + analysisSchema.Instruction()
+	}
+
+	var stages []stageEstimate
+	// Every chunk is assumed to pass the prefilter.
+	if prefilterEndpoint != "" {
+		prefilterConf, err := findEndpoint(prefilterEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		goal := string(promptBytes)
+		if prefilterPrompt != "" {
+			goalBytes, err := os.ReadFile(prefilterPrompt)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read prefilter prompt file: %w", err)
+			}
+			goal = string(goalBytes)
+		}
+		estimate := stageEstimate{name: "prefilter", endpoint: prefilterConf, chunks: len(chunks), requests: len(chunks)}
+		for _, chunk := range chunks {
+			estimate.input += requestTokens(s, prefilterConf, prefilter.Prompt(goal, chunk))
+			estimate.output += prefilterOutputEstimate
+		}
+		stages = append(stages, estimate)
+	}
+
+	mapStage := stageEstimate{name: "map", endpoint: endpointConf, chunks: len(chunks), requests: len(chunks)}
+	for _, chunk := range chunks {
+		mapStage.input += requestTokens(s, endpointConf, analysisRequest(analysisPrompt, chunk))
+		mapStage.output += outputEstimate(endpointConf)
+	}
+	return append(stages, mapStage), nil
+}
+
+// estimateReduce estimates the reduce stage for the given number of results
+// of the map stage.
+func estimateReduce(cmd *cobra.Command, results int, endpointConf config.EndpointConfig) (stageEstimate, error) {
+	sum, summaryPrompt, err := reduceSummarizer(cmd, estimateClient(endpointConf), endpointConf)
+	if err != nil {
+		return stageEstimate{}, err
+	}
+	sizes := make([]int, results)
+	for i := range sizes {
+		sizes[i] = outputEstimate(endpointConf)
+	}
+	reduce, err := sum.Estimate(sizes, summaryPrompt, outputEstimate(endpointConf))
+	if err != nil {
+		return stageEstimate{}, fmt.Errorf("failed to estimate the reduce stage: %w", err)
+	}
+	return stageEstimate{
+		name: "reduce", endpoint: endpointConf, chunks: results, requests: reduce.Requests,
+		input: reduce.InputTokens, output: reduce.OutputTokens, depth: reduce.Depth,
+	}, nil
+}
+
+// estimateClient returns a client with the settings of the endpoint that
+// change the size of its requests. Estimates send no requests, so it has no
+// API key, response cache or recording.
+func estimateClient(endpointConf config.EndpointConfig) *llm.Client {
+	client := llm.NewClient(endpointConf.EndpointURL, "", endpointConf.Model)
+	client.SystemPrompt = endpointConf.SystemPrompt
+	client.MaxTokens = endpointConf.MaxOutputTokens
+	client.SupportsJSONSchema = endpointConf.NativeJSONSchema()
+	return client
+}
+
+// estimateMapOnly builds the batches of a map-only run.
+func estimateMapOnly(inputFile string, s *splitter.Splitter, analysisPrompt string, endpointConf config.EndpointConfig) (stageEstimate, error) {
+	format, err := resolveFormat(inputFile)
+	if err != nil {
+		return stageEstimate{}, err
+	}
+	if format != extractor.FormatJSONL {
+		return stageEstimate{}, fmt.Errorf("--mode %s requires JSONL input", modeMapOnly)
+	}
+	input, err := os.Open(inputFile)
+	if err != nil {
+		return stageEstimate{}, fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer input.Close()
+	recs, err := records.Read(input)
+	if err != nil {
+		return stageEstimate{}, fmt.Errorf("failed to read records: %w", err)
+	}
+
+	p := records.NewProcessor(nil, s, analysisPrompt, endpointConf.ChunkSize)
+	p.BatchSize = batchSize
+	prompts, err := p.Prompts(recs)
+	if err != nil {
+		return stageEstimate{}, err
+	}
+	estimate := stageEstimate{name: modeMapOnly, endpoint: endpointConf, chunks: len(recs), requests: len(prompts)}
+	for _, prompt := range prompts {
+		estimate.input += requestTokens(s, endpointConf, prompt)
+		estimate.output += outputEstimate(endpointConf)
+	}
+	return estimate, nil
+}
+
+// printEstimate prints the estimate of every stage and the total.
+func printEstimate(cmd *cobra.Command, stages []stageEstimate) error {
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tENDPOINT\tCHUNKS\tREQUESTS\tINPUT TOKENS\tOUTPUT TOKENS\tCOST")
+	var total stageEstimate
+	var totalCost float64
+	for _, stage := range stages {
+		cost := stage.cost()
+		name := stage.name
+		if stage.depth > 0 {
+			name = fmt.Sprintf("%s (depth %d)", name, stage.depth)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%.4f\n", name, stage.endpoint.Name, stage.chunks, stage.requests, stage.input, stage.output, cost)
+		if stage.requests > 0 {
+			total.requests += stage.requests
+			total.input += stage.input
+			total.output += stage.output
+			totalCost += cost
+		}
+	}
+	fmt.Fprintf(w, "total\t\t\t%d\t%d\t%d\t%.4f\n", total.requests, total.input, total.output, totalCost)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write estimate: %w", err)
+	}
+
+	cmd.Printf("\nOutput tokens assume answers of max_output_tokens (or %d) tokens, and that every chunk passes the prefilter. Retries are not included.\n", defaultOutputEstimate)
+	return nil
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "no requests expected", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	files := newTestFiles(t)
+	// The key is not set: a dry run needs none.
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: dry-run-endpoint
+    endpoint_url: "`+server.URL+`"
+    api_key_env: "LLM_DATA_ANALYZER_TEST_UNSET_KEY"
+    model: "test-model"
+    context_window_size: 2000
+    chunk_size: 50
+    input_price_per_mtok: 1
+    output_price_per_mtok: 2
+`)
+	analysisPrompt := files.write("analysis.txt", "Analyze this:")
+	summaryPrompt := files.write("summary.txt", "Summarize the following analysis:")
+	input := files.write("input.txt", strings.Repeat("This is a test sentence. ", 40))
+	args := []string{
+		"--config", configFile, "--endpoint-name", "dry-run-endpoint",
+		"--analysis-prompt-file", analysisPrompt, "--summary-prompt-file", summaryPrompt,
+		"--dry-run", input,
+	}
+
+	for _, command := range [][]string{nil, {"run"}} {
+		stdout, _, err := execute(append(command, args...)...)
+		if err != nil {
+			t.Fatalf("%v --dry-run failed: %v", command, err)
+		}
+		for _, want := range []string{"STAGE", "\nsplit ", "\nmap ", "\nreduce (depth ", "\ntotal "} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("%v --dry-run: expected %q in the estimate:\n%s", command, want, stdout)
+			}
+		}
+	}
+	if requests.Load() != 0 {
+		t.Errorf("expected no requests, got %d", requests.Load())
+	}
+
+	// The stage subcommands would send requests, so they reject the flag.
+	for _, command := range []string{"map", "reduce", "extract"} {
+		if _, _, err := execute(command, "--dry-run", files.dir); err == nil || !strings.Contains(err.Error(), "unknown flag: --dry-run") {
+			t.Errorf("expected %s to reject --dry-run, got %v", command, err)
+		}
+	}
+	if _, _, err := execute("pipeline", "run", "--dry-run", files.path("pipeline.yaml")); err == nil || !strings.Contains(err.Error(), "unknown flag: --dry-run") {
+		t.Errorf("expected pipeline run to reject --dry-run, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/stats"
+	"llm-data-analyzer/pkg/table"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	fieldsFile   string
+	outputFormat string
+)
+
+func init() {
+	rootCmd.AddCommand(extractCmd)
+	extractCmd.Flags().StringVar(&fieldsFile, "fields-file", "", "Path to the YAML field specification (required)")
+	extractCmd.Flags().StringVar(&outputFormat, "output-format", "", "Output format: 'csv' or 'jsonl' (default is jsonl for a .jsonl output file, csv otherwise)")
+}
+
+var extractCmd = &cobra.Command{
+	Use:   "extract [flags] <input_file_path>",
+	Short: "Extract fields from every chunk into a CSV or JSONL table",
+	Long: `extract pulls the fields described in a field specification out of every chunk
+of the input with structured output. The rows are type-checked, deduplicated and
+written as CSV or JSONL, together with the chunk each row was first found in.
+
+The --analysis-prompt-file, if given, replaces the default extraction instructions.
+The chunks and the response of every chunk are kept in the work directory
+(--temp-dir), so that a run stopped by its budget continues with --resume.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if fieldsFile == "" {
+			return fmt.Errorf("required flag \"fields-file\" not set")
+		}
+		if endpointName == "" {
+			return fmt.Errorf("required flag \"endpoint-name\" not set")
+		}
+		switch outputFormat {
+		case "":
+			outputFormat = "csv"
+			if strings.EqualFold(filepath.Ext(outputFile), ".jsonl") {
+				outputFormat = "jsonl"
+			}
+		case "csv", "jsonl":
+		default:
+			return fmt.Errorf("invalid --output-format '%s': must be 'csv' or 'jsonl'", outputFormat)
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		spec, err := table.LoadSpec(fieldsFile)
+		if err != nil {
+			return err
+		}
+		var instructions string
+		if analysisPromptFile != "" {
+			promptBytes, err := os.ReadFile(analysisPromptFile)
+			if err != nil {
+				return fmt.Errorf("failed to read analysis prompt file: %w", err)
+			}
+			instructions = string(promptBytes)
+		}
+
+		endpointConf, err := selectEndpoint()
+		if err != nil {
+			return err
+		}
+
+		workDir, removeWorkDir, err := openWorkDir(cmd)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if removeWorkDir {
+				os.RemoveAll(workDir)
+			}
+		}()
+		if runStats, err = stats.Load(workDir); err != nil {
+			return err
+		}
+		runStats.SetBudget(maxTotalTokens, maxCost)
+
+		err = runExtract(cmd, args[0], workDir, spec, instructions, endpointConf)
+		if errors.Is(err, stats.ErrBudgetExceeded) {
+			// Keep the extracted rows for a resumed run.
+			removeWorkDir = false
+			return budgetStop(cmd, err, fmt.Sprintf("run extract again with --temp-dir %s --resume", workDir), workDir)
+		}
+		if err != nil {
+			return err
+		}
+		return printStats(cmd)
+	},
+}
+
+// runExtract splits the input into the work directory, extracts the rows of
+// every chunk, saving the response of chunk N as its result, and writes the
+// table to the output. With --resume, chunks that have a result are not sent
+// again.
+func runExtract(cmd *cobra.Command, inputFile, workDir string, spec *table.Spec, instructions string, endpointConf config.EndpointConfig) error {
+	extractionSchema, err := spec.Schema()
+	if err != nil {
+		return err
+	}
+	chunks, err := runSplit(cmd, inputFile, workDir, endpointConf)
+	if err != nil {
+		return err
+	}
+
+	pending := chunks
+	if resume {
+		pending = workdir.Pending(workDir, chunks)
+		if verbose {
+			cmd.Printf("Resuming: %d of %d chunks already extracted.\n", len(chunks)-len(pending), len(chunks))
+		}
+	} else {
+		runStats.Reset(stats.StageExtract)
+	}
+	client, err := newStageClient(cmd, endpointConf, stats.StageExtract)
+	if err != nil {
+		return err
+	}
+	err = extractChunks(cmd, client, spec, extractionSchema, instructions, workDir, pending)
+	// Save the usage of a failed extraction, too.
+	if statsErr := runStats.Write(workDir); statsErr != nil {
+		return statsErr
+	}
+	if err != nil {
+		return err
+	}
+	responses, err := workdir.ReadResults(workDir, chunks)
+	if err != nil {
+		return err
+	}
+
+	// Add the rows in chunk order, so that duplicates point to the first
+	// occurrence.
+	t := table.New(spec)
+	for i, chunk := range chunks {
+		if err := t.Add(chunk, responses[i]); err != nil {
+			return err
+		}
+	}
+	if t.Rejected > 0 {
+		cmd.PrintErrf("Warning: dropped %d rows with values that do not match the field types\n", t.Rejected)
+	}
+
+	var out io.Writer = cmd.OutOrStdout()
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if outputFormat == "jsonl" {
+		err = t.WriteJSONL(out)
+	} else {
+		err = t.WriteCSV(out)
+	}
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		cmd.Printf("Extracted %d distinct rows from %d chunks.\n", t.Len(), len(chunks))
+	}
+	return nil
+}
+
+// extractChunks extracts the rows of the chunks in parallel and writes every
+// response to the work directory.
+func extractChunks(cmd *cobra.Command, client *llm.Client, spec *table.Spec, extractionSchema *schema.Schema, instructions, workDir string, chunks []splitter.Chunk) error {
+	var wg sync.WaitGroup
+	errorChan := make(chan error, len(chunks))
+	sem := make(chan struct{}, max(concurrency, 1))
+
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func(chunk splitter.Chunk) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if verbose {
+				cmd.Printf("Extracting from chunk %d (%s)...\n", chunk.Index, chunk.Location())
+			}
+			response, err := schema.Analyze(context.Background(), client, spec.Prompt(instructions, chunk.Text), extractionSchema, schemaRetries)
+			if err != nil {
+				errorChan <- fmt.Errorf("failed to extract from chunk %d: %w", chunk.Index, err)
+				return
+			}
+			if err := workdir.WriteResult(workDir, chunk.Index, response); err != nil {
+				errorChan <- err
+			}
+		}(chunk)
+	}
+
+	wg.Wait()
+	close(errorChan)
+
+	// Check for errors during extraction
+	for err := range errorChan {
+		return err // Return the first error encountered
+	}
+	return nil
+}
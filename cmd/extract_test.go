@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/stats"
+)
+
+func TestExtractBudgetResume(t *testing.T) {
+	files := newTestFiles(t)
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: extract-mock
+    provider: mock
+    model: "mock-model"
+    context_window_size: 1000
+    chunk_size: 50
+`)
+	fieldsFile := files.write("fields.yaml", `
+fields:
+  - name: host
+    description: Host name
+`)
+	input := files.write("input.txt", strings.Repeat("Host db-1 failed to answer. ", 40))
+	extract := func(workDir, output string, extra ...string) (string, error) {
+		args := append([]string{
+			"extract", "--config", configFile, "--endpoint-name", "extract-mock",
+			"--fields-file", fieldsFile, "--temp-dir", workDir, "--output", output,
+		}, extra...)
+		_, stderr, err := execute(append(args, input)...)
+		return stderr, err
+	}
+
+	// A run without a budget gives the usage of the whole extraction.
+	fullDir := files.path("full")
+	if _, err := extract(fullDir, files.path("full.csv")); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	full := readTotal(t, fullDir)
+	if full.Requests < 3 {
+		t.Fatalf("expected a request per chunk, got %+v", full)
+	}
+
+	// Half the tokens stop the run, which keeps the extracted chunks.
+	workDir := files.path("work")
+	stderr, err := extract(workDir, files.path("out.csv"), "--max-total-tokens", strconv.Itoa(full.InputTokens/2))
+	if err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Fatalf("expected a budget stop, got %v\n%s", err, stderr)
+	}
+	stopped := readTotal(t, workDir)
+	if stopped.Requests == 0 || stopped.Requests >= full.Requests {
+		t.Errorf("expected a partial extraction, got %+v", stopped)
+	}
+
+	if _, err := extract(workDir, files.path("out.csv"), "--resume"); err != nil {
+		t.Fatalf("resumed extract failed: %v", err)
+	}
+	resumed := readTotal(t, workDir)
+	if resumed.Requests != full.Requests {
+		t.Errorf("expected %d requests in total after the resume, got %d", full.Requests, resumed.Requests)
+	}
+	want, _ := os.ReadFile(files.path("full.csv"))
+	got, _ := os.ReadFile(files.path("out.csv"))
+	if len(want) == 0 || string(got) != string(want) {
+		t.Errorf("expected the table %q, got %q", want, got)
+	}
+}
+
+// readTotal returns the total usage recorded in the run_stats.json of a work
+// directory.
+func readTotal(t *testing.T, workDir string) stats.Entry {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(workDir, stats.FileName))
+	if err != nil {
+		t.Fatalf("no run statistics: %v", err)
+	}
+	var f struct {
+		Total stats.Entry `json:"total"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		t.Fatalf("invalid run statistics: %v", err)
+	}
+	return f.Total
+}
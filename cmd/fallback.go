@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/summarizer"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+// fallbackEndpoints returns the endpoint followed by the fallbacks of its
+// configuration, in the order they are tried.
+func fallbackEndpoints(endpointConf config.EndpointConfig) ([]config.EndpointConfig, error) {
+	endpoints := []config.EndpointConfig{endpointConf}
+	seen := map[string]bool{endpointConf.Name: true}
+	for _, name := range endpointConf.Fallbacks {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		fallback, err := findEndpoint(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback of endpoint '%s': %w", endpointConf.Name, err)
+		}
+		endpoints = append(endpoints, fallback)
+	}
+	return endpoints, nil
+}
+
+// chunkAnalyzer analyzes chunks on an endpoint and, when the endpoint cannot
+// serve a request, on its fallbacks in order.
+type chunkAnalyzer struct {
+	endpoints []config.EndpointConfig
+	clients   []*llm.Client
+	prompt    string
+	schema    *schema.Schema
+	// mergeRules combine the JSON results of the pieces of a chunk that was
+	// split for a fallback.
+	mergeRules summarizer.MergeRules
+}
+
+// newChunkAnalyzer creates the clients of the endpoint and its fallbacks,
+// whose usage is recorded for the stage.
+func newChunkAnalyzer(cmd *cobra.Command, endpointConf config.EndpointConfig, stage, prompt string, sch *schema.Schema) (*chunkAnalyzer, error) {
+	endpoints, err := fallbackEndpoints(endpointConf)
+	if err != nil {
+		return nil, err
+	}
+	a := &chunkAnalyzer{endpoints: endpoints, prompt: prompt, schema: sch}
+	for _, conf := range endpoints {
+		client, err := newStageClient(cmd, conf, stage)
+		if err != nil {
+			return nil, err
+		}
+		a.clients = append(a.clients, client)
+	}
+	if sch != nil && mergeRulesFile != "" {
+		if a.mergeRules, err = loadMergeRules(mergeRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// analyze returns the result of the chunk and the endpoint that served it.
+func (a *chunkAnalyzer) analyze(ctx context.Context, cmd *cobra.Command, chunk splitter.Chunk) (string, workdir.Served, error) {
+	var err error
+	for i, conf := range a.endpoints {
+		if i > 0 && verbose {
+			cmd.Printf("Endpoint %s failed on chunk %d (%v), falling back to %s...\n", a.endpoints[i-1].Name, chunk.Index, err, conf.Name)
+		}
+		var result string
+		var pieces int
+		result, pieces, err = a.analyzeOn(ctx, i, chunk)
+		if err == nil {
+			return result, workdir.Served{Index: chunk.Index, Endpoint: conf.Name, Pieces: pieces}, nil
+		}
+		if !llm.Unavailable(err) {
+			break
+		}
+	}
+	return "", workdir.Served{}, err
+}
+
+// analyzeOn analyzes the chunk on the i-th endpoint. A fallback with a
+// smaller chunk size gets the chunk in pieces, whose results are joined, or
+// merged if they are JSON. It returns the number of pieces, or 0 if the chunk
+// was not split.
+func (a *chunkAnalyzer) analyzeOn(ctx context.Context, i int, chunk splitter.Chunk) (string, int, error) {
+	conf, client := a.endpoints[i], a.clients[i]
+	if i == 0 || conf.ChunkSize <= 0 || chunk.Tokens <= conf.ChunkSize {
+		result, err := a.request(ctx, client, chunk)
+		return result, 0, err
+	}
+
+	s, err := splitter.NewSplitter(conf.ChunkSize)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create splitter: %w", err)
+	}
+	pieces, err := s.Split(strings.NewReader(chunk.Text))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to split chunk %d for endpoint %s: %w", chunk.Index, conf.Name, err)
+	}
+	results := make([]string, len(pieces))
+	for j, piece := range pieces {
+		if results[j], err = a.request(ctx, client, piece); err != nil {
+			return "", 0, fmt.Errorf("failed to analyze part %d of %d: %w", j+1, len(pieces), err)
+		}
+	}
+	if a.schema != nil {
+		merged, err := summarizer.MergeJSON(results, a.mergeRules)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to merge the parts of chunk %d: %w", chunk.Index, err)
+		}
+		return merged, len(pieces), nil
+	}
+	return strings.Join(results, "\n\n"), len(pieces), nil
+}
+
+// request sends the analysis prompt with the text of the chunk.
+func (a *chunkAnalyzer) request(ctx context.Context, client *llm.Client, chunk splitter.Chunk) (string, error) {
+	fullPrompt := analysisRequest(a.prompt, chunk)
+	if a.schema != nil {
+		return schema.Analyze(ctx, client, fullPrompt, a.schema, schemaRetries)
+	}
+	return client.Analyze(ctx, fullPrompt)
+}
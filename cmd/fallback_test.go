@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/workdir"
+)
+
+func TestRunFallback(t *testing.T) {
+	files := newTestFiles(t)
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: fallback-primary
+    provider: mock
+    model: "mock-model"
+    context_window_size: 2000
+    chunk_size: 50
+    mock:
+      failure_rate: 1
+    fallbacks: [fallback-secondary]
+  - name: fallback-secondary
+    provider: mock
+    model: "mock-model"
+    context_window_size: 2000
+    chunk_size: 25
+`)
+	analysisPrompt := files.write("analysis.txt", "Analyze this:")
+	summaryPrompt := files.write("summary.txt", "Summarize the following analysis:")
+	input := files.write("input.txt", strings.Repeat("This is a test sentence. ", 40))
+	workDir := files.path("work")
+
+	stdout, stderr, err := execute("run", "--config", configFile, "--endpoint-name", "fallback-primary",
+		"--analysis-prompt-file", analysisPrompt, "--summary-prompt-file", summaryPrompt,
+		"--temp-dir", workDir, "--output", files.path("report.txt"), input)
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, stderr)
+	}
+	chunks, err := workdir.ReadChunks(workDir)
+	if err != nil {
+		t.Fatalf("expected the chunks in the work directory: %v", err)
+	}
+	served, err := workdir.ReadServed(workDir)
+	if err != nil || len(served) != len(chunks) {
+		t.Fatalf("expected the endpoint of every chunk in served.jsonl, got %d of %d (%v)", len(served), len(chunks), err)
+	}
+	for i, s := range served {
+		if s.Endpoint != "fallback-secondary" {
+			t.Errorf("expected chunk %d to be served by the fallback, got %q", s.Index, s.Endpoint)
+		}
+		// The fallback's chunk size is half of the primary's.
+		if chunks[i].Tokens > 25 && s.Pieces < 2 {
+			t.Errorf("expected chunk %d of %d tokens to be split for the fallback, got %d pieces", s.Index, chunks[i].Tokens, s.Pieces)
+		}
+	}
+	want := "Endpoint fallback-primary unavailable: " + strconv.Itoa(len(chunks)) + " chunks were analyzed by fallback fallback-secondary."
+	if !strings.Contains(stdout+stderr, want) {
+		t.Errorf("expected %q, got:\n%s%s", want, stdout, stderr)
+	}
+}
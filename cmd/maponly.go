@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/extractor"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+// Run modes.
+const (
+	modeSummarize = "summarize"
+	modeMapOnly   = "map-only"
+)
+
+// runMapOnly analyzes every JSONL record and writes the records joined with
+// the model's result fields, one per line, instead of a summary. The valid
+// results are kept in the work directory, also when the run fails, and with
+// --resume, records that already have one are not analyzed again.
+func runMapOnly(cmd *cobra.Command, inputFile, workDir string, s *splitter.Splitter, endpointConf config.EndpointConfig) error {
+	format, err := resolveFormat(inputFile)
+	if err != nil {
+		return err
+	}
+	if format != extractor.FormatJSONL {
+		return fmt.Errorf("--mode %s requires JSONL input", modeMapOnly)
+	}
+	input, err := os.Open(inputFile)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer input.Close()
+
+	if !resume {
+		runStats.Reset(modeMapOnly)
+	}
+	client, err := newStageClient(cmd, endpointConf, modeMapOnly)
+	if err != nil {
+		return err
+	}
+
+	promptBytes, err := os.ReadFile(analysisPromptFile)
+	if err != nil {
+		return fmt.Errorf("failed to read analysis prompt file: %w", err)
+	}
+	analysisSchema, err := loadSchema(analysisSchemaFile)
+	if err != nil {
+		return err
+	}
+
+	recs, err := records.Read(input)
+	if err != nil {
+		return fmt.Errorf("failed to read records: %w", err)
+	}
+	if verbose {
+		cmd.Printf("Read %d records.\n", len(recs))
+	}
+
+	p := records.NewProcessor(client, s, string(promptBytes), endpointConf.ChunkSize)
+	p.BatchSize = batchSize
+	p.Retries = recordRetries
+	p.Concurrency = concurrency
+	p.Schema = analysisSchema
+	if verbose {
+		p.Progress = func(done, total int) {
+			cmd.Printf("Analyzed batch %d/%d\n", done, total)
+		}
+	}
+
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+	// The results of earlier runs, by record ID.
+	saved := make(map[int]records.Result)
+	pending := recs
+	if resume {
+		if saved, err = workdir.ReadRecordResults(workDir, recs); err != nil {
+			return err
+		}
+		pending = nil
+		for _, record := range recs {
+			if _, ok := saved[record.ID]; !ok {
+				pending = append(pending, record)
+			}
+		}
+		if verbose {
+			cmd.Printf("Resuming: %d of %d records already have a result.\n", len(saved), len(recs))
+		}
+	}
+
+	analyzed, err := p.Run(context.Background(), pending)
+	for _, result := range analyzed {
+		saved[result.Record.ID] = result
+	}
+	results := make([]records.Result, 0, len(saved))
+	for _, record := range recs {
+		if result, ok := saved[record.ID]; ok {
+			results = append(results, result)
+		}
+	}
+	if writeErr := workdir.WriteRecordResults(workDir, results); writeErr != nil && err == nil {
+		err = writeErr
+	}
+	if statsErr := runStats.Write(workDir); statsErr != nil && err == nil {
+		err = statsErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = cmd.OutOrStdout()
+	if outputFile != "" {
+		f, err := os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	failed := 0
+	for _, result := range results {
+		line, err := records.Join(result)
+		if err != nil {
+			return err
+		}
+		w.Write(line)
+		w.WriteString("\n")
+		if result.Err != nil {
+			failed++
+			cmd.PrintErrf("Warning: no valid result for the record in line %d: %v\n", result.Record.ID, result.Err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	if verbose {
+		cmd.Printf("Wrote %d records, %d without a valid result.\n", len(results), failed)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+)
+
+// newMock creates the mock of an endpoint with the mock provider.
+func newMock(mockConf config.MockConfig) (*llm.Mock, error) {
+	if mockConf.FailureRate < 0 || mockConf.FailureRate > 1 {
+		return nil, fmt.Errorf("failure_rate %g is not between 0 and 1", mockConf.FailureRate)
+	}
+	mock := llm.NewMock(mockConf.Seed)
+	mock.Latency = mockConf.Latency
+	mock.FailureRate = mockConf.FailureRate
+	if mockConf.ResponseFile != "" {
+		data, err := os.ReadFile(mockConf.ResponseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response file: %w", err)
+		}
+		mock.Response = string(data)
+	}
+	return mock, nil
+}
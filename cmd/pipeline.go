@@ -0,0 +1,430 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"llm-data-analyzer/pkg/citation"
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/extractor"
+	"llm-data-analyzer/pkg/pipeline"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/stats"
+	"llm-data-analyzer/pkg/summarizer"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+var forceStages bool
+
+// filterInstruction is added to the prompt of a filter stage.
+const filterInstruction = `Decide for each record whether it matches the criteria above. Answer with the boolean field "keep" for every record.`
+
+// filterSchema is the schema of a filter stage's result for one record.
+const filterSchema = `{"type": "object", "properties": {"keep": {"type": "boolean"}}, "required": ["keep"]}`
+
+func init() {
+	rootCmd.AddCommand(pipelineCmd)
+	pipelineCmd.AddCommand(pipelineRunCmd)
+	pipelineRunCmd.Flags().BoolVar(&forceStages, "force", false, "Run all stages, even if their cached output is up to date")
+}
+
+var pipelineCmd = &cobra.Command{
+	Use:   "pipeline",
+	Short: "Run multi-stage analyses declared in a pipeline file",
+}
+
+var pipelineRunCmd = &cobra.Command{
+	Use:   "run [flags] <pipeline_file>",
+	Short: "Run the stages of a pipeline file in dependency order",
+	Long: `run executes the stages of a pipeline file in dependency order. The output of
+every stage is cached with a key over its input, prompt, schema, the flags that
+tune the stages, and its endpoints, so a stage only runs again when one of these
+changes. With --resume, a map stage stopped by --max-total-tokens or --max-cost
+continues with the chunks that have no result yet.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		p, err := pipeline.Load(args[0])
+		if err != nil {
+			return err
+		}
+		if appConfig, err = config.LoadConfig(cfgFile); err != nil {
+			return fmt.Errorf("Error loading config file: %w", err)
+		}
+		stages, err := p.Order()
+		if err != nil {
+			return err
+		}
+		runStats = stats.New()
+		if resume {
+			// The usage of the stopped run counts against the budget.
+			if runStats, err = stats.Load(p.CacheDir); err != nil {
+				return err
+			}
+		}
+		runStats.SetBudget(maxTotalTokens, maxCost)
+
+		for _, stage := range stages {
+			if stage.Endpoint == "" {
+				stage.Endpoint = endpointName
+			}
+			output, cached, err := runStage(cmd, p, stage)
+			if errors.Is(err, stats.ErrBudgetExceeded) {
+				if writeErr := runStats.Write(p.CacheDir); writeErr != nil {
+					return writeErr
+				}
+				return budgetStop(cmd, fmt.Errorf("stage '%s': %w", stage.Name, err), "run the pipeline again with --resume", p.Dir(stage))
+			}
+			if err != nil {
+				return fmt.Errorf("stage '%s' failed: %w", stage.Name, err)
+			}
+			status := "done"
+			if cached {
+				status = "cached"
+			}
+			cmd.Printf("Stage %s (%s): %s, output in %s\n", stage.Name, stage.Mode, status, output)
+
+			if stage.Output != "" {
+				data, err := os.ReadFile(output)
+				if err != nil {
+					return fmt.Errorf("failed to read output of stage '%s': %w", stage.Name, err)
+				}
+				if err := os.WriteFile(stage.Output, data, 0644); err != nil {
+					return fmt.Errorf("failed to write output of stage '%s': %w", stage.Name, err)
+				}
+			}
+		}
+		if err := runStats.Write(p.CacheDir); err != nil {
+			return err
+		}
+		return printStats(cmd)
+	},
+}
+
+// stageKey returns the cache key of a stage over everything that changes its
+// output: the stage, its prompt, schema, input and input format, the flags
+// that tune the stage, and the endpoint with its fallbacks and, for map
+// stages, the prefilter.
+func stageKey(stage *pipeline.Stage, endpointConf config.EndpointConfig, prompt, schemaText []byte, inputHash string, format extractor.Format) (string, error) {
+	var mergeRules []byte
+	if mergeRulesFile != "" {
+		var err error
+		if mergeRules, err = os.ReadFile(mergeRulesFile); err != nil {
+			return "", fmt.Errorf("failed to read merge rules file: %w", err)
+		}
+	}
+	parts := []string{
+		stage.Mode, stage.Strategy, string(prompt), string(schemaText), inputHash, string(format),
+		splitMode, strconv.Itoa(fanIn), strconv.Itoa(batchSize), strconv.Itoa(recordRetries), strconv.Itoa(schemaRetries), string(mergeRules),
+	}
+	if stage.Mode == pipeline.ModeReduce {
+		parts = append(parts, strconv.FormatBool(citations))
+		for _, file := range []string{mergePromptFile, refinePromptFile} {
+			var text []byte
+			if file != "" {
+				var err error
+				if text, err = os.ReadFile(file); err != nil {
+					return "", fmt.Errorf("failed to read prompt file: %w", err)
+				}
+			}
+			parts = append(parts, string(text))
+		}
+	}
+	endpoints, err := fallbackEndpoints(endpointConf)
+	if err != nil {
+		return "", err
+	}
+	if stage.Mode == pipeline.ModeMap && prefilterEndpoint != "" {
+		// The prefilter decides which chunks a map stage analyzes.
+		prefilterConf, err := findEndpoint(prefilterEndpoint)
+		if err != nil {
+			return "", err
+		}
+		var goal []byte
+		if prefilterPrompt != "" {
+			if goal, err = os.ReadFile(prefilterPrompt); err != nil {
+				return "", fmt.Errorf("failed to read prefilter prompt file: %w", err)
+			}
+		}
+		parts = append(parts, string(goal))
+		endpoints = append(endpoints, prefilterConf)
+	}
+	for _, conf := range endpoints {
+		endpointParts, err := endpointKey(conf)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, endpointParts...)
+	}
+	return pipeline.Key(parts...), nil
+}
+
+// endpointKey returns the settings of an endpoint that change its answers.
+func endpointKey(conf config.EndpointConfig) ([]string, error) {
+	parts := []string{
+		conf.Name, conf.Provider, conf.EndpointURL, conf.Model, conf.SystemPrompt,
+		strconv.Itoa(conf.ContextWindowSize), strconv.Itoa(conf.ChunkSize), strconv.Itoa(conf.MaxOutputTokens),
+		strconv.FormatBool(conf.NativeJSONSchema()), strconv.Itoa(len(conf.EndpointURLs)),
+	}
+	for _, replica := range conf.EndpointURLs {
+		parts = append(parts, replica.URL)
+	}
+	if conf.Provider == config.ProviderMock && conf.Mock.ResponseFile != "" {
+		response, err := os.ReadFile(conf.Mock.ResponseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response file of endpoint '%s': %w", conf.Name, err)
+		}
+		parts = append(parts, string(response))
+	}
+	return parts, nil
+}
+
+// runStage runs one stage unless its cached output is up to date, and
+// returns the path of the output. With --resume, a map stage that stopped
+// early keeps the results it has if its key is unchanged.
+func runStage(cmd *cobra.Command, p *pipeline.Pipeline, stage *pipeline.Stage) (string, bool, error) {
+	if stage.Endpoint == "" {
+		return "", false, fmt.Errorf("no endpoint set for the stage or the pipeline, and no --endpoint-name given")
+	}
+	endpointConf, err := findEndpoint(stage.Endpoint)
+	if err != nil {
+		return "", false, err
+	}
+
+	inputPath := stage.Input
+	dep := p.Dependency(stage)
+	format := extractor.DetectFormat(inputPath)
+	if dep != nil {
+		// The output of an earlier stage is text or JSONL, whatever --format says.
+		inputPath = p.OutputPath(dep)
+		format = extractor.DetectFormat(inputPath)
+	} else if format, err = resolveFormat(inputPath); err != nil {
+		return "", false, err
+	}
+	cite := citations && stage.Mode == pipeline.ModeReduce && dep != nil && dep.Mode == pipeline.ModeMap
+	if cite && stage.Strategy == summarizer.StrategyMerge {
+		return "", false, fmt.Errorf("--citations cannot be used with the merge strategy")
+	}
+
+	var prompt, schemaText []byte
+	if stage.Prompt != "" {
+		if prompt, err = os.ReadFile(stage.Prompt); err != nil {
+			return "", false, fmt.Errorf("failed to read prompt file: %w", err)
+		}
+	}
+	if stage.Schema != "" {
+		if schemaText, err = os.ReadFile(stage.Schema); err != nil {
+			return "", false, fmt.Errorf("failed to read schema file: %w", err)
+		}
+	}
+	inputHash, err := pipeline.HashFile(inputPath)
+	if err != nil {
+		return "", false, err
+	}
+	key, err := stageKey(stage, endpointConf, prompt, schemaText, inputHash, format)
+	if err != nil {
+		return "", false, err
+	}
+
+	output := p.OutputPath(stage)
+	if !forceStages && p.Cached(stage, key) {
+		return output, true, nil
+	}
+	resumed := resume && stage.Mode == pipeline.ModeMap && p.Started(stage, key)
+	if !resumed {
+		// The usage of an earlier run of the stage does not count.
+		runStats.Reset(prefilterStage(stage.Name))
+		runStats.Reset(stage.Name)
+		if err := p.Reset(stage); err != nil {
+			return "", false, err
+		}
+		if err := p.Start(stage, key); err != nil {
+			return "", false, err
+		}
+	}
+	if verbose {
+		cmd.Printf("Running stage %s (%s) on %s\n", stage.Name, stage.Mode, inputPath)
+	}
+
+	sch, err := loadSchema(stage.Schema)
+	if err != nil {
+		return "", false, err
+	}
+	s, err := splitter.NewSplitter(endpointConf.ChunkSize)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to create splitter: %w", err)
+	}
+	ctx := context.Background()
+
+	var result []byte
+	switch stage.Mode {
+	case pipeline.ModeMap:
+		dir := p.Dir(stage)
+		chunks, err := splitInput(cmd, s, inputPath, format)
+		if err != nil {
+			return "", false, err
+		}
+		if err := workdir.WriteChunks(dir, chunks); err != nil {
+			return "", false, err
+		}
+		if err := analyzeStage(cmd, dir, chunks, endpointConf, stage.Name, string(prompt), sch); err != nil {
+			return "", false, err
+		}
+		results, err := workdir.ReadResults(dir, chunks)
+		if err != nil {
+			return "", false, err
+		}
+		result = []byte(strings.Join(results, "\n\n"))
+
+	case pipeline.ModeReduce:
+		results, chunks, err := reduceInputs(p, dep, inputPath, format)
+		if err != nil {
+			return "", false, err
+		}
+		client, err := newStageClient(cmd, endpointConf, stage.Name)
+		if err != nil {
+			return "", false, err
+		}
+		strategy := reduceStrategy
+		if stage.Strategy != "" {
+			strategy = stage.Strategy
+		}
+		sum, err := newSummarizer(cmd, client, endpointConf, strategy, sch, cite)
+		if err != nil {
+			return "", false, err
+		}
+		summaryPrompt := string(prompt)
+		if cite {
+			summaryPrompt = withCitationInstruction(summaryPrompt)
+			for i := range results {
+				results[i] = citation.TagResult(chunks[i].Index, results[i])
+			}
+		}
+		summary, err := sum.SummarizeResults(ctx, results, summaryPrompt)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to generate summary: %w", err)
+		}
+		if cite {
+			summary = addReferences(cmd, summary, chunks, sch != nil)
+		}
+		result = []byte(summary)
+
+	case pipeline.ModePerRecord, pipeline.ModeFilter:
+		if format != extractor.FormatJSONL {
+			return "", false, fmt.Errorf("%s stages need JSONL input, got %s", stage.Mode, inputPath)
+		}
+		input, err := os.Open(inputPath)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to open input file: %w", err)
+		}
+		recs, err := records.Read(input)
+		input.Close()
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read records: %w", err)
+		}
+
+		recordPrompt := string(prompt)
+		if stage.Mode == pipeline.ModeFilter {
+			recordPrompt += "\n\n" + filterInstruction
+			if sch, err = schema.Parse("filter", []byte(filterSchema)); err != nil {
+				return "", false, err
+			}
+		}
+		client, err := newStageClient(cmd, endpointConf, stage.Name)
+		if err != nil {
+			return "", false, err
+		}
+		processor := records.NewProcessor(client, s, recordPrompt, endpointConf.ChunkSize)
+		processor.BatchSize = batchSize
+		processor.Retries = recordRetries
+		processor.Concurrency = concurrency
+		processor.Schema = sch
+		results, err := processor.Run(ctx, recs)
+		if err != nil {
+			return "", false, err
+		}
+		if result, err = recordOutput(cmd, stage.Mode, results); err != nil {
+			return "", false, err
+		}
+	}
+
+	if err := os.WriteFile(output, result, 0644); err != nil {
+		return "", false, fmt.Errorf("failed to write stage output: %w", err)
+	}
+	if err := p.Commit(stage, key); err != nil {
+		return "", false, err
+	}
+	return output, false, nil
+}
+
+// reduceInputs returns the results a reduce stage combines: the chunk results
+// of a map stage with their chunks, the lines of a JSONL input, or the whole
+// text of any other input.
+func reduceInputs(p *pipeline.Pipeline, dep *pipeline.Stage, inputPath string, format extractor.Format) ([]string, []splitter.Chunk, error) {
+	if dep != nil && dep.Mode == pipeline.ModeMap {
+		dir := p.Dir(dep)
+		chunks, err := workdir.ReadChunks(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		results, err := workdir.ReadResults(dir, chunks)
+		return results, chunks, err
+	}
+
+	data, err := os.ReadFile(inputPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read input file: %w", err)
+	}
+	if format != extractor.FormatJSONL {
+		return []string{string(data)}, nil, nil
+	}
+	var results []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			results = append(results, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read input file: %w", err)
+	}
+	return results, nil, nil
+}
+
+// recordOutput writes the results of a per-record stage as joined records,
+// and of a filter stage as the original records the model kept.
+func recordOutput(cmd *cobra.Command, mode string, results []records.Result) ([]byte, error) {
+	var b bytes.Buffer
+	for _, result := range results {
+		if result.Err != nil {
+			cmd.PrintErrf("Warning: no valid result for the record in line %d: %v\n", result.Record.ID, result.Err)
+		}
+		if mode == pipeline.ModeFilter {
+			var keep bool
+			if result.Err != nil || json.Unmarshal(result.Fields["keep"], &keep) != nil || !keep {
+				continue
+			}
+			b.Write(result.Record.Data)
+			b.WriteString("\n")
+			continue
+		}
+		line, err := records.Join(result)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/workdir"
+)
+
+func TestPipelineRun(t *testing.T) {
+	files := newTestFiles(t)
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: pipeline-mock
+    provider: mock
+    model: "mock-model"
+    context_window_size: 2000
+    chunk_size: 50
+`)
+	files.write("details.txt", "Find the details:")
+	files.write("summary.txt", "Summarize the details:")
+	files.write("input.md", "# Incidents\n\n"+strings.Repeat("The database was slow again. ", 30))
+	pipelineFile := files.write("pipeline.yaml", `
+endpoint: pipeline-mock
+stages:
+  - name: details
+    input: input.md
+    mode: map
+    prompt: details.txt
+  - name: summary
+    input: details
+    mode: reduce
+    prompt: summary.txt
+    output: report.txt
+`)
+	run := func(args ...string) string {
+		t.Helper()
+		stdout, stderr, err := execute(append([]string{"pipeline", "run", "--config", configFile}, append(args, pipelineFile)...)...)
+		if err != nil {
+			t.Fatalf("pipeline run failed: %v\n%s", err, stderr)
+		}
+		return stdout + stderr
+	}
+
+	output := run("--citations")
+	for _, want := range []string{"Stage details (map): done", "Stage summary (reduce): done"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q, got:\n%s", want, output)
+		}
+	}
+	full := readTotal(t, files.path(".pipeline-cache"))
+	dir := files.path(".pipeline-cache/details")
+	chunks, err := workdir.ReadChunks(dir)
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("expected the chunks of the map stage in its cache directory, got %d (%v)", len(chunks), err)
+	}
+	if chunks[0].Section != "# Incidents" {
+		t.Errorf("expected the input to be read as Markdown, got section %q", chunks[0].Section)
+	}
+	if served, err := workdir.ReadServed(dir); err != nil || len(served) != len(chunks) {
+		t.Errorf("expected the endpoint of every chunk in served.jsonl, got %d (%v)", len(served), err)
+	}
+	report, err := os.ReadFile(files.path("report.txt"))
+	if err != nil {
+		t.Fatalf("expected the output of the reduce stage: %v", err)
+	}
+	if !strings.Contains(string(report), "Summarize the details:") || !strings.Contains(string(report), "## References") {
+		t.Errorf("expected a summary with references, got %q", report)
+	}
+
+	// A new merge prompt only runs the reduce stage again.
+	output = run("--citations", "--merge-prompt-file", files.write("merge.txt", "Combine the details:"))
+	for _, want := range []string{"Stage details (map): cached", "Stage summary (reduce): done"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q, got:\n%s", want, output)
+		}
+	}
+
+	// A budget stop keeps the results of the map stage for --resume.
+	if _, _, err := execute("pipeline", "run", "--config", configFile, "--force", "--max-total-tokens", "200", pipelineFile); err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Fatalf("expected a budget stop, got %v", err)
+	}
+	if pending := workdir.Pending(dir, chunks); len(pending) == 0 || len(pending) == len(chunks) {
+		t.Errorf("expected some chunks to be analyzed before the stop, %d of %d are pending", len(pending), len(chunks))
+	}
+	run("--resume")
+	if resumed := readTotal(t, files.path(".pipeline-cache")); resumed.Requests != full.Requests {
+		t.Errorf("expected the resumed run to analyze the pending chunks only: %d requests in total, %d in a full run", resumed.Requests, full.Requests)
+	}
+	if served, err := workdir.ReadServed(dir); err != nil || len(served) != len(chunks) {
+		t.Errorf("expected the endpoint of every chunk after the resume, got %d (%v)", len(served), err)
+	}
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+
+	"llm-data-analyzer/pkg/llm"
+)
+
+// recording is the recording of the running command, opened by the first
+// client that uses it.
+var recording *llm.Recording
+
+// openRecording returns the recording of --record or --replay, or nil if
+// neither is set.
+func openRecording() (*llm.Recording, error) {
+	if recordDir != "" && replayDir != "" {
+		return nil, fmt.Errorf("--record and --replay cannot be used together")
+	}
+	dir, replay := recordDir, false
+	if replayDir != "" {
+		dir, replay = replayDir, true
+	}
+	if dir == "" {
+		return nil, nil
+	}
+	if recording != nil && recording.Dir() == dir && recording.Replay == replay {
+		return recording, nil
+	}
+	r, err := llm.NewRecording(dir, replay)
+	if err != nil {
+		return nil, err
+	}
+	recording = r
+	return r, nil
+}
@@ -16,19 +16,24 @@ limitations under the License.
 package cmd
 
 import (
-	"context"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
+	"time"
 
+	"llm-data-analyzer/pkg/cache"
+	"llm-data-analyzer/pkg/citation"
 	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/extractor"
 	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/schema"
 	"llm-data-analyzer/pkg/splitter"
 	"llm-data-analyzer/pkg/summarizer"
 
 	"github.com/spf13/cobra"
+	"go.yaml.in/yaml/v3"
 )
 
 var (
@@ -41,6 +46,34 @@ var (
 	keepTempDir        bool
 	verbose            bool
 	isJSONL            bool
+	inputFormat        string
+	splitMode          string
+	citations          bool
+	concurrency        int
+	fanIn              int
+	reduceStrategy     string
+	refinePromptFile   string
+	mergePromptFile    string
+	analysisSchemaFile string
+	summarySchemaFile  string
+	schemaRetries      int
+	mergeRulesFile     string
+	runMode            string
+	batchSize          int
+	recordRetries      int
+	prefilterEndpoint  string
+	prefilterPrompt    string
+	dryRun             bool
+	maxTotalTokens     int
+	maxCost            float64
+	resume             bool
+	noCache            bool
+	refreshCache       bool
+	cacheDir           string
+	cacheTTL           time.Duration
+	cacheMaxSize       int64
+	recordDir          string
+	replayDir          string
 
 	appConfig config.Config
 )
@@ -54,197 +87,238 @@ var rootCmd = &cobra.Command{
 It breaks down the input file into smaller chunks that fit within the context window of a specified Large Language Model (LLM).
 Each chunk is analyzed individually, and the results are then summarized to produce a final, consolidated report.`,
 	Args: cobra.ExactArgs(1),
-	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		// Skip flag validation for version, help, and completion commands
-		if cmd.Name() == "version" || cmd.Name() == "help" || cmd.Name() == "completion" {
-			return nil
-		}
-
-		if analysisPromptFile == "" {
-			return fmt.Errorf("required flag \"analysis-prompt-file\" not set")
-		}
-		if summaryPromptFile == "" {
-			return fmt.Errorf("required flag \"summary-prompt-file\" not set")
-		}
-		if endpointName == "" {
-			return fmt.Errorf("required flag \"endpoint-name\" not set")
-		}
-		return nil
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkRunFlags()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// Load config here
-		var err error
-		appConfig, err = config.LoadConfig(cfgFile)
-		if err != nil {
-			return fmt.Errorf("Error loading config file: %w", err)
-		}
-
-		// 1. Get input file path
-		inputFile := args[0]
-
-		// 2. Select endpoint configuration
-		var endpointConf config.EndpointConfig
-		for _, ep := range appConfig.Endpoints {
-			if ep.Name == endpointName {
-				endpointConf = ep
-				break
-			}
-		}
-		if endpointConf.Name == "" {
-			return fmt.Errorf("endpoint '%s' not found in config file", endpointName)
-		}
+		return runAll(cmd, args[0])
+	},
+}
 
-		// 3. Create and manage temporary directory
-		workDir := tempDir
-		if workDir == "" {
-			workDir, err = os.MkdirTemp("", "llm-analyzer-*")
-			if err != nil {
-				return fmt.Errorf("failed to create temporary directory: %w", err)
-			}
-			if !keepTempDir {
-				defer os.RemoveAll(workDir)
-			}
-		}
-		if verbose {
-			cmd.Printf("Using temporary directory: %s\n", workDir)
-		}
+// selectEndpoint loads the config file and returns the configuration of the
+// endpoint selected with --endpoint-name.
+func selectEndpoint() (config.EndpointConfig, error) {
+	var err error
+	appConfig, err = config.LoadConfig(cfgFile)
+	if err != nil {
+		return config.EndpointConfig{}, fmt.Errorf("Error loading config file: %w", err)
+	}
+	return findEndpoint(endpointName)
+}
 
-		// 4. Open input file
-		file, err := os.Open(inputFile)
-		if err != nil {
-			return fmt.Errorf("failed to open input file: %w", err)
+// findEndpoint returns the configuration of a named endpoint of the loaded
+// config file.
+func findEndpoint(name string) (config.EndpointConfig, error) {
+	for _, ep := range appConfig.Endpoints {
+		if ep.Name == name {
+			return ep, nil
 		}
-		defer file.Close()
+	}
+	return config.EndpointConfig{}, fmt.Errorf("endpoint '%s' not found in config file", name)
+}
 
-		// 5. Create splitter and split the file
-		s, err := splitter.NewSplitter(endpointConf.ChunkSize)
-		if err != nil {
-			return fmt.Errorf("failed to create splitter: %w", err)
-		}
+// splitInput reads the input file, extracts the text of documents and splits
+// it into chunks according to the input format and --split-mode.
+func splitInput(cmd *cobra.Command, s *splitter.Splitter, inputFile string, format extractor.Format) ([]splitter.Chunk, error) {
+	file, err := os.Open(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer file.Close()
 
-		var chunks []string
-		if isJSONL {
-			chunks, err = s.SplitJSONL(file)
-		} else {
-			chunks, err = s.Split(file)
-		}
+	var input io.Reader = file
+	if format.IsDocument() {
+		text, err := extractText(file, format)
 		if err != nil {
-			return fmt.Errorf("failed to split file: %w", err)
+			return nil, err
 		}
-
 		if verbose {
-			cmd.Printf("File split into %d chunks.\n", len(chunks))
-		}
-
-		// 6. Create LLM client
-		apiKey := ""
-		if endpointConf.APIKeyEnv != "" {
-			apiKey = os.Getenv(endpointConf.APIKeyEnv)
-			if apiKey == "" {
-				return fmt.Errorf("API key environment variable '%s' not set", endpointConf.APIKeyEnv)
-			}
+			cmd.Printf("Extracted %d bytes of text from %s input.\n", len(text), format)
 		}
-		client := llm.NewClient(endpointConf.EndpointURL, apiKey, endpointConf.Model)
-
-		// 7. Read analysis prompt
-		promptBytes, err := os.ReadFile(analysisPromptFile)
-		if err != nil {
-			return fmt.Errorf("failed to read analysis prompt file: %w", err)
-		}
-		analysisPrompt := string(promptBytes)
-
-		// 8. Analyze all chunks in parallel
-		var wg sync.WaitGroup
-		errorChan := make(chan error, len(chunks))
-
-		for i, chunk := range chunks {
-			wg.Add(1)
-			go func(chunkIndex int, chunkText string) {
-				defer wg.Done()
-
-				fullPrompt := fmt.Sprintf("%s\n\n--- Data ---\n%s", analysisPrompt, chunkText)
-				if verbose {
-					cmd.Printf("Analyzing chunk %d...\n", chunkIndex+1)
-				}
-
-				result, err := client.Analyze(context.Background(), fullPrompt)
-				if err != nil {
-					errorChan <- fmt.Errorf("failed to analyze chunk %d: %w", chunkIndex+1, err)
-					return
-				}
+		input = strings.NewReader(text)
+	}
 
-				// Save result to temporary file
-				resultFile := filepath.Join(workDir, fmt.Sprintf("chunk_%d.txt", chunkIndex+1))
-				if err := os.WriteFile(resultFile, []byte(result), 0644); err != nil {
-					errorChan <- fmt.Errorf("failed to write result for chunk %d: %w", chunkIndex+1, err)
-				}
-			}(i, chunk)
-		}
+	s.DocumentMarkers = format.IsDocument()
+
+	var chunks []splitter.Chunk
+	switch {
+	case format == extractor.FormatJSONL:
+		chunks, err = s.SplitJSONL(input)
+	case splitMode == "markdown":
+		chunks, err = s.SplitMarkdown(input)
+	case splitMode == "tokens":
+		chunks, err = s.Split(input)
+	default:
+		return nil, fmt.Errorf("invalid --split-mode '%s': must be 'tokens' or 'markdown'", splitMode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to split file: %w", err)
+	}
+	for i := range chunks {
+		chunks[i].Source = inputFile
+	}
 
-		wg.Wait()
-		close(errorChan)
+	if verbose {
+		cmd.Printf("File split into %d chunks.\n", len(chunks))
+	}
+	return chunks, nil
+}
 
-		// Check for errors during chunk analysis
-		for err := range errorChan {
-			return err // Return the first error encountered
+// newClient creates an LLM client for an endpoint configuration.
+func newClient(endpointConf config.EndpointConfig) (*llm.Client, error) {
+	apiKey := ""
+	if endpointConf.APIKeyEnv != "" {
+		apiKey = os.Getenv(endpointConf.APIKeyEnv)
+		// A replay sends no requests and needs no key.
+		if apiKey == "" && replayDir == "" {
+			return nil, fmt.Errorf("API key environment variable '%s' not set", endpointConf.APIKeyEnv)
 		}
-
-		if verbose {
-			cmd.Println("\nAll chunks analyzed successfully.")
+	}
+	client := llm.NewClient(endpointConf.EndpointURL, apiKey, endpointConf.Model)
+	client.SystemPrompt = endpointConf.SystemPrompt
+	client.MaxTokens = endpointConf.MaxOutputTokens
+	client.SupportsJSONSchema = endpointConf.NativeJSONSchema()
+	client.RateLimiter = llm.SharedRateLimiter(endpointConf.Name, endpointConf.RequestsPerMinute, endpointConf.TokensPerMinute)
+	client.Retries = endpointConf.Retries
+	if len(endpointConf.EndpointURLs) > 0 {
+		replicas := make([]llm.Replica, len(endpointConf.EndpointURLs))
+		for i, replica := range endpointConf.EndpointURLs {
+			replicas[i] = llm.Replica{URL: replica.URL, Weight: replica.Weight}
 		}
-
-		// 9. Combine results and generate final summary
-		if verbose {
-			cmd.Println("Combining results and generating final summary...")
+		balancer, err := llm.SharedBalancer(endpointConf.Name, replicas, endpointConf.LoadBalancing)
+		if err != nil {
+			return nil, err
 		}
-
-		files, err := os.ReadDir(workDir)
+		client.Balancer = balancer
+	}
+	cb := endpointConf.CircuitBreaker
+	client.Breaker = llm.SharedCircuitBreaker(endpointConf.Name, cb.Failures, cb.Cooldown, cb.Wait)
+	client.Name = endpointConf.Name
+	switch endpointConf.Provider {
+	case "", config.ProviderOpenAI:
+	case config.ProviderMock:
+		mock, err := newMock(endpointConf.Mock)
 		if err != nil {
-			return fmt.Errorf("failed to read temporary directory: %w", err)
+			return nil, fmt.Errorf("invalid mock of endpoint '%s': %w", endpointConf.Name, err)
 		}
-
-		var combinedResults strings.Builder
-		for _, file := range files {
-			content, err := os.ReadFile(filepath.Join(workDir, file.Name()))
-			if err != nil {
-				return fmt.Errorf("failed to read intermediate file %s: %w", file.Name(), err)
-			}
-			combinedResults.Write(content)
-			combinedResults.WriteString("\n\n---\n\n")
+		client.Mock = mock
+	default:
+		return nil, fmt.Errorf("invalid provider '%s' of endpoint '%s': must be '%s' or '%s'", endpointConf.Provider, endpointConf.Name, config.ProviderOpenAI, config.ProviderMock)
+	}
+	rec, err := openRecording()
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		client.Recording = rec
+		if rec.Replay {
+			// A replay sends nothing, and its answers do not change when
+			// asked again.
+			client.RateLimiter = nil
+			client.Retries = 0
 		}
+		// Every request must reach the recording.
+		return client, nil
+	}
+	if client.Mock != nil {
+		// The answers of a mock depend on its config, which is not part of
+		// the cache key, and its latency and failures must apply every time.
+		return client, nil
+	}
+	responses, err := openResponseCache()
+	if err != nil {
+		return nil, err
+	}
+	if responses != nil {
+		client.Cache = responses
+	}
+	return client, nil
+}
 
-		summaryPromptBytes, err := os.ReadFile(summaryPromptFile)
-		if err != nil {
-			return fmt.Errorf("failed to read summary prompt file: %w", err)
-		}
-		summaryPrompt := string(summaryPromptBytes)
+// loadSchema loads the JSON Schema file given by a schema flag, or returns nil
+// if the flag is not set.
+func loadSchema(path string) (*schema.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	sch, err := schema.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load schema: %w", err)
+	}
+	return sch, nil
+}
 
-		// Create a summarizer and generate the final report
-		summarizer, err := summarizer.NewSummarizer(client, endpointConf.ContextWindowSize, verbose, cmd)
-		if err != nil {
-			return fmt.Errorf("failed to create summarizer: %w", err)
-		}
+// loadMergeRules reads the field rules of the merge strategy from a YAML file
+// that maps field paths to rules.
+func loadMergeRules(path string) (summarizer.MergeRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read merge rules file: %w", err)
+	}
+	var spec map[string]string
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse merge rules file: %w", err)
+	}
+	rules, err := summarizer.ParseMergeRules(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid merge rules file: %w", err)
+	}
+	return rules, nil
+}
 
-		finalResult, err := summarizer.Summarize(context.Background(), combinedResults.String(), summaryPrompt)
+// resolveFormat determines the input format from the --format and --jsonl
+// flags, falling back to the file extension for document formats.
+func resolveFormat(inputFile string) (extractor.Format, error) {
+	if inputFormat != "" {
+		format, err := extractor.ParseFormat(inputFormat)
 		if err != nil {
-			return fmt.Errorf("failed to generate final summary: %w", err)
+			return "", fmt.Errorf("invalid --format: %w", err)
 		}
+		return format, nil
+	}
+	if isJSONL {
+		return extractor.FormatJSONL, nil
+	}
+	if format := extractor.DetectFormat(inputFile); format.IsDocument() {
+		return format, nil
+	}
+	return extractor.FormatText, nil
+}
 
-		// 10. Output final result
-		if outputFile != "" {
-			if err := os.WriteFile(outputFile, []byte(finalResult), 0644); err != nil {
-				return fmt.Errorf("failed to write output file: %w", err)
-			}
-			if verbose {
-				cmd.Printf("Final summary written to %s\n", outputFile)
-			}
-		} else {
-			cmd.Println("\n--- Final Summary ---")
-			cmd.Println(finalResult)
-		}
+// extractText converts a document input file into plain text.
+func extractText(file *os.File, format extractor.Format) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat input file: %w", err)
+	}
+	text, err := extractor.Extract(file, info.Size(), format)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract text from %s input: %w", format, err)
+	}
+	return text, nil
+}
 
-		return nil
-	},
+// withCitationInstruction appends the citation instruction to a prompt. An
+// empty prompt stands for the built-in merge prompt.
+func withCitationInstruction(prompt string) string {
+	if prompt == "" {
+		prompt = summarizer.DefaultMergePrompt
+	}
+	return prompt + "\n\n" + citation.Instruction
+}
+
+// reportCitationProblems warns about statements of the final summary that
+// lost their citations and about citations of chunks that do not exist.
+func reportCitationProblems(cmd *cobra.Command, report citation.Report) {
+	if len(report.Unknown) > 0 {
+		cmd.PrintErrf("Warning: the summary cites unknown chunks: %v\n", report.Unknown)
+	}
+	if len(report.Uncited) > 0 {
+		cmd.PrintErrf("Warning: %d statements in the summary have no citation:\n", len(report.Uncited))
+		for _, claim := range report.Uncited {
+			cmd.PrintErrf("  %s\n", claim)
+		}
+	}
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -266,10 +340,42 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "config file")
 	rootCmd.PersistentFlags().StringVarP(&endpointName, "endpoint-name", "e", "", "Name of the LLM endpoint to use (defined in config file)")
 	rootCmd.PersistentFlags().StringVar(&analysisPromptFile, "analysis-prompt-file", "", "Path to the data analysis prompt file (required)")
-	rootCmd.PersistentFlags().StringVar(&summaryPromptFile, "summary-prompt-file", "", "Path to the summary prompt file (required)")
+	rootCmd.PersistentFlags().StringVar(&summaryPromptFile, "summary-prompt-file", "", "Path to the summary prompt file (required, except with --reduce-strategy merge)")
 	rootCmd.PersistentFlags().StringVarP(&outputFile, "output", "o", "", "Path to the output file (default is stdout)")
 	rootCmd.PersistentFlags().StringVar(&tempDir, "temp-dir", "", "Path to the temporary directory for intermediate files")
 	rootCmd.PersistentFlags().BoolVar(&keepTempDir, "keep-temp-dir", false, "Keep the temporary directory after execution")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
 	rootCmd.PersistentFlags().BoolVar(&isJSONL, "jsonl", false, "Treat the input file as JSONL")
+	rootCmd.PersistentFlags().StringVar(&splitMode, "split-mode", "tokens", "How to split text input: 'tokens' (fixed token windows) or 'markdown' (whole sections with heading breadcrumbs)")
+	rootCmd.PersistentFlags().IntVar(&concurrency, "concurrency", summarizer.DefaultConcurrency, "Maximum number of concurrent LLM requests in the map and reduce phases")
+	rootCmd.PersistentFlags().IntVar(&fanIn, "fan-in", summarizer.DefaultFanIn, "Maximum number of results merged by one node of the reduce tree")
+	rootCmd.PersistentFlags().StringVar(&mergePromptFile, "merge-prompt-file", "", "Path to the prompt for intermediate reduce levels (default is a built-in merge prompt); the summary prompt is used for the final request only")
+	rootCmd.PersistentFlags().StringVar(&reduceStrategy, "reduce-strategy", summarizer.StrategyTree, "How to reduce intermediate results: 'tree' (parallel fan-in merge), 'refine' (running report updated in order) or 'merge' (deterministic merge of JSON results)")
+	rootCmd.PersistentFlags().StringVar(&mergeRulesFile, "merge-rules-file", "", "Path to a YAML file with the per-field rules of --reduce-strategy merge")
+	rootCmd.PersistentFlags().StringVar(&refinePromptFile, "refine-prompt-file", "", "Path to the prompt template of a refine step (default is a built-in template)")
+	rootCmd.PersistentFlags().BoolVar(&citations, "citations", false, "Tag intermediate results with [chunk N], keep the tags in the summary and append a reference list")
+	rootCmd.PersistentFlags().StringVar(&analysisSchemaFile, "analysis-schema-file", "", "Path to a JSON Schema for the chunk analysis results; each response is validated and stored as JSON")
+	rootCmd.PersistentFlags().StringVar(&summarySchemaFile, "summary-schema-file", "", "Path to a JSON Schema for the final summary; the report is emitted as validated JSON")
+	rootCmd.PersistentFlags().IntVar(&schemaRetries, "schema-retries", schema.DefaultRetries, "Number of repair attempts for a response that fails schema validation")
+	rootCmd.PersistentFlags().StringVar(&runMode, "mode", modeSummarize, "Run mode: 'summarize' (analyze chunks and summarize them) or 'map-only' (one result per JSONL record, written as JSONL)")
+	rootCmd.PersistentFlags().IntVar(&batchSize, "batch-size", records.DefaultBatchSize, "Maximum number of records per request in map-only mode")
+	rootCmd.PersistentFlags().IntVar(&recordRetries, "record-retries", records.DefaultRetries, "Number of retries for a record the model skipped or answered invalidly in map-only mode")
+	rootCmd.PersistentFlags().StringVar(&prefilterEndpoint, "prefilter-endpoint", "", "Name of a cheap endpoint that decides whether each chunk is relevant before the analysis; irrelevant chunks are skipped")
+	rootCmd.PersistentFlags().StringVar(&prefilterPrompt, "prefilter-prompt-file", "", "Path to the analysis goal given to the prefilter (default is the analysis prompt)")
+	// The estimate covers a complete run, so the stage subcommands have no
+	// dry run.
+	for _, c := range []*cobra.Command{rootCmd, runCmd} {
+		c.Flags().BoolVar(&dryRun, "dry-run", false, "Split the input and print the estimated chunks, tokens, requests and cost of every stage without calling the LLM")
+	}
+	rootCmd.PersistentFlags().IntVar(&maxTotalTokens, "max-total-tokens", 0, "Stop the run before its input and output tokens exceed this number (0 means no limit)")
+	rootCmd.PersistentFlags().Float64Var(&maxCost, "max-cost", 0, "Stop the run before its cost at the configured token prices exceeds this amount (0 means no limit)")
+	rootCmd.PersistentFlags().BoolVar(&resume, "resume", false, "Skip the chunks, or records in map-only mode, that already have a result in the work directory, e.g. to continue a run stopped by a budget")
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "Do not read or write the response cache")
+	rootCmd.PersistentFlags().BoolVar(&refreshCache, "refresh-cache", false, "Send every request again and replace its cached response")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", "", "Directory of the response cache (default is llm-data-analyzer/responses in the user cache directory)")
+	rootCmd.PersistentFlags().DurationVar(&cacheTTL, "cache-ttl", cache.DefaultTTL, "How long a cached response is used (0 means forever)")
+	rootCmd.PersistentFlags().Int64Var(&cacheMaxSize, "cache-max-size", cache.DefaultMaxBytes>>20, "Size limit of the response cache in MB, enforced when a run starts and by 'cache prune' (0 means no limit)")
+	rootCmd.PersistentFlags().StringVar(&recordDir, "record", "", "Save every request and its response to this directory")
+	rootCmd.PersistentFlags().StringVar(&replayDir, "replay", "", "Answer the requests from a recording made with --record instead of sending them")
+	rootCmd.PersistentFlags().StringVar(&inputFormat, "format", "", "Input format: text, jsonl, html, markdown, pdf or docx (default is detected from the file extension)")
 }
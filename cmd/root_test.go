@@ -1,17 +1,26 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 func TestRootCmd(t *testing.T) {
+	// Keep the response cache of the runs out of the user's cache directory.
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
 	// 1. Create a mock LLM server
 	analysisCount := 0
 	summaryCount := 0
@@ -87,4 +96,186 @@ endpoints:
 	if summaryCount != 1 {
 		t.Errorf("expected 1 summary call, got %d", summaryCount)
 	}
-}
\ No newline at end of file
+}
+
+func TestRecordReplay(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Cleanup(func() {
+		recordDir, replayDir, outputFile = "", "", ""
+		recording = nil
+	})
+
+	var requests atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "Summarize the following analysis") {
+			w.Write([]byte(`{"choices": [{"message": {"content": "Final summary."}}]}`))
+		} else {
+			w.Write([]byte(`{"choices": [{"message": {"content": "chunk summary"}}]}`))
+		}
+	}))
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	configFile := write("config.yaml", `
+endpoints:
+  - name: test-endpoint
+    endpoint_url: "`+mockServer.URL+`"
+    model: "test-model"
+    context_window_size: 100
+    chunk_size: 100
+`)
+	analysisPrompt := write("analysis.txt", "Analyze this:")
+	summaryPrompt := write("summary.txt", "Summarize the following analysis:")
+	input := write("input.txt", strings.Repeat("This is a test sentence. ", 20))
+	recordingDir := dir + "/recording"
+
+	run := func(output string, flags ...string) error {
+		rootCmd.SetArgs(append([]string{
+			"--config", configFile,
+			"--endpoint-name", "test-endpoint",
+			"--analysis-prompt-file", analysisPrompt,
+			"--summary-prompt-file", summaryPrompt,
+			"--output", output,
+			input,
+		}, flags...))
+		return rootCmd.ExecuteContext(context.Background())
+	}
+
+	recorded := dir + "/recorded.txt"
+	if err := run(recorded, "--record", recordingDir, "--replay="); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+	mockServer.Close()
+	if requests.Load() != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests.Load())
+	}
+
+	replayed := dir + "/replayed.txt"
+	if err := run(replayed, "--record=", "--replay", recordingDir); err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	want, _ := os.ReadFile(recorded)
+	got, _ := os.ReadFile(replayed)
+	if string(got) != string(want) || !strings.Contains(string(got), "Final summary.") {
+		t.Errorf("expected the recorded report %q, got %q", want, got)
+	}
+
+	write("analysis.txt", "Analyze this differently:")
+	if err := run(replayed, "--record=", "--replay", recordingDir); err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("expected a replay miss, got %v", err)
+	}
+}
+
+func TestMockResponseFile(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Cleanup(func() { outputFile = "" })
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	responseFile := write("canned.txt", "First canned answer.")
+	configFile := write("config.yaml", `
+endpoints:
+  - name: mock-endpoint
+    provider: mock
+    model: "mock-model"
+    context_window_size: 1000
+    chunk_size: 100
+    mock:
+      response_file: "`+responseFile+`"
+`)
+	analysisPrompt := write("analysis.txt", "Analyze this:")
+	summaryPrompt := write("summary.txt", "Summarize the following analysis:")
+	input := write("input.txt", strings.Repeat("This is a test sentence. ", 20))
+	output := dir + "/output.txt"
+
+	for _, answer := range []string{"First canned answer.", "Second canned answer."} {
+		write("canned.txt", answer)
+		rootCmd.SetArgs([]string{
+			"--config", configFile,
+			"--endpoint-name", "mock-endpoint",
+			"--analysis-prompt-file", analysisPrompt,
+			"--summary-prompt-file", summaryPrompt,
+			"--output", output,
+			input,
+		})
+		if err := rootCmd.ExecuteContext(context.Background()); err != nil {
+			t.Fatalf("command failed: %v", err)
+		}
+		if got, _ := os.ReadFile(output); !strings.Contains(string(got), answer) {
+			t.Errorf("expected the report %q, got %q", answer, got)
+		}
+	}
+}
+
+// testFiles is the directory of the input, prompt and config files of a
+// command test.
+type testFiles struct {
+	t   *testing.T
+	dir string
+}
+
+// newTestFiles creates the directory of a command test and keeps the
+// response cache of its runs out of the user's cache directory.
+func newTestFiles(t *testing.T) *testFiles {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	return &testFiles{t: t, dir: t.TempDir()}
+}
+
+// path returns the path of a file in the directory.
+func (f *testFiles) path(name string) string {
+	return filepath.Join(f.dir, name)
+}
+
+// write writes a file to the directory and returns its path.
+func (f *testFiles) write(name, content string) string {
+	path := f.path(name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+	return path
+}
+
+// execute runs a command line and returns what it wrote to stdout and
+// stderr. The flags are reset afterwards, since their variables outlive the
+// run.
+func execute(args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetErr(&stderr)
+	rootCmd.SetArgs(args)
+	defer func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		resetFlags(rootCmd)
+	}()
+	err := rootCmd.ExecuteContext(context.Background())
+	return stdout.String(), stderr.String(), err
+}
+
+// resetFlags sets the flags of a command and its subcommands back to their
+// defaults.
+func resetFlags(c *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	}
+	c.PersistentFlags().VisitAll(reset)
+	c.Flags().VisitAll(reset)
+	for _, sub := range c.Commands() {
+		resetFlags(sub)
+	}
+}
@@ -0,0 +1,745 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"llm-data-analyzer/pkg/citation"
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/prefilter"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+	"llm-data-analyzer/pkg/stats"
+	"llm-data-analyzer/pkg/summarizer"
+	"llm-data-analyzer/pkg/workdir"
+
+	"github.com/spf13/cobra"
+)
+
+// runStats collects the token usage of the running command.
+var runStats = stats.New()
+
+func init() {
+	rootCmd.AddCommand(splitCmd, mapCmd, reduceCmd, runCmd)
+}
+
+var splitCmd = &cobra.Command{
+	Use:   "split [flags] <input_file_path> <work_dir>",
+	Short: "Split the input file into chunks in the work directory",
+	Long: `split extracts the text of the input file, splits it into chunks and writes
+chunks.jsonl and the chunk texts (text_N.txt) to the work directory.`,
+	Args: cobra.ExactArgs(2),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkEndpointFlag()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpointConf, err := selectEndpoint()
+		if err != nil {
+			return err
+		}
+		_, err = runSplit(cmd, args[0], args[1], endpointConf)
+		return err
+	},
+}
+
+var mapCmd = &cobra.Command{
+	Use:   "map [flags] <work_dir>",
+	Short: "Analyze the chunks of the work directory",
+	Long: `map analyzes every chunk written by split with the analysis prompt and writes
+the result of chunk N to chunk_N.txt in the work directory. With
+--prefilter-endpoint, only the chunks the prefilter finds relevant are analyzed;
+its decisions are saved to prefilter.jsonl.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkEndpointFlag(); err != nil {
+			return err
+		}
+		return checkMapFlags()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpointConf, err := selectEndpoint()
+		if err != nil {
+			return err
+		}
+		chunks, err := workdir.ReadChunks(args[0])
+		if err != nil {
+			return err
+		}
+		if runStats, err = stats.Load(args[0]); err != nil {
+			return err
+		}
+		if err := checkBudget(cmd, args[0], chunks, endpointConf, stats.StageMap); err != nil {
+			return err
+		}
+		runStats.SetBudget(maxTotalTokens, maxCost)
+		err = runMap(cmd, args[0], chunks, endpointConf)
+		if errors.Is(err, stats.ErrBudgetExceeded) {
+			return budgetStop(cmd, err, "run map again with --resume", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return printStats(cmd)
+	},
+}
+
+var reduceCmd = &cobra.Command{
+	Use:   "reduce [flags] <work_dir>",
+	Short: "Summarize the analysis results of the work directory",
+	Long: `reduce combines the analysis results written by map into the final report with
+the summary prompt. Chunks dropped by the prefilter are left out. Run it again with another prompt or reduce strategy without
+repeating the analysis.`,
+	Args: cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkEndpointFlag(); err != nil {
+			return err
+		}
+		return checkReduceFlags()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		endpointConf, err := selectEndpoint()
+		if err != nil {
+			return err
+		}
+		chunks, err := workdir.ReadChunks(args[0])
+		if err != nil {
+			return err
+		}
+		if runStats, err = stats.Load(args[0]); err != nil {
+			return err
+		}
+		if err := checkBudget(cmd, args[0], chunks, endpointConf, stats.StageReduce); err != nil {
+			return err
+		}
+		runStats.SetBudget(maxTotalTokens, maxCost)
+		err = runReduce(cmd, args[0], chunks, endpointConf)
+		if errors.Is(err, stats.ErrBudgetExceeded) {
+			return budgetStop(cmd, err, "run reduce again", args[0])
+		}
+		if err != nil {
+			return err
+		}
+		return printStats(cmd)
+	},
+}
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] <input_file_path>",
+	Short: "Run split, map and reduce (the same as the root command)",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return checkRunFlags()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAll(cmd, args[0])
+	},
+}
+
+func checkEndpointFlag() error {
+	if endpointName == "" {
+		return fmt.Errorf("required flag \"endpoint-name\" not set")
+	}
+	return nil
+}
+
+func checkMapFlags() error {
+	if analysisPromptFile == "" {
+		return fmt.Errorf("required flag \"analysis-prompt-file\" not set")
+	}
+	return nil
+}
+
+func checkReduceFlags() error {
+	if summaryPromptFile == "" && reduceStrategy != summarizer.StrategyMerge {
+		return fmt.Errorf("required flag \"summary-prompt-file\" not set")
+	}
+	switch reduceStrategy {
+	case summarizer.StrategyTree, summarizer.StrategyRefine:
+	case summarizer.StrategyMerge:
+		if citations {
+			return fmt.Errorf("--citations cannot be used with --reduce-strategy %s", summarizer.StrategyMerge)
+		}
+	default:
+		return fmt.Errorf("invalid --reduce-strategy '%s': must be '%s', '%s' or '%s'", reduceStrategy, summarizer.StrategyTree, summarizer.StrategyRefine, summarizer.StrategyMerge)
+	}
+	return nil
+}
+
+// checkRunFlags validates the flags of a complete run.
+func checkRunFlags() error {
+	if err := checkMapFlags(); err != nil {
+		return err
+	}
+	if err := checkEndpointFlag(); err != nil {
+		return err
+	}
+	switch runMode {
+	case modeSummarize:
+	case modeMapOnly:
+		return nil
+	default:
+		return fmt.Errorf("invalid --mode '%s': must be '%s' or '%s'", runMode, modeSummarize, modeMapOnly)
+	}
+	return checkReduceFlags()
+}
+
+// runAll runs the split, map and reduce stages in a temporary work
+// directory, or in --temp-dir if set.
+func runAll(cmd *cobra.Command, inputFile string) error {
+	// 1. Load config and select endpoint configuration
+	endpointConf, err := selectEndpoint()
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return runDryRun(cmd, inputFile, endpointConf)
+	}
+
+	// 2. Create and manage temporary directory
+	workDir, removeWorkDir, err := openWorkDir(cmd)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if removeWorkDir {
+			os.RemoveAll(workDir)
+		}
+	}()
+
+	if runStats, err = stats.Load(workDir); err != nil {
+		return err
+	}
+
+	if runMode == modeMapOnly {
+		runStats.SetBudget(maxTotalTokens, maxCost)
+		s, err := splitter.NewSplitter(endpointConf.ChunkSize)
+		if err != nil {
+			return fmt.Errorf("failed to create splitter: %w", err)
+		}
+		err = runMapOnly(cmd, inputFile, workDir, s, endpointConf)
+		if errors.Is(err, stats.ErrBudgetExceeded) {
+			// Keep the results for a resumed run.
+			removeWorkDir = false
+			return budgetStop(cmd, err, fmt.Sprintf("run again with --temp-dir %s --resume", workDir), workDir)
+		}
+		if err != nil {
+			return err
+		}
+		return printStats(cmd)
+	}
+
+	// 3. Split, analyze and summarize
+	chunks, err := runSplit(cmd, inputFile, workDir, endpointConf)
+	if err != nil {
+		return err
+	}
+	// The reduce starts over, also in a resumed run.
+	runStats.Reset(stats.StageReduce)
+	if err := checkBudget(cmd, workDir, chunks, endpointConf, stats.StageMap, stats.StageReduce); err != nil {
+		return err
+	}
+	runStats.SetBudget(maxTotalTokens, maxCost)
+	err = runMap(cmd, workDir, chunks, endpointConf)
+	if err == nil {
+		err = runReduce(cmd, workDir, chunks, endpointConf)
+	}
+	if errors.Is(err, stats.ErrBudgetExceeded) {
+		// Keep the results for a resumed run.
+		removeWorkDir = false
+		return budgetStop(cmd, err, fmt.Sprintf("run again with --temp-dir %s --resume", workDir), workDir)
+	}
+	if err != nil {
+		return err
+	}
+	return printStats(cmd)
+}
+
+// openWorkDir returns the work directory of a run: --temp-dir, or a new
+// temporary directory. It reports whether the directory is to be removed
+// after the run.
+func openWorkDir(cmd *cobra.Command) (string, bool, error) {
+	workDir := tempDir
+	remove := false
+	if workDir == "" {
+		var err error
+		workDir, err = os.MkdirTemp("", "llm-analyzer-*")
+		if err != nil {
+			return "", false, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		remove = !keepTempDir
+	}
+	if verbose {
+		cmd.Printf("Using temporary directory: %s\n", workDir)
+	}
+	return workDir, remove, nil
+}
+
+// budgetStop reports a run that stopped at its budget, with the usage so far
+// and how to continue it.
+func budgetStop(cmd *cobra.Command, err error, next, workDir string) error {
+	if statsErr := printStats(cmd); statsErr != nil {
+		return statsErr
+	}
+	return fmt.Errorf("run stopped: %w\nThe results so far are kept in %s; %s to continue.", err, workDir, next)
+}
+
+// newStageClient creates a client whose token usage and circuit breaker
+// changes are recorded for the stage.
+func newStageClient(cmd *cobra.Command, endpointConf config.EndpointConfig, stage string) (*llm.Client, error) {
+	client, err := newClient(endpointConf)
+	if err != nil {
+		return nil, err
+	}
+	runStats.Track(client, stage, endpointConf)
+	record := client.OnCircuitChange
+	client.OnCircuitChange = func(from, to llm.CircuitState) {
+		if verbose {
+			cmd.Printf("Circuit breaker of endpoint %s: %s -> %s\n", endpointConf.Name, from, to)
+		}
+		record(from, to)
+	}
+	return client, nil
+}
+
+// printStats prints the token usage and cost of the run, and the use of the
+// response cache, to stderr.
+func printStats(cmd *cobra.Command) error {
+	cmd.PrintErrln("\n--- Token Usage ---")
+	if err := runStats.WriteTable(cmd.ErrOrStderr()); err != nil {
+		return err
+	}
+	if responseCache != nil {
+		if hits, misses := responseCache.Stats(); hits > 0 {
+			cmd.PrintErrf("Response cache: %d of %d requests answered from %s\n", hits, hits+misses, responseCache.Dir())
+		}
+	}
+	return nil
+}
+
+// runSplit splits the input file and writes the chunks to the work directory.
+func runSplit(cmd *cobra.Command, inputFile, workDir string, endpointConf config.EndpointConfig) ([]splitter.Chunk, error) {
+	s, err := splitter.NewSplitter(endpointConf.ChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create splitter: %w", err)
+	}
+	format, err := resolveFormat(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := splitInput(cmd, s, inputFile, format)
+	if err != nil {
+		return nil, err
+	}
+	if err := workdir.WriteChunks(workDir, chunks); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// runMap analyzes all chunks in parallel and saves the results to the work
+// directory.
+func runMap(cmd *cobra.Command, workDir string, chunks []splitter.Chunk, endpointConf config.EndpointConfig) error {
+	promptBytes, err := os.ReadFile(analysisPromptFile)
+	if err != nil {
+		return fmt.Errorf("failed to read analysis prompt file: %w", err)
+	}
+	analysisSchema, err := loadSchema(analysisSchemaFile)
+	if err != nil {
+		return err
+	}
+	return analyzeStage(cmd, workDir, chunks, endpointConf, stats.StageMap, string(promptBytes), analysisSchema)
+}
+
+// prefilterStage returns the stage the usage of the prefilter in front of a
+// stage is recorded for.
+func prefilterStage(stage string) string {
+	if stage == stats.StageMap {
+		return stats.StagePrefilter
+	}
+	return stage + "-" + stats.StagePrefilter
+}
+
+// analyzeStage runs the prefilter and analyzes the relevant chunks with the
+// prompt, recording the usage for the stage, and saves the results to the
+// work directory. With --resume, chunks that have a result are skipped.
+func analyzeStage(cmd *cobra.Command, workDir string, chunks []splitter.Chunk, endpointConf config.EndpointConfig, stage, analysisPrompt string, analysisSchema *schema.Schema) error {
+	if !resume {
+		runStats.Reset(prefilterStage(stage))
+		runStats.Reset(stage)
+	}
+	analyzer, err := newChunkAnalyzer(cmd, endpointConf, stage, analysisPrompt, analysisSchema)
+	if err != nil {
+		return err
+	}
+
+	var served []workdir.Served
+	chunks, err = runPrefilter(cmd, workDir, chunks, analysisPrompt, prefilterStage(stage))
+	if err == nil && resume {
+		pending := workdir.Pending(workDir, chunks)
+		if verbose {
+			cmd.Printf("Resuming: %d of %d chunks already analyzed.\n", len(chunks)-len(pending), len(chunks))
+		}
+		served, err = servedBefore(workDir, chunks, pending)
+		chunks = pending
+	}
+	if err == nil {
+		var analyzed []workdir.Served
+		analyzed, err = analyzeChunks(cmd, analyzer, workDir, chunks)
+		served = append(served, analyzed...)
+		sort.Slice(served, func(i, j int) bool { return served[i].Index < served[j].Index })
+		if writeErr := workdir.WriteServed(workDir, served); writeErr != nil && err == nil {
+			err = writeErr
+		}
+		reportFallbacks(cmd, endpointConf, served)
+	}
+	// Save the usage of a failed map, too.
+	if statsErr := runStats.Write(workDir); statsErr != nil {
+		return statsErr
+	}
+	return err
+}
+
+// reportFallbacks prints how many chunks the fallbacks of the endpoint
+// analyzed.
+func reportFallbacks(cmd *cobra.Command, endpointConf config.EndpointConfig, served []workdir.Served) {
+	counts := make(map[string]int)
+	var names []string
+	for _, record := range served {
+		if record.Endpoint == endpointConf.Name {
+			continue
+		}
+		if counts[record.Endpoint] == 0 {
+			names = append(names, record.Endpoint)
+		}
+		counts[record.Endpoint]++
+	}
+	for _, name := range names {
+		cmd.Printf("Endpoint %s unavailable: %d chunks were analyzed by fallback %s.\n", endpointConf.Name, counts[name], name)
+	}
+}
+
+// runPrefilter asks the --prefilter-endpoint whether each chunk is relevant to
+// the analysis goal, saves the decisions to the work directory and returns the
+// relevant chunks. Without a prefilter endpoint, all chunks are returned.
+func runPrefilter(cmd *cobra.Command, workDir string, chunks []splitter.Chunk, analysisPrompt, stage string) ([]splitter.Chunk, error) {
+	if prefilterEndpoint == "" {
+		// Decisions of an earlier run must not drop chunks of this one.
+		return chunks, workdir.WriteDecisions(workDir, nil)
+	}
+	endpointConf, err := findEndpoint(prefilterEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newStageClient(cmd, endpointConf, stage)
+	if err != nil {
+		return nil, err
+	}
+	goal := analysisPrompt
+	if prefilterPrompt != "" {
+		goalBytes, err := os.ReadFile(prefilterPrompt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prefilter prompt file: %w", err)
+		}
+		goal = string(goalBytes)
+	}
+
+	// With --resume, the decisions on unchanged chunks are kept.
+	var decisions []prefilter.Decision
+	todo := chunks
+	if resume {
+		previous, err := workdir.ReadDecisions(workDir)
+		if err != nil {
+			return nil, err
+		}
+		known := make(map[int]prefilter.Decision, len(previous))
+		for _, decision := range previous {
+			known[decision.Index] = decision
+		}
+		todo = nil
+		for _, chunk := range chunks {
+			if decision, ok := known[chunk.Index]; ok && decision.Hash == chunk.Hash {
+				decisions = append(decisions, decision)
+			} else {
+				todo = append(todo, chunk)
+			}
+		}
+	}
+
+	if verbose {
+		cmd.Printf("Prefiltering %d chunks with endpoint %s...\n", len(todo), prefilterEndpoint)
+	}
+	filter := prefilter.NewFilter(client, goal)
+	filter.Concurrency = concurrency
+	made, err := filter.Run(context.Background(), todo)
+	decisions = append(decisions, made...)
+	sort.Slice(decisions, func(i, j int) bool { return decisions[i].Index < decisions[j].Index })
+	// Save the decisions made before an error, too.
+	if writeErr := workdir.WriteDecisions(workDir, decisions); writeErr != nil {
+		return nil, writeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	relevant, err := workdir.Relevant(workDir, chunks)
+	if err != nil {
+		return nil, err
+	}
+	runStats.SetPrefilter(len(chunks), len(relevant))
+	if verbose {
+		cmd.Printf("Prefilter: %d of %d chunks relevant, %d skipped\n", len(relevant), len(chunks), len(chunks)-len(relevant))
+	}
+	return relevant, nil
+}
+
+// analysisRequest returns the prompt that analyzes a chunk.
+func analysisRequest(analysisPrompt string, chunk splitter.Chunk) string {
+	return fmt.Sprintf("%s\n\n--- Data ---\n%s", analysisPrompt, chunk.Text)
+}
+
+// analyzeChunks analyzes the chunks in parallel and writes their results to
+// the work directory. It returns which endpoint served each analyzed chunk,
+// also on error.
+func analyzeChunks(cmd *cobra.Command, analyzer *chunkAnalyzer, workDir string, chunks []splitter.Chunk) ([]workdir.Served, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var served []workdir.Served
+	errorChan := make(chan error, len(chunks))
+	sem := make(chan struct{}, max(concurrency, 1))
+
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func(chunk splitter.Chunk) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if verbose {
+				cmd.Printf("Analyzing chunk %d (%s)...\n", chunk.Index, chunk.Location())
+			}
+
+			result, by, err := analyzer.analyze(context.Background(), cmd, chunk)
+			if err != nil {
+				errorChan <- fmt.Errorf("failed to analyze chunk %d: %w", chunk.Index, err)
+				return
+			}
+
+			if err := workdir.WriteResult(workDir, chunk.Index, result); err != nil {
+				errorChan <- err
+				return
+			}
+			mu.Lock()
+			served = append(served, by)
+			mu.Unlock()
+		}(chunk)
+	}
+
+	wg.Wait()
+	close(errorChan)
+	sort.Slice(served, func(i, j int) bool { return served[i].Index < served[j].Index })
+
+	// Check for errors during chunk analysis
+	for err := range errorChan {
+		return served, err // Return the first error encountered
+	}
+
+	if verbose {
+		cmd.Println("\nAll chunks analyzed successfully.")
+	}
+	return served, nil
+}
+
+// servedBefore returns the records of the chunks that were analyzed by an
+// earlier run and are not pending.
+func servedBefore(workDir string, chunks, pending []splitter.Chunk) ([]workdir.Served, error) {
+	previous, err := workdir.ReadServed(workDir)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]bool, len(chunks))
+	for _, chunk := range chunks {
+		done[chunk.Index] = true
+	}
+	for _, chunk := range pending {
+		done[chunk.Index] = false
+	}
+	var served []workdir.Served
+	for _, record := range previous {
+		if done[record.Index] {
+			served = append(served, record)
+		}
+	}
+	return served, nil
+}
+
+// newReduceSummarizer creates the summarizer of the reduce stage from the
+// flags and returns it with the summary prompt.
+func newReduceSummarizer(cmd *cobra.Command, endpointConf config.EndpointConfig) (*summarizer.Summarizer, string, error) {
+	client, err := newStageClient(cmd, endpointConf, stats.StageReduce)
+	if err != nil {
+		return nil, "", err
+	}
+	return reduceSummarizer(cmd, client, endpointConf)
+}
+
+// reduceSummarizer creates the summarizer of the reduce stage on the client
+// and returns it with the summary prompt.
+func reduceSummarizer(cmd *cobra.Command, client *llm.Client, endpointConf config.EndpointConfig) (*summarizer.Summarizer, string, error) {
+	summarySchema, err := loadSchema(summarySchemaFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var summaryPrompt string
+	if summaryPromptFile != "" {
+		summaryPromptBytes, err := os.ReadFile(summaryPromptFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read summary prompt file: %w", err)
+		}
+		summaryPrompt = string(summaryPromptBytes)
+	}
+	if citations {
+		summaryPrompt = withCitationInstruction(summaryPrompt)
+	}
+
+	sum, err := newSummarizer(cmd, client, endpointConf, reduceStrategy, summarySchema, citations)
+	if err != nil {
+		return nil, "", err
+	}
+	return sum, summaryPrompt, nil
+}
+
+// newSummarizer creates a summarizer with the strategy and final schema, set
+// up by the reduce flags: the fan-in, the merge and refine prompts, with the
+// citation instruction if cite is set, and the merge rules.
+func newSummarizer(cmd *cobra.Command, client *llm.Client, endpointConf config.EndpointConfig, strategy string, finalSchema *schema.Schema, cite bool) (*summarizer.Summarizer, error) {
+	sum, err := summarizer.NewSummarizer(client, endpointConf.ContextWindowSize, verbose, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create summarizer: %w", err)
+	}
+	sum.FanIn = fanIn
+	sum.Concurrency = concurrency
+	sum.Strategy = strategy
+	if mergePromptFile != "" {
+		mergeBytes, err := os.ReadFile(mergePromptFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read merge prompt file: %w", err)
+		}
+		sum.MergePrompt = string(mergeBytes)
+	}
+	if cite {
+		sum.MergePrompt = withCitationInstruction(sum.MergePrompt)
+	}
+	if refinePromptFile != "" {
+		refineBytes, err := os.ReadFile(refinePromptFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read refine prompt file: %w", err)
+		}
+		sum.RefineTemplate = string(refineBytes)
+	}
+	sum.FinalSchema = finalSchema
+	sum.SchemaRetries = schemaRetries
+	if mergeRulesFile != "" {
+		if sum.MergeRules, err = loadMergeRules(mergeRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	return sum, nil
+}
+
+// runReduce combines the results of the work directory into the final report
+// and writes it to the output.
+func runReduce(cmd *cobra.Command, workDir string, chunks []splitter.Chunk, endpointConf config.EndpointConfig) error {
+	if verbose {
+		cmd.Println("Combining results and generating final summary...")
+	}
+
+	chunks, err := workdir.Relevant(workDir, chunks)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return fmt.Errorf("the prefilter found no relevant chunks, nothing to summarize")
+	}
+	results, err := workdir.ReadResults(workDir, chunks)
+	if err != nil {
+		return err
+	}
+	if citations {
+		for i, chunk := range chunks {
+			results[i] = citation.TagResult(chunk.Index, results[i])
+		}
+	}
+
+	endpoints, err := fallbackEndpoints(endpointConf)
+	if err != nil {
+		return err
+	}
+	runStats.Reset(stats.StageReduce)
+	var sum *summarizer.Summarizer
+	var summaryPrompt, finalResult string
+	for i, conf := range endpoints {
+		if i > 0 {
+			cmd.Printf("Endpoint %s failed on the reduce stage (%v), falling back to %s...\n", endpoints[i-1].Name, err, conf.Name)
+		}
+		if sum, summaryPrompt, err = newReduceSummarizer(cmd, conf); err != nil {
+			return err
+		}
+		finalResult, err = sum.SummarizeResults(context.Background(), results, summaryPrompt)
+		if err == nil || !llm.Unavailable(err) {
+			break
+		}
+	}
+	if statsErr := runStats.Write(workDir); statsErr != nil {
+		return statsErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to generate final summary: %w", err)
+	}
+	summarySchema := sum.FinalSchema
+
+	// Results that are JSON are printed without a header.
+	jsonOutput := summarySchema != nil || (reduceStrategy == summarizer.StrategyMerge && summaryPrompt == "")
+
+	if citations {
+		finalResult = addReferences(cmd, finalResult, chunks, summarySchema != nil)
+	}
+
+	// Output final result
+	if outputFile != "" {
+		if err := os.WriteFile(outputFile, []byte(finalResult), 0644); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+		if verbose {
+			cmd.Printf("Final summary written to %s\n", outputFile)
+		}
+	} else if jsonOutput {
+		cmd.Println(finalResult)
+	} else {
+		cmd.Println("\n--- Final Summary ---")
+		cmd.Println(finalResult)
+	}
+
+	return nil
+}
+
+// addReferences appends the references of the cited chunks to a summary and
+// warns about citation problems. The references of JSON output are printed
+// separately, to keep it valid.
+func addReferences(cmd *cobra.Command, summary string, chunks []splitter.Chunk, jsonOutput bool) string {
+	report := citation.Check(summary, chunks)
+	if jsonOutput {
+		cmd.PrintErr(strings.TrimLeft(report.Appendix(), "\n") + "\n")
+	} else {
+		summary += report.Appendix()
+	}
+	reportCitationProblems(cmd, report)
+	return summary
+}
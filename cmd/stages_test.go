@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/workdir"
+)
+
+func TestSplitMapReduce(t *testing.T) {
+	files := newTestFiles(t)
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: stages-mock
+    provider: mock
+    model: "mock-model"
+    context_window_size: 2000
+    chunk_size: 50
+`)
+	analysisPrompt := files.write("analysis.txt", "Analyze this:")
+	summaryPrompt := files.write("summary.txt", "Summarize the following analysis:")
+	input := files.write("input.txt", strings.Repeat("This is a test sentence. ", 40))
+	workDir := files.path("work")
+	flags := []string{"--config", configFile, "--endpoint-name", "stages-mock"}
+
+	if _, _, err := execute(append([]string{"split"}, append(flags, input, workDir)...)...); err != nil {
+		t.Fatalf("split failed: %v", err)
+	}
+	chunks, err := workdir.ReadChunks(workDir)
+	if err != nil || len(chunks) < 2 {
+		t.Fatalf("expected several chunks in the work directory, got %d (%v)", len(chunks), err)
+	}
+	if pending := workdir.Pending(workDir, chunks); len(pending) != len(chunks) {
+		t.Errorf("expected no results after split, got %d", len(chunks)-len(pending))
+	}
+
+	if _, _, err := execute(append([]string{"map", "--analysis-prompt-file", analysisPrompt}, append(flags, workDir)...)...); err != nil {
+		t.Fatalf("map failed: %v", err)
+	}
+	results, err := workdir.ReadResults(workDir, chunks)
+	if err != nil {
+		t.Fatalf("expected a result per chunk: %v", err)
+	}
+	for i, result := range results {
+		// The mock's digest quotes the end of the prompt: the chunk text.
+		if !strings.Contains(result, "Analyze this: --- Data --- "+strings.TrimSpace(chunks[i].Text)[:20]) {
+			t.Errorf("result of chunk %d does not answer its prompt: %q", chunks[i].Index, result)
+		}
+	}
+
+	reduce := func(prompt, output string) {
+		t.Helper()
+		if _, _, err := execute(append([]string{"reduce", "--summary-prompt-file", prompt, "--output", output}, append(flags, workDir)...)...); err != nil {
+			t.Fatalf("reduce failed: %v", err)
+		}
+	}
+	reduce(summaryPrompt, files.path("report.txt"))
+	if report, _ := os.ReadFile(files.path("report.txt")); !strings.Contains(string(report), "Summarize the following analysis:") {
+		t.Errorf("expected the report to answer the summary prompt, got %q", report)
+	}
+	total := readTotal(t, workDir)
+
+	// Another summary prompt reuses the results of the map stage.
+	reduce(files.write("summary2.txt", "List the findings:"), files.path("report2.txt"))
+	if report, _ := os.ReadFile(files.path("report2.txt")); !strings.Contains(string(report), "List the findings:") {
+		t.Errorf("expected the report to answer the new prompt, got %q", report)
+	}
+	again, err := workdir.ReadResults(workDir, chunks)
+	if err != nil || strings.Join(again, "") != strings.Join(results, "") {
+		t.Errorf("expected the map results to be kept, got %v", err)
+	}
+	if rerun := readTotal(t, workDir); rerun.Requests != total.Requests {
+		t.Errorf("expected the reduce to replace its own usage only: %d requests before, %d after", total.Requests, rerun.Requests)
+	}
+}
+
+func TestRunBudgetResume(t *testing.T) {
+	files := newTestFiles(t)
+	// The mock's answers are longer than max_output_tokens, so the estimate
+	// before the run stays below the usage, and the budget stops the run.
+	configFile := files.write("config.yaml", `
+endpoints:
+  - name: budget-mock
+    provider: mock
+    model: "mock-model"
+    context_window_size: 2000
+    chunk_size: 50
+    max_output_tokens: 10
+`)
+	analysisPrompt := files.write("analysis.txt", "Analyze this:")
+	summaryPrompt := files.write("summary.txt", "Summarize the following analysis:")
+	input := files.write("input.txt", strings.Repeat("This is a test sentence. ", 40))
+	run := func(workDir, output string, extra ...string) (string, error) {
+		args := append([]string{
+			"run", "--config", configFile, "--endpoint-name", "budget-mock",
+			"--analysis-prompt-file", analysisPrompt, "--summary-prompt-file", summaryPrompt,
+			"--temp-dir", workDir, "--output", output,
+		}, extra...)
+		_, stderr, err := execute(append(args, input)...)
+		return stderr, err
+	}
+
+	fullDir := files.path("full")
+	if _, err := run(fullDir, files.path("full.txt")); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	full := readTotal(t, fullDir)
+
+	workDir := files.path("work")
+	budget := strconv.Itoa((full.InputTokens + full.OutputTokens) / 2)
+	stderr, err := run(workDir, files.path("out.txt"), "--max-total-tokens", budget)
+	if err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Fatalf("expected a budget stop, got %v\n%s", err, stderr)
+	}
+	stopped := readTotal(t, workDir)
+	if stopped.Requests == 0 || stopped.Requests >= full.Requests {
+		t.Errorf("expected a partial run, got %+v", stopped)
+	}
+
+	// The usage of the stopped run counts against the budget of the resumed run.
+	if _, err := run(workDir, files.path("out.txt"), "--resume", "--max-total-tokens", budget); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected the resumed run to exceed the budget, got %v", err)
+	}
+	if again := readTotal(t, workDir); again.Requests != stopped.Requests {
+		t.Errorf("expected no requests over the budget, got %d after %d", again.Requests, stopped.Requests)
+	}
+
+	if _, err := run(workDir, files.path("out.txt"), "--resume"); err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+	if resumed := readTotal(t, workDir); resumed.Requests != full.Requests {
+		t.Errorf("expected %d requests in total after the resume, got %d", full.Requests, resumed.Requests)
+	}
+	want, _ := os.ReadFile(files.path("full.txt"))
+	got, _ := os.ReadFile(files.path("out.txt"))
+	if len(want) == 0 || string(got) != string(want) {
+		t.Errorf("expected the report %q, got %q", want, got)
+	}
+
+	// The map subcommand checks its estimate before sending requests.
+	if _, _, err := execute("map", "--config", configFile, "--endpoint-name", "budget-mock", "--analysis-prompt-file", analysisPrompt, "--max-total-tokens", "10", workDir); err == nil || !strings.Contains(err.Error(), "--max-total-tokens 10") {
+		t.Errorf("expected the map estimate to exceed the budget, got %v", err)
+	}
+}
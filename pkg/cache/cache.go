@@ -0,0 +1,213 @@
+// Package cache stores LLM responses on disk, addressed by the hash of their
+// request, so that a repeated request is answered without calling the model.
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultTTL is how long a response is kept by default.
+	DefaultTTL = 7 * 24 * time.Hour
+	// DefaultMaxBytes is the default size limit of the cache.
+	DefaultMaxBytes = 1 << 30
+)
+
+// DefaultDir returns the cache directory under the user cache directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "llm-data-analyzer", "responses"), nil
+}
+
+// entry is the file of one cached response.
+type entry struct {
+	Created  time.Time `json:"created"`
+	Response string    `json:"response"`
+}
+
+// Cache is a directory of responses, one file per request key. It is safe for
+// concurrent use, also by several processes.
+type Cache struct {
+	dir string
+
+	// TTL is how long a response is served. Zero means forever.
+	TTL time.Duration
+	// MaxBytes is the size Prune shrinks the cache to. Zero means no limit.
+	MaxBytes int64
+	// Refresh makes every lookup miss, so that all responses are requested
+	// and stored again.
+	Refresh bool
+
+	hits, misses atomic.Int64
+	now          func() time.Time
+}
+
+// New creates a Cache in the directory with the default limits. The directory
+// is created when the first response is stored.
+func New(dir string) *Cache {
+	return &Cache{dir: dir, TTL: DefaultTTL, MaxBytes: DefaultMaxBytes, now: time.Now}
+}
+
+// Dir returns the directory of the cache.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// path returns the file of a key. Files are spread over subdirectories by the
+// first two characters of the key.
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Get returns the response stored for the key, unless it has expired.
+func (c *Cache) Get(key string) (string, bool) {
+	if c.Refresh || len(key) < 2 {
+		c.misses.Add(1)
+		return "", false
+	}
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		c.misses.Add(1)
+		return "", false
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil || c.expired(e.Created) {
+		c.misses.Add(1)
+		return "", false
+	}
+	c.hits.Add(1)
+	return e.Response, true
+}
+
+func (c *Cache) expired(created time.Time) bool {
+	return c.TTL > 0 && c.now().Sub(created) > c.TTL
+}
+
+// Put stores the response for the key. The file is written to a temporary
+// name first, so that readers never see a partial response.
+func (c *Cache) Put(key, response string) error {
+	if len(key) < 2 {
+		return fmt.Errorf("invalid cache key '%s'", key)
+	}
+	data, err := json.Marshal(entry{Created: c.now().UTC(), Response: response})
+	if err != nil {
+		return fmt.Errorf("failed to encode cached response: %w", err)
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write cached response: %w", err)
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write cached response: %w", err)
+	}
+	return nil
+}
+
+// Stats returns the number of lookups that were answered from the cache and
+// of those that were not.
+func (c *Cache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// PruneResult describes the work of Prune.
+type PruneResult struct {
+	Removed      int
+	RemovedBytes int64
+	Kept         int
+	KeptBytes    int64
+}
+
+type file struct {
+	path    string
+	size    int64
+	created time.Time
+}
+
+// Prune removes expired responses, then the oldest responses until the cache
+// fits into MaxBytes.
+func (c *Cache) Prune() (PruneResult, error) {
+	return c.prune(false)
+}
+
+// Clear removes all responses.
+func (c *Cache) Clear() (PruneResult, error) {
+	return c.prune(true)
+}
+
+func (c *Cache) prune(all bool) (PruneResult, error) {
+	var result PruneResult
+	var files []file
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// A temporary file is left over from an interrupted Put.
+		leftover := strings.HasSuffix(path, ".tmp") && c.now().Sub(info.ModTime()) > time.Hour
+		if !strings.HasSuffix(path, ".json") && !leftover {
+			return nil
+		}
+		f := file{path: path, size: info.Size(), created: info.ModTime()}
+		if all || leftover || c.expired(f.created) {
+			return c.remove(f, &result)
+		}
+		files = append(files, f)
+		result.KeptBytes += f.size
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to prune cache: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].created.Before(files[j].created) })
+	for _, f := range files {
+		if c.MaxBytes <= 0 || result.KeptBytes <= c.MaxBytes {
+			result.Kept++
+			continue
+		}
+		result.KeptBytes -= f.size
+		if err := c.remove(f, &result); err != nil {
+			return result, fmt.Errorf("failed to prune cache: %w", err)
+		}
+	}
+	return result, nil
+}
+
+func (c *Cache) remove(f file, result *PruneResult) error {
+	if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	result.Removed++
+	result.RemovedBytes += f.size
+	return nil
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPut(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := New(t.TempDir())
+	c.TTL = time.Hour
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.Get("abcdef"); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+	if err := c.Put("abcdef", "response"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if response, ok := c.Get("abcdef"); !ok || response != "response" {
+		t.Errorf("expected the stored response, got %q, %v", response, ok)
+	}
+
+	c.Refresh = true
+	if _, ok := c.Get("abcdef"); ok {
+		t.Error("expected a miss with Refresh")
+	}
+	c.Refresh = false
+
+	now = now.Add(2 * time.Hour)
+	if _, ok := c.Get("abcdef"); ok {
+		t.Error("expected an expired response to miss")
+	}
+	c.TTL = 0
+	if _, ok := c.Get("abcdef"); !ok {
+		t.Error("expected a hit without a TTL")
+	}
+
+	if hits, misses := c.Stats(); hits != 2 || misses != 3 {
+		t.Errorf("expected 2 hits and 3 misses, got %d and %d", hits, misses)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	c := New(dir)
+	// A fixed time gives all entries the same size.
+	start := time.Now().Truncate(time.Second)
+	c.now = func() time.Time { return start }
+	keys := []string{"aa01", "bb02", "cc03", "dd04"}
+	for i, key := range keys {
+		if err := c.Put(key, strings.Repeat("x", 100)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		// Older keys come first.
+		mtime := start.Add(time.Duration(i-len(keys)) * time.Hour)
+		if err := os.Chtimes(c.path(key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leftover := filepath.Join(dir, "aa", "123.tmp")
+	os.WriteFile(leftover, []byte("partial"), 0644)
+	old := start.Add(-2 * time.Hour)
+	os.Chtimes(leftover, old, old)
+
+	info, _ := os.Stat(c.path("aa01"))
+	size := info.Size()
+
+	// The oldest response has expired, the next one does not fit.
+	c.TTL = 3*time.Hour + 30*time.Minute
+	c.MaxBytes = 2 * size
+	result, err := c.Prune()
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	var keptBytes int64
+	for _, key := range keys[2:] {
+		if info, err := os.Stat(c.path(key)); err == nil {
+			keptBytes += info.Size()
+		}
+	}
+	if result.Removed != 3 || result.Kept != 2 || result.KeptBytes != keptBytes {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	for i, key := range keys {
+		if _, ok := c.Get(key); ok != (i >= 2) {
+			t.Errorf("unexpected presence of %s: %v", key, ok)
+		}
+	}
+
+	result, err = c.Clear()
+	if err != nil || result.Removed != 2 || result.Kept != 0 {
+		t.Errorf("unexpected result of Clear: %+v, %v", result, err)
+	}
+}
+
+func TestPruneMissingDir(t *testing.T) {
+	c := New(filepath.Join(t.TempDir(), "missing"))
+	if result, err := c.Prune(); err != nil || result != (PruneResult{}) {
+		t.Errorf("expected nothing to prune, got %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,160 @@
+package citation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"llm-data-analyzer/pkg/splitter"
+)
+
+// Instruction is appended to the summary prompt in citation mode.
+const Instruction = `Every finding in the results is tagged with the chunk it comes from, e.g. [chunk 3].
+Keep these tags: end every statement in your answer with the tags of all chunks that support it, e.g. "Disk usage peaked at 98% [chunk 3] [chunk 7]".
+Do not invent tags and do not drop the tags of the findings you use.`
+
+// tagPattern matches "[chunk 3]" as well as "[chunks 3, 7]".
+var tagPattern = regexp.MustCompile(`\[chunks? (\d+(?:\s*,\s*\d+)*)\]`)
+
+// Tag returns the citation tag of a chunk.
+func Tag(index int) string {
+	return fmt.Sprintf("[chunk %d]", index)
+}
+
+// TagResult prefixes an intermediate result with the tag of its chunk.
+func TagResult(index int, result string) string {
+	return Tag(index) + "\n" + result
+}
+
+// Cited returns the sorted, distinct chunk indexes cited in text.
+func Cited(text string) []int {
+	seen := make(map[int]bool)
+	var indexes []int
+	for _, m := range tagPattern.FindAllStringSubmatch(text, -1) {
+		for _, part := range strings.Split(m[1], ",") {
+			index, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || seen[index] {
+				continue
+			}
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// Report is the result of checking the citations of a final summary.
+type Report struct {
+	// Cited are the chunks cited in the summary.
+	Cited []splitter.Chunk
+	// Unknown are cited chunk indexes that do not exist.
+	Unknown []int
+	// Uncited are the statements of the summary that carry no citation.
+	Uncited []string
+}
+
+// Check verifies the citations in a final summary against the chunks of the
+// input.
+func Check(text string, chunks []splitter.Chunk) Report {
+	byIndex := make(map[int]splitter.Chunk, len(chunks))
+	for _, chunk := range chunks {
+		byIndex[chunk.Index] = chunk
+	}
+
+	var report Report
+	for _, index := range Cited(text) {
+		if chunk, ok := byIndex[index]; ok {
+			report.Cited = append(report.Cited, chunk)
+		} else {
+			report.Unknown = append(report.Unknown, index)
+		}
+	}
+	for _, claim := range claims(text) {
+		if !tagPattern.MatchString(claim) {
+			report.Uncited = append(report.Uncited, claim)
+		}
+	}
+	return report
+}
+
+// Appendix returns the reference section listing the location of every
+// cited chunk.
+func (r Report) Appendix() string {
+	var b strings.Builder
+	b.WriteString("\n\n## References\n\n")
+	if len(r.Cited) == 0 {
+		b.WriteString("No sources were cited.\n")
+	}
+	for _, chunk := range r.Cited {
+		b.WriteString(fmt.Sprintf("- %s %s\n", Tag(chunk.Index), chunk.Location()))
+	}
+	return b.String()
+}
+
+// claims splits a summary into statements: list items, table rows and
+// paragraphs. Headings, rules, code blocks, table headers and separators and
+// short lead-in lines ending with a colon are not statements.
+func claims(text string) []string {
+	var result []string
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			result = append(result, strings.Join(paragraph, " "))
+			paragraph = nil
+		}
+	}
+
+	inFence := false
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+			flush()
+			continue
+		}
+		switch {
+		case inFence:
+			continue
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "#"),
+			strings.Trim(trimmed, "-*_= ") == "",
+			isTableSeparator(trimmed),
+			strings.HasSuffix(trimmed, ":") && !tagPattern.MatchString(trimmed):
+			flush()
+		case strings.HasPrefix(trimmed, "|"):
+			flush()
+			// The row in front of a separator is the header.
+			if i+1 < len(lines) && isTableSeparator(lines[i+1]) {
+				continue
+			}
+			paragraph = append(paragraph, trimmed)
+			flush()
+		case isListItem(trimmed):
+			flush()
+			paragraph = append(paragraph, trimmed)
+			flush()
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flush()
+	return result
+}
+
+var listItem = regexp.MustCompile(`^([-*+]|\d+[.)])\s+`)
+
+func isListItem(line string) bool {
+	return listItem.MatchString(line)
+}
+
+// isTableSeparator reports whether a line separates the header of a markdown
+// table from its rows.
+func isTableSeparator(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.Contains(trimmed, "-") && strings.Trim(trimmed, "|-: ") == ""
+}
@@ -0,0 +1,57 @@
+package citation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/splitter"
+)
+
+func TestCited(t *testing.T) {
+	text := "Disk full [chunk 3]. DNS outage [chunks 7, 2] and again [chunk 3]."
+	if got := Cited(text); !reflect.DeepEqual(got, []int{2, 3, 7}) {
+		t.Errorf("Expected [2 3 7], got %v", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	chunks := []splitter.Chunk{
+		{Index: 1, Source: "app.log", StartLine: 1, EndLine: 40},
+		{Index: 2, Source: "app.log", StartLine: 41, EndLine: 90},
+	}
+	summary := `# Incident report
+
+Findings:
+
+- Disk usage peaked at 98% [chunk 1]
+- The database restarted twice
+- DNS failed over [chunk 9]
+
+Overall the system recovered
+within minutes [chunk 2].
+
+| Host | Errors |
+|------|--------|
+| db-1 | 12 [chunk 1] |
+| db-2 | 3 |
+`
+
+	report := Check(summary, chunks)
+
+	if len(report.Cited) != 2 || report.Cited[0].Index != 1 || report.Cited[1].Index != 2 {
+		t.Errorf("Unexpected cited chunks: %+v", report.Cited)
+	}
+	if !reflect.DeepEqual(report.Unknown, []int{9}) {
+		t.Errorf("Expected unknown citation 9, got %v", report.Unknown)
+	}
+	expected := []string{"- The database restarted twice", "| db-2 | 3 |"}
+	if !reflect.DeepEqual(report.Uncited, expected) {
+		t.Errorf("Expected uncited claims %q, got %q", expected, report.Uncited)
+	}
+
+	appendix := report.Appendix()
+	if !strings.Contains(appendix, "- [chunk 1] lines 1–40 of app.log\n") || !strings.Contains(appendix, "- [chunk 2] lines 41–90 of app.log\n") {
+		t.Errorf("Unexpected appendix:\n%s", appendix)
+	}
+}
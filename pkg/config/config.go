@@ -1,17 +1,85 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
 // EndpointConfig defines the configuration for a single LLM endpoint.
 type EndpointConfig struct {
-	Name              string `mapstructure:"name"`
-	EndpointURL       string `mapstructure:"endpoint_url"`
-	APIKeyEnv         string `mapstructure:"api_key_env"`
-	Model             string `mapstructure:"model"`
-	ContextWindowSize int    `mapstructure:"context_window_size"`
-	ChunkSize         int    `mapstructure:"chunk_size"`
+	Name               string   `mapstructure:"name"`
+	EndpointURL        string   `mapstructure:"endpoint_url"`
+	APIKeyEnv          string   `mapstructure:"api_key_env"`
+	Model              string   `mapstructure:"model"`
+	ContextWindowSize  int      `mapstructure:"context_window_size"`
+	ChunkSize          int      `mapstructure:"chunk_size"`
+	MaxOutputTokens    int      `mapstructure:"max_output_tokens"`
+	SystemPrompt       string   `mapstructure:"system_prompt"`
+	SupportsJSONSchema bool     `mapstructure:"supports_json_schema"`
+	InputPricePerMTok  float64  `mapstructure:"input_price_per_mtok"`
+	OutputPricePerMTok float64  `mapstructure:"output_price_per_mtok"`
+	RequestsPerMinute  int      `mapstructure:"requests_per_minute"`
+	TokensPerMinute    int      `mapstructure:"tokens_per_minute"`
+	Retries            int      `mapstructure:"retries"`
+	Fallbacks          []string `mapstructure:"fallbacks"`
+	// EndpointURLs are replicas of the model that share the requests instead
+	// of EndpointURL.
+	EndpointURLs  []ReplicaConfig `mapstructure:"endpoint_urls"`
+	LoadBalancing string          `mapstructure:"load_balancing"`
+	// CircuitBreaker stops the requests to the endpoint while it keeps
+	// failing.
+	CircuitBreaker CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	// Provider is ProviderOpenAI, the default, or ProviderMock.
+	Provider string     `mapstructure:"provider"`
+	Mock     MockConfig `mapstructure:"mock"`
+}
+
+// Providers of an endpoint.
+const (
+	// ProviderOpenAI is an OpenAI-compatible chat completions API.
+	ProviderOpenAI = "openai"
+	// ProviderMock answers locally with deterministic responses, without
+	// calling a model.
+	ProviderMock = "mock"
+)
+
+// MockConfig configures the responses of an endpoint with ProviderMock.
+type MockConfig struct {
+	// ResponseFile is a file whose text is the answer to every request. If
+	// it is not set, the mock answers with a digest of the request.
+	ResponseFile string        `mapstructure:"response_file"`
+	Latency      time.Duration `mapstructure:"latency"`
+	// FailureRate is the share of requests, between 0 and 1, that fail.
+	FailureRate float64 `mapstructure:"failure_rate"`
+	Seed        int64   `mapstructure:"seed"`
+}
+
+// NativeJSONSchema reports whether schemas are sent to the endpoint as
+// response_format: the endpoint supports it, or it is a mock, which answers
+// with JSON that is valid under the schema.
+func (e EndpointConfig) NativeJSONSchema() bool {
+	return e.SupportsJSONSchema || e.Provider == ProviderMock
+}
+
+// CircuitBreakerConfig configures the circuit breaker of an endpoint. It is
+// disabled unless Failures is set.
+type CircuitBreakerConfig struct {
+	Failures int           `mapstructure:"failures"`
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	Wait     bool          `mapstructure:"wait"`
+}
+
+// ReplicaConfig is one replica of an endpoint.
+type ReplicaConfig struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// Cost returns the price of the given tokens at the endpoint's prices per
+// million tokens.
+func (e EndpointConfig) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*e.InputPricePerMTok + float64(outputTokens)*e.OutputPricePerMTok) / 1e6
 }
 
 // Config defines the overall configuration for the application.
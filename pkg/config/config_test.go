@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -15,6 +16,19 @@ endpoints:
     model: "gpt-4"
     context_window_size: 8192
     chunk_size: 4096
+    max_output_tokens: 1024
+    system_prompt: "You are a log analyst."
+    supports_json_schema: true
+    input_price_per_mtok: 30
+    output_price_per_mtok: 60
+    requests_per_minute: 500
+    tokens_per_minute: 30000
+    retries: 3
+    fallbacks: ["azure", "local"]
+    circuit_breaker:
+      failures: 5
+      cooldown: 45s
+      wait: true
 `
 	tmpfile, err := os.CreateTemp("", "config-*.yaml")
 	if err != nil {
@@ -58,4 +72,28 @@ endpoints:
 	if endpoint.ChunkSize != 4096 {
 		t.Errorf("Expected chunk size 4096, got %d", endpoint.ChunkSize)
 	}
+	if endpoint.MaxOutputTokens != 1024 {
+		t.Errorf("Expected max output tokens 1024, got %d", endpoint.MaxOutputTokens)
+	}
+	if endpoint.SystemPrompt != "You are a log analyst." {
+		t.Errorf("Expected system prompt 'You are a log analyst.', got '%s'", endpoint.SystemPrompt)
+	}
+	if !endpoint.SupportsJSONSchema {
+		t.Error("Expected supports_json_schema to be true")
+	}
+	if endpoint.RequestsPerMinute != 500 || endpoint.TokensPerMinute != 30000 {
+		t.Errorf("Expected rate limits 500/30000, got %d/%d", endpoint.RequestsPerMinute, endpoint.TokensPerMinute)
+	}
+	if endpoint.Retries != 3 {
+		t.Errorf("Expected 3 retries, got %d", endpoint.Retries)
+	}
+	if len(endpoint.Fallbacks) != 2 || endpoint.Fallbacks[0] != "azure" || endpoint.Fallbacks[1] != "local" {
+		t.Errorf("Expected fallbacks [azure local], got %v", endpoint.Fallbacks)
+	}
+	if cb := endpoint.CircuitBreaker; cb.Failures != 5 || cb.Cooldown != 45*time.Second || !cb.Wait {
+		t.Errorf("Expected circuit breaker {5 45s true}, got %+v", cb)
+	}
+	if cost := endpoint.Cost(1000, 500); cost != 0.06 {
+		t.Errorf("Expected cost 0.06, got %v", cost)
+	}
 }
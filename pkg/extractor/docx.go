@@ -0,0 +1,146 @@
+package extractor
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// extractDOCX reads word/document.xml from a DOCX archive. Paragraphs styled
+// as "Title" or "HeadingN" become markdown headings, and page breaks (explicit
+// or as last rendered by Word) start a new PageMarker. Word also marks the
+// page after an explicit break as rendered, which is not counted again.
+func extractDOCX(r io.ReaderAt, size int64) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to open DOCX archive: %w", err)
+	}
+
+	var document *zip.File
+	for _, f := range archive.File {
+		if f.Name == "word/document.xml" {
+			document = f
+			break
+		}
+	}
+	if document == nil {
+		return "", fmt.Errorf("word/document.xml not found in DOCX archive")
+	}
+
+	rc, err := document.Open()
+	if err != nil {
+		return "", fmt.Errorf("failed to open word/document.xml: %w", err)
+	}
+	defer rc.Close()
+
+	var b strings.Builder
+	var paragraph strings.Builder
+	headingLevel := 0
+	page := 1
+	b.WriteString(fmt.Sprintf(PageMarker, page))
+	b.WriteString("\n\n")
+
+	newPage := func() {
+		page++
+		b.WriteString("\n")
+		b.WriteString(fmt.Sprintf(PageMarker, page))
+		b.WriteString("\n\n")
+	}
+
+	decoder := xml.NewDecoder(rc)
+	inText := false
+	// afterBreak is set between an explicit page break and the next text.
+	afterBreak := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse word/document.xml: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				paragraph.Reset()
+				headingLevel = 0
+			case "pStyle":
+				headingLevel = docxHeadingLevel(attr(t, "val"))
+			case "t":
+				inText = true
+			case "tab":
+				paragraph.WriteString("\t")
+			case "br":
+				if attr(t, "type") == "page" {
+					flushParagraph(&b, &paragraph, headingLevel)
+					newPage()
+					afterBreak = true
+				} else {
+					paragraph.WriteString("\n")
+				}
+			case "lastRenderedPageBreak":
+				if !afterBreak {
+					flushParagraph(&b, &paragraph, headingLevel)
+					newPage()
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				flushParagraph(&b, &paragraph, headingLevel)
+			}
+		case xml.CharData:
+			if inText {
+				paragraph.Write(t)
+				afterBreak = false
+			}
+		}
+	}
+
+	return cleanText(b.String()), nil
+}
+
+// flushParagraph writes the buffered paragraph text and resets the buffer.
+func flushParagraph(b, paragraph *strings.Builder, headingLevel int) {
+	text := paragraph.String()
+	paragraph.Reset()
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	if headingLevel > 0 {
+		writeHeading(b, headingLevel, text)
+		return
+	}
+	b.WriteString(text)
+	b.WriteString("\n\n")
+}
+
+// docxHeadingLevel maps a paragraph style id to a heading level, or 0.
+func docxHeadingLevel(style string) int {
+	lower := strings.ToLower(style)
+	if lower == "title" {
+		return 1
+	}
+	if strings.HasPrefix(lower, "heading") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(lower, "heading")); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func attr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package extractor
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Format identifies the type of an input file.
+type Format string
+
+const (
+	FormatText     Format = "text"
+	FormatJSONL    Format = "jsonl"
+	FormatHTML     Format = "html"
+	FormatMarkdown Format = "markdown"
+	FormatPDF      Format = "pdf"
+	FormatDOCX     Format = "docx"
+)
+
+// PageMarker is the line written before the text of each page of a paginated
+// document. The splitter recognizes it to record page numbers in chunk metadata.
+const PageMarker = "[Page %d]"
+
+// ParseFormat converts a --format flag value into a Format.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text", "txt":
+		return FormatText, nil
+	case "jsonl":
+		return FormatJSONL, nil
+	case "html", "htm":
+		return FormatHTML, nil
+	case "markdown", "md":
+		return FormatMarkdown, nil
+	case "pdf":
+		return FormatPDF, nil
+	case "docx":
+		return FormatDOCX, nil
+	}
+	return "", fmt.Errorf("unsupported format '%s'", name)
+}
+
+// DetectFormat guesses the format of a file from its extension. Unknown
+// extensions are treated as plain text.
+func DetectFormat(path string) Format {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return FormatText
+	}
+	format, err := ParseFormat(ext)
+	if err != nil {
+		return FormatText
+	}
+	return format
+}
+
+// IsDocument reports whether the format needs text extraction before splitting.
+func (f Format) IsDocument() bool {
+	switch f {
+	case FormatHTML, FormatMarkdown, FormatPDF, FormatDOCX:
+		return true
+	}
+	return false
+}
+
+// Extract converts a document into plain text. Headings are written as
+// markdown headings ("# Title") and pages are introduced by PageMarker lines.
+func Extract(r io.ReaderAt, size int64, format Format) (string, error) {
+	switch format {
+	case FormatHTML:
+		return extractHTML(io.NewSectionReader(r, 0, size))
+	case FormatMarkdown:
+		return extractMarkdown(io.NewSectionReader(r, 0, size))
+	case FormatPDF:
+		return extractPDF(r, size)
+	case FormatDOCX:
+		return extractDOCX(r, size)
+	}
+	return "", fmt.Errorf("format '%s' does not support text extraction", format)
+}
+
+// writeHeading writes a markdown heading of the given level.
+func writeHeading(b *strings.Builder, level int, text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	if level < 1 {
+		level = 1
+	}
+	if level > 6 {
+		level = 6
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.Repeat("#", level))
+	b.WriteString(" ")
+	b.WriteString(text)
+	b.WriteString("\n\n")
+}
+
+// cleanText trims trailing spaces and collapses runs of blank lines.
+func cleanText(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	blank := true
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			if blank {
+				continue
+			}
+			blank = true
+		} else {
+			blank = false
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n")) + "\n"
+}
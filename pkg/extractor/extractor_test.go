@@ -0,0 +1,109 @@
+package extractor
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	cases := map[string]Format{
+		"report.html": FormatHTML,
+		"notes.md":    FormatMarkdown,
+		"ticket.PDF":  FormatPDF,
+		"spec.docx":   FormatDOCX,
+		"app.log":     FormatText,
+		"events":      FormatText,
+		"data.jsonl":  FormatJSONL,
+	}
+	for path, expected := range cases {
+		if got := DetectFormat(path); got != expected {
+			t.Errorf("DetectFormat(%q) = %s, expected %s", path, got, expected)
+		}
+	}
+}
+
+func TestExtractHTML(t *testing.T) {
+	input := `<html><head><title>x</title><style>p {}</style></head>
+<body><h1>Ops Report</h1><p>All systems   nominal.</p>
+<h2>Incidents</h2><ul><li>Disk full</li><li>DNS outage</li></ul>
+<script>alert(1)</script></body></html>`
+
+	text, err := Extract(strings.NewReader(input), int64(len(input)), FormatHTML)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := "# Ops Report\n\nAll systems nominal.\n\n## Incidents\n\n- Disk full\n- DNS outage\n"
+	if text != expected {
+		t.Errorf("Expected:\n%q\ngot:\n%q", expected, text)
+	}
+}
+
+func TestExtractMarkdown(t *testing.T) {
+	input := "---\ntitle: doc\n---\nOps\n===\n\n<!-- draft -->\nIntro.\n\nIncidents\n---------\n\n```\n# not a heading\n```\n"
+
+	text, err := Extract(strings.NewReader(input), int64(len(input)), FormatMarkdown)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := "# Ops\n\nIntro.\n\n## Incidents\n\n```\n# not a heading\n```\n"
+	if text != expected {
+		t.Errorf("Expected:\n%q\ngot:\n%q", expected, text)
+	}
+}
+
+func TestExtractDOCX(t *testing.T) {
+	document := `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t>Summary</w:t></w:r></w:p>
+<w:p><w:r><w:t>First page text.</w:t></w:r></w:p>
+<w:p><w:r><w:br w:type="page"/><w:t>Second page text.</w:t></w:r></w:p>
+</w:body></w:document>`
+
+	text, err := extractDOCXDocument(document)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := "[Page 1]\n\n# Summary\n\nFirst page text.\n\n[Page 2]\n\nSecond page text.\n"
+	if text != expected {
+		t.Errorf("Expected:\n%q\ngot:\n%q", expected, text)
+	}
+}
+
+func TestExtractDOCXPageBreaks(t *testing.T) {
+	// Word marks the page after an explicit break as rendered, too; only a
+	// rendered break without an explicit one starts another page.
+	document := `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>First page text.</w:t></w:r></w:p>
+<w:p><w:r><w:br w:type="page"/></w:r><w:r><w:lastRenderedPageBreak/><w:t>Second page text.</w:t></w:r></w:p>
+<w:p><w:r><w:lastRenderedPageBreak/><w:t>Third page text.</w:t></w:r></w:p>
+</w:body></w:document>`
+
+	text, err := extractDOCXDocument(document)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	expected := "[Page 1]\n\nFirst page text.\n\n[Page 2]\n\nSecond page text.\n\n[Page 3]\n\nThird page text.\n"
+	if text != expected {
+		t.Errorf("Expected:\n%q\ngot:\n%q", expected, text)
+	}
+}
+
+// extractDOCXDocument extracts the text of a DOCX archive with the given
+// word/document.xml.
+func extractDOCXDocument(document string) (string, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("word/document.xml")
+	w.Write([]byte(document))
+	zw.Close()
+
+	data := buf.Bytes()
+	return Extract(bytes.NewReader(data), int64(len(data)), FormatDOCX)
+}
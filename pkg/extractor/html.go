@@ -0,0 +1,101 @@
+package extractor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// extractHTML walks the DOM and keeps the visible text, turning h1-h6 into
+// markdown headings and block elements into line breaks.
+func extractHTML(r io.Reader) (string, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			text := strings.Join(strings.Fields(n.Data), " ")
+			if text == "" {
+				return
+			}
+			if strings.HasPrefix(n.Data, " ") || strings.HasPrefix(n.Data, "\n") {
+				text = " " + text
+			}
+			if strings.HasSuffix(n.Data, " ") || strings.HasSuffix(n.Data, "\n") {
+				text += " "
+			}
+			b.WriteString(text)
+			return
+		case html.ElementNode:
+			switch n.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template:
+				return
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				level := int(n.Data[1] - '0')
+				writeHeading(&b, level, nodeText(n))
+				return
+			case atom.Br:
+				b.WriteString("\n")
+				return
+			case atom.Li:
+				b.WriteString("\n- ")
+			case atom.Td, atom.Th:
+				b.WriteString(" | ")
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+
+		if n.Type == html.ElementNode && isBlock(n.DataAtom) {
+			b.WriteString("\n")
+		}
+	}
+	walk(doc)
+
+	return cleanHTMLText(b.String()), nil
+}
+
+// nodeText returns the whitespace-normalized text content of a node.
+func nodeText(n *html.Node) string {
+	var parts []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			parts = append(parts, strings.Fields(n.Data)...)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(parts, " ")
+}
+
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer,
+		atom.Ul, atom.Ol, atom.Table, atom.Tr, atom.Pre, atom.Blockquote,
+		atom.Main, atom.Nav, atom.Aside, atom.Dl, atom.Dt, atom.Dd, atom.Hr:
+		return true
+	}
+	return false
+}
+
+// cleanHTMLText trims the leading spaces left by inline text at line starts.
+func cleanHTMLText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimLeft(line, " ")
+	}
+	return cleanText(strings.Join(lines, "\n"))
+}
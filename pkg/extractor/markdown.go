@@ -0,0 +1,93 @@
+package extractor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// extractMarkdown normalizes a markdown document: YAML front matter and HTML
+// comments are dropped and setext headings are rewritten as ATX headings, so
+// that every heading starts with '#'.
+func extractMarkdown(r io.Reader) (string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read markdown: %w", err)
+	}
+
+	// Drop YAML front matter.
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		for i := 1; i < len(lines); i++ {
+			if t := strings.TrimSpace(lines[i]); t == "---" || t == "..." {
+				lines = lines[i+1:]
+				break
+			}
+		}
+	}
+
+	var b strings.Builder
+	inFence := false
+	inComment := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if !inFence {
+			if inComment {
+				if idx := strings.Index(line, "-->"); idx >= 0 {
+					inComment = false
+					line = line[idx+3:]
+				} else {
+					continue
+				}
+			}
+			line = stripHTMLComments(line, &inComment)
+
+			// Setext headings: a text line followed by === or ---.
+			if i+1 < len(lines) && strings.TrimSpace(line) != "" && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				next := strings.TrimSpace(lines[i+1])
+				if next != "" && strings.Trim(next, "=") == "" {
+					writeHeading(&b, 1, line)
+					i++
+					continue
+				}
+				if len(next) >= 2 && strings.Trim(next, "-") == "" {
+					writeHeading(&b, 2, line)
+					i++
+					continue
+				}
+			}
+		}
+
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return cleanText(b.String()), nil
+}
+
+// stripHTMLComments removes <!-- ... --> comments from a line. If a comment is
+// left open at the end of the line, inComment is set.
+func stripHTMLComments(line string, inComment *bool) string {
+	for {
+		start := strings.Index(line, "<!--")
+		if start < 0 {
+			return line
+		}
+		end := strings.Index(line[start+4:], "-->")
+		if end < 0 {
+			*inComment = true
+			return line[:start]
+		}
+		line = line[:start] + line[start+4+end+3:]
+	}
+}
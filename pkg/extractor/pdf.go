@@ -0,0 +1,42 @@
+package extractor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// extractPDF returns the text of each page, row by row, preceded by a
+// PageMarker line.
+func extractPDF(r io.ReaderAt, size int64) (string, error) {
+	reader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to open PDF: %w", err)
+	}
+
+	var b strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		rows, err := page.GetTextByRow()
+		if err != nil {
+			return "", fmt.Errorf("failed to read text of page %d: %w", i, err)
+		}
+
+		b.WriteString("\n")
+		b.WriteString(fmt.Sprintf(PageMarker, i))
+		b.WriteString("\n\n")
+		for _, row := range rows {
+			for _, text := range row.Content {
+				b.WriteString(text.S)
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	return cleanText(b.String()), nil
+}
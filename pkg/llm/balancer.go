@@ -0,0 +1,174 @@
+package llm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies of a Balancer.
+const (
+	// BalanceRoundRobin sends requests to the replicas in turn, in proportion
+	// to their weights.
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastOutstanding sends a request to the replica with the fewest
+	// requests in flight relative to its weight.
+	BalanceLeastOutstanding = "least-outstanding"
+)
+
+const (
+	// DefaultMaxFailures is the number of consecutive failures after which a
+	// replica is taken out of rotation.
+	DefaultMaxFailures = 3
+	// DefaultReplicaCooldown is how long an unhealthy replica is left out.
+	DefaultReplicaCooldown = 30 * time.Second
+)
+
+// Replica is one URL that serves the model of an endpoint.
+type Replica struct {
+	URL string
+	// Weight is the share of requests the replica gets. Zero means 1.
+	Weight int
+}
+
+type replica struct {
+	Replica
+	// current is the running score of the smooth weighted round-robin.
+	current     int
+	outstanding int
+	failures    int
+	downUntil   time.Time
+}
+
+// Balancer spreads the requests to an endpoint across its replicas and leaves
+// out replicas that keep failing for a while. It is safe for concurrent use.
+type Balancer struct {
+	// MaxFailures is the number of consecutive failures after which a
+	// replica is left out for Cooldown.
+	MaxFailures int
+	Cooldown    time.Duration
+
+	mu       sync.Mutex
+	replicas []*replica
+	strategy string
+	now      func() time.Time
+}
+
+// NewBalancer creates a Balancer for the replicas with the given strategy,
+// BalanceRoundRobin if it is empty.
+func NewBalancer(replicas []Replica, strategy string) (*Balancer, error) {
+	switch strategy {
+	case "":
+		strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastOutstanding:
+	default:
+		return nil, fmt.Errorf("invalid load balancing strategy '%s': must be '%s' or '%s'", strategy, BalanceRoundRobin, BalanceLeastOutstanding)
+	}
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("no replicas to balance")
+	}
+	b := &Balancer{
+		MaxFailures: DefaultMaxFailures,
+		Cooldown:    DefaultReplicaCooldown,
+		strategy:    strategy,
+		now:         time.Now,
+	}
+	for _, r := range replicas {
+		if r.URL == "" {
+			return nil, fmt.Errorf("replica without a URL")
+		}
+		if r.Weight < 0 {
+			return nil, fmt.Errorf("invalid weight %d of replica %s", r.Weight, r.URL)
+		}
+		if r.Weight == 0 {
+			r.Weight = 1
+		}
+		b.replicas = append(b.replicas, &replica{Replica: r})
+	}
+	return b, nil
+}
+
+// acquire picks the replica for the next request. Unhealthy replicas are
+// left out unless all replicas are unhealthy.
+func (b *Balancer) acquire() *replica {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	var healthy []*replica
+	for _, r := range b.replicas {
+		if !now.Before(r.downUntil) {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = b.replicas
+	}
+
+	var picked *replica
+	switch b.strategy {
+	case BalanceLeastOutstanding:
+		for _, r := range healthy {
+			// Compare outstanding/weight without division.
+			if picked == nil || r.outstanding*picked.Weight < picked.outstanding*r.Weight {
+				picked = r
+			}
+		}
+	default:
+		// Smooth weighted round-robin: every replica gains its weight, the
+		// leader is picked and pays the total.
+		total := 0
+		for _, r := range healthy {
+			r.current += r.Weight
+			total += r.Weight
+			if picked == nil || r.current > picked.current {
+				picked = r
+			}
+		}
+		picked.current -= total
+	}
+	picked.outstanding++
+	return picked
+}
+
+// release records the outcome of a request to the replica. A replica that
+// was unavailable MaxFailures times in a row is left out for Cooldown. Other
+// errors, such as a canceled request, do not count.
+func (b *Balancer) release(r *replica, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r.outstanding--
+	if err == nil {
+		r.failures = 0
+		return
+	}
+	if !Unavailable(err) {
+		return
+	}
+	r.failures++
+	if b.MaxFailures > 0 && r.failures >= b.MaxFailures {
+		r.downUntil = b.now().Add(b.Cooldown)
+		r.failures = 0
+	}
+}
+
+var (
+	balancersMu sync.Mutex
+	balancers   = make(map[string]*Balancer)
+)
+
+// SharedBalancer returns the balancer of the named endpoint, creating it on
+// first use, so that all clients of an endpoint share the replicas' load and
+// health.
+func SharedBalancer(endpoint string, replicas []Replica, strategy string) (*Balancer, error) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+	if b, ok := balancers[endpoint]; ok {
+		return b, nil
+	}
+	b, err := NewBalancer(replicas, strategy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid replicas of endpoint '%s': %w", endpoint, err)
+	}
+	balancers[endpoint] = b
+	return b, nil
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, err := NewBalancer([]Replica{{URL: "a", Weight: 2}, {URL: "b"}}, "")
+	if err != nil {
+		t.Fatalf("NewBalancer failed: %v", err)
+	}
+	var picked []string
+	for i := 0; i < 6; i++ {
+		r := b.acquire()
+		picked = append(picked, r.URL)
+		b.release(r, nil)
+	}
+	if got := strings.Join(picked, ""); got != "abaaba" {
+		t.Errorf("expected the smooth weighted order abaaba, got %s", got)
+	}
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	b, err := NewBalancer([]Replica{{URL: "a"}, {URL: "b", Weight: 2}}, BalanceLeastOutstanding)
+	if err != nil {
+		t.Fatalf("NewBalancer failed: %v", err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		counts[b.acquire().URL]++
+	}
+	// Requests in flight are spread in proportion to the weights.
+	if counts["a"] != 2 || counts["b"] != 4 {
+		t.Errorf("expected 2 requests on a and 4 on b, got %v", counts)
+	}
+}
+
+func TestBalancerUnhealthy(t *testing.T) {
+	now := time.Unix(0, 0)
+	b, err := NewBalancer([]Replica{{URL: "a"}, {URL: "b"}}, BalanceRoundRobin)
+	if err != nil {
+		t.Fatalf("NewBalancer failed: %v", err)
+	}
+	b.MaxFailures = 2
+	b.now = func() time.Time { return now }
+
+	down := &RequestError{StatusCode: http.StatusBadGateway, Err: context.DeadlineExceeded}
+	// Requests alternate, and a fails twice in a row.
+	for i := 0; i < 4; i++ {
+		r := b.acquire()
+		if r.URL == "a" {
+			b.release(r, down)
+		} else {
+			b.release(r, nil)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if r := b.acquire(); r.URL != "b" {
+			t.Fatalf("expected the unhealthy replica to be left out, got %s", r.URL)
+		}
+	}
+
+	now = now.Add(b.Cooldown)
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		seen[b.acquire().URL] = true
+	}
+	if !seen["a"] {
+		t.Error("expected the replica back after the cooldown")
+	}
+}
+
+func TestClientBalancer(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	newServer := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.WriteHeader(status)
+			w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}]}`))
+		}))
+	}
+	healthy := newServer("healthy", http.StatusOK)
+	defer healthy.Close()
+	broken := newServer("broken", http.StatusInternalServerError)
+	defer broken.Close()
+
+	b, err := NewBalancer([]Replica{{URL: healthy.URL}, {URL: broken.URL}}, BalanceRoundRobin)
+	if err != nil {
+		t.Fatalf("NewBalancer failed: %v", err)
+	}
+	client := NewClient("", "test-api-key", "test-model")
+	client.Balancer = b
+	client.Retries = 1
+	client.RetryDelay = time.Millisecond
+	for i := 0; i < 10; i++ {
+		if _, err := client.Analyze(context.Background(), "This is a test prompt."); err != nil {
+			t.Fatalf("expected the retry to reach the healthy replica, got %v", err)
+		}
+	}
+	if hits["healthy"] != 10 || hits["broken"] != DefaultMaxFailures {
+		t.Errorf("expected 10 requests on the healthy replica and %d on the broken one, got %v", DefaultMaxFailures, hits)
+	}
+}
+
+func TestSharedBalancer(t *testing.T) {
+	if _, err := SharedBalancer("invalid", []Replica{{URL: "a"}}, "random"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+	b, err := SharedBalancer("replicas", []Replica{{URL: "a"}}, "")
+	if err != nil {
+		t.Fatalf("SharedBalancer failed: %v", err)
+	}
+	if again, _ := SharedBalancer("replicas", []Replica{{URL: "a"}}, ""); again != b {
+		t.Error("expected the clients of an endpoint to share its balancer")
+	}
+}
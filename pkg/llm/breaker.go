@@ -0,0 +1,211 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState string
+
+// States of a CircuitBreaker.
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen stops all requests until the cooldown has passed.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets one probe request through, which closes the
+	// circuit if it succeeds and opens it again if it fails.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// DefaultCircuitCooldown is how long an open circuit stops requests.
+const DefaultCircuitCooldown = 30 * time.Second
+
+// ErrCircuitOpen is returned for requests that are stopped by an open circuit
+// breaker.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitChange is a change of the state of a circuit breaker. The zero value
+// is no change.
+type circuitChange struct {
+	from, to CircuitState
+}
+
+// CircuitBreaker stops the requests to an endpoint after Threshold
+// consecutive failures for Cooldown, then lets a probe request through. It is
+// safe for concurrent use.
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+	// Wait makes requests wait while the circuit is open, instead of failing
+	// with ErrCircuitOpen.
+	Wait bool
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probing is set while the probe request of a half-open circuit is in
+	// flight.
+	probing bool
+	// changed is closed and replaced on every change of the state.
+	changed chan struct{}
+	now     func() time.Time
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitCooldown
+	}
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		state:     CircuitClosed,
+		changed:   make(chan struct{}),
+		now:       time.Now,
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// set changes the state and wakes the waiting requests. b.mu must be held.
+func (b *CircuitBreaker) set(state CircuitState) circuitChange {
+	change := circuitChange{from: b.state, to: state}
+	b.state = state
+	if state == CircuitOpen {
+		b.openedAt = b.now()
+	}
+	b.wake()
+	return change
+}
+
+// wake wakes the requests that wait for a change. b.mu must be held.
+func (b *CircuitBreaker) wake() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// allow returns nil if a request may be sent. While the circuit is open, it
+// returns an error wrapping ErrCircuitOpen, or waits if Wait is set. It also
+// returns the change of state it made, if any.
+func (b *CircuitBreaker) allow(ctx context.Context) (circuitChange, error) {
+	for {
+		b.mu.Lock()
+		var wait time.Duration
+		switch b.state {
+		case CircuitClosed:
+			b.mu.Unlock()
+			return circuitChange{}, nil
+		case CircuitOpen:
+			wait = b.openedAt.Add(b.Cooldown).Sub(b.now())
+			if wait <= 0 {
+				change := b.set(CircuitHalfOpen)
+				b.probing = true
+				b.mu.Unlock()
+				return change, nil
+			}
+		case CircuitHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return circuitChange{}, nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if !b.Wait {
+			if wait > 0 {
+				return circuitChange{}, fmt.Errorf("%w after %d consecutive failures, retrying in %s", ErrCircuitOpen, b.Threshold, wait.Round(time.Second))
+			}
+			return circuitChange{}, fmt.Errorf("%w, waiting for a probe request", ErrCircuitOpen)
+		}
+		if err := waitFor(ctx, changed, wait); err != nil {
+			return circuitChange{}, err
+		}
+	}
+}
+
+// waitFor waits until changed is closed, the duration has passed if it is
+// positive, or the context is done.
+func waitFor(ctx context.Context, changed <-chan struct{}, wait time.Duration) error {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+	case <-timeout:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// record counts the outcome of a request and returns the change of state it
+// made, if any. Only errors of an unavailable endpoint count as failures.
+func (b *CircuitBreaker) record(err error) circuitChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != CircuitClosed {
+			return b.set(CircuitClosed)
+		}
+		return circuitChange{}
+	}
+	if !Unavailable(err) {
+		// The probe gave no verdict; let the next request probe.
+		if b.state == CircuitHalfOpen {
+			b.wake()
+		}
+		return circuitChange{}
+	}
+
+	b.failures++
+	switch {
+	case b.state == CircuitHalfOpen:
+		return b.set(CircuitOpen)
+	case b.state == CircuitClosed && b.failures >= b.Threshold:
+		return b.set(CircuitOpen)
+	}
+	return circuitChange{}
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*CircuitBreaker)
+)
+
+// SharedCircuitBreaker returns the circuit breaker of the named endpoint,
+// creating it on first use, so that all clients of an endpoint see its
+// failures. It returns nil if threshold is not positive.
+func SharedCircuitBreaker(endpoint string, threshold int, cooldown time.Duration, wait bool) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	if b, ok := breakers[endpoint]; ok {
+		return b
+	}
+	b := NewCircuitBreaker(threshold, cooldown)
+	b.Wait = wait
+	breakers[endpoint] = b
+	return b
+}
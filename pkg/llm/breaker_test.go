@@ -0,0 +1,92 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+	failure := &RequestError{StatusCode: http.StatusInternalServerError, Err: errors.New("500")}
+
+	if change := b.record(failure); change != (circuitChange{}) {
+		t.Errorf("expected the circuit to stay closed after one failure, got %+v", change)
+	}
+	// A bad request is not a failure of the endpoint.
+	b.record(&RequestError{StatusCode: http.StatusBadRequest, Err: errors.New("400")})
+	if change := b.record(failure); change != (circuitChange{CircuitClosed, CircuitOpen}) {
+		t.Fatalf("expected the circuit to open, got %+v", change)
+	}
+
+	_, err := b.allow(context.Background())
+	if !errors.Is(err, ErrCircuitOpen) || !Unavailable(err) {
+		t.Fatalf("expected an open circuit to fail fast, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	change, err := b.allow(context.Background())
+	if err != nil || change != (circuitChange{CircuitOpen, CircuitHalfOpen}) {
+		t.Fatalf("expected a probe after the cooldown, got %+v, %v", change, err)
+	}
+	if _, err := b.allow(context.Background()); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected only one probe at a time, got %v", err)
+	}
+	if change := b.record(failure); change != (circuitChange{CircuitHalfOpen, CircuitOpen}) {
+		t.Fatalf("expected a failed probe to open the circuit again, got %+v", change)
+	}
+
+	now = now.Add(time.Minute)
+	b.allow(context.Background())
+	if change := b.record(nil); change != (circuitChange{CircuitHalfOpen, CircuitClosed}) || b.State() != CircuitClosed {
+		t.Errorf("expected a successful probe to close the circuit, got %+v", change)
+	}
+}
+
+func TestCircuitBreakerWait(t *testing.T) {
+	requests := 0
+	var mu sync.Mutex
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.Breaker = NewCircuitBreaker(1, 20*time.Millisecond)
+	client.Breaker.Wait = true
+	var changes []CircuitState
+	client.OnCircuitChange = func(from, to CircuitState) {
+		mu.Lock()
+		changes = append(changes, to)
+		mu.Unlock()
+	}
+
+	if _, err := client.Analyze(context.Background(), "first"); err == nil {
+		t.Fatal("expected the first request to fail")
+	}
+	start := time.Now()
+	if response, err := client.Analyze(context.Background(), "second"); err != nil || response != "ok" {
+		t.Fatalf("expected the request to wait for the cooldown and succeed, got %q, %v", response, err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected the request to wait for the cooldown, waited %v", elapsed)
+	}
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] || changes[2] != want[2] {
+		t.Errorf("expected the changes %v, got %v", want, changes)
+	}
+}
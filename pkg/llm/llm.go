@@ -3,9 +3,15 @@ package llm
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
+
+	"llm-data-analyzer/pkg/tokens"
 )
 
 // Client represents a client for an OpenAI-compatible LLM API.
@@ -14,6 +20,53 @@ type Client struct {
 	APIKey      string
 	Model       string
 	HTTPClient  *http.Client
+
+	// SystemPrompt, if set, is sent as a system message before the prompt.
+	SystemPrompt string
+	// MaxTokens, if set, limits the number of tokens the model may generate.
+	MaxTokens int
+	// SupportsJSONSchema reports whether the endpoint accepts a response_format
+	// of type json_schema.
+	SupportsJSONSchema bool
+	// OnUsage, if set, is called with the token usage of every successful
+	// request. It may be called concurrently.
+	OnUsage func(Usage)
+	// BeforeRequest, if set, is called with the messages of every request
+	// before it is sent. An error cancels the request and is returned. It may
+	// be called concurrently.
+	BeforeRequest func(messages []Message) error
+	// RateLimiter, if set, delays requests to stay within the endpoint's
+	// quota. Each request reserves its prompt tokens and MaxTokens.
+	RateLimiter *RateLimiter
+	// Retries is the number of times a request that failed with a transient
+	// error is sent again, after RetryDelay, doubled for every attempt.
+	Retries    int
+	RetryDelay time.Duration
+	// Balancer, if set, spreads the requests across replicas instead of
+	// sending them to EndpointURL.
+	Balancer *Balancer
+	// Breaker, if set, stops requests while the endpoint keeps failing.
+	Breaker *CircuitBreaker
+	// OnCircuitChange, if set, is called when a request of the client changes
+	// the state of the circuit breaker. It may be called concurrently.
+	OnCircuitChange func(from, to CircuitState)
+	// Cache, if set, answers requests that were answered before. A request is
+	// identified by Name, EndpointURL and its payload: the model, the
+	// generation parameters and the messages.
+	Cache ResponseCache
+	// Recording, if set, records the requests and their responses, or answers
+	// the requests from a recording in replay mode.
+	Recording *Recording
+	// Name identifies the endpoint in cache keys and recordings.
+	Name string
+	// Mock, if set, answers the requests instead of the endpoint.
+	Mock *Mock
+}
+
+// ResponseCache stores the answers of requests by key.
+type ResponseCache interface {
+	Get(key string) (string, bool)
+	Put(key, response string) error
 }
 
 // NewClient creates a new LLM client.
@@ -23,13 +76,29 @@ func NewClient(endpointURL, apiKey, model string) *Client {
 		APIKey:      apiKey,
 		Model:       model,
 		HTTPClient:  &http.Client{},
+		RetryDelay:  time.Second,
 	}
 }
 
 // ChatCompletionRequest represents the request payload for a chat completion.
 type ChatCompletionRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat asks the model for a structured response.
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema is the schema of a response_format of type json_schema.
+type JSONSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict,omitempty"`
 }
 
 // Message represents a single message in a chat completion request.
@@ -41,6 +110,17 @@ type Message struct {
 // ChatCompletionResponse represents the response from a chat completion.
 type ChatCompletionResponse struct {
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+}
+
+// Usage is the number of tokens a request consumed.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// Counted reports that the endpoint did not report the usage and the
+	// tokens were counted locally.
+	Counted bool `json:"-"`
 }
 
 // Choice represents a single choice in a chat completion response.
@@ -50,16 +130,34 @@ type Choice struct {
 
 // Analyze sends a prompt to the LLM and returns the response.
 func (c *Client) Analyze(ctx context.Context, prompt string) (string, error) {
-	messages := []Message{
+	return c.Chat(ctx, []Message{
 		{
 			Role:    "user",
 			Content: prompt,
 		},
+	}, nil)
+}
+
+// Chat sends a conversation to the LLM and returns the response. The system
+// prompt, if any, is sent before the messages. A non-nil format is sent as
+// the response_format of the request. A request that fails with a transient
+// error is retried up to Retries times. Answers are served from and stored in
+// the Cache, if set.
+func (c *Client) Chat(ctx context.Context, messages []Message, format *ResponseFormat) (string, error) {
+	if c.SystemPrompt != "" {
+		messages = append([]Message{
+			{
+				Role:    "system",
+				Content: c.SystemPrompt,
+			},
+		}, messages...)
 	}
 
 	reqPayload := ChatCompletionRequest{
-		Model:    c.Model,
-		Messages: messages,
+		Model:          c.Model,
+		Messages:       messages,
+		MaxTokens:      c.MaxTokens,
+		ResponseFormat: format,
 	}
 
 	reqBytes, err := json.Marshal(reqPayload)
@@ -67,9 +165,107 @@ func (c *Client) Analyze(ctx context.Context, prompt string) (string, error) {
 		return "", fmt.Errorf("failed to marshal request payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", c.EndpointURL, bytes.NewBuffer(reqBytes))
+	// A cached answer costs nothing and is not subject to BeforeRequest.
+	var cacheKey string
+	if c.Cache != nil {
+		cacheKey = c.cacheKey(reqBytes)
+		if content, ok := c.Cache.Get(cacheKey); ok {
+			return content, nil
+		}
+	}
+
+	if c.BeforeRequest != nil {
+		if err := c.BeforeRequest(messages); err != nil {
+			return "", err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if c.Breaker != nil {
+			change, err := c.Breaker.allow(ctx)
+			c.circuitChanged(change)
+			if err != nil {
+				return "", err
+			}
+		}
+		if c.RateLimiter != nil {
+			if err := c.RateLimiter.Wait(ctx, PromptTokens(messages)+c.MaxTokens); err != nil {
+				if c.Breaker != nil {
+					// Give up a probe that was not sent.
+					c.Breaker.record(err)
+				}
+				return "", err
+			}
+		}
+
+		content, usage, err := c.exchange(ctx, reqBytes)
+		if c.Breaker != nil {
+			c.circuitChanged(c.Breaker.record(err))
+		}
+		if err == nil {
+			if c.OnUsage != nil {
+				if usage == nil {
+					usage = countUsage(messages, content)
+				}
+				c.OnUsage(*usage)
+			}
+			if c.Cache != nil {
+				// A response that cannot be cached is still returned.
+				c.Cache.Put(cacheKey, content)
+			}
+			return content, nil
+		}
+
+		var reqErr *RequestError
+		if attempt >= c.Retries || !errors.As(err, &reqErr) || !reqErr.Transient() {
+			return "", err
+		}
+		// Back off exponentially before the next attempt.
+		timer := time.NewTimer(c.RetryDelay << attempt)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", ctx.Err()
+		}
+	}
+}
+
+// cacheKey returns the key of a request in the cache.
+func (c *Client) cacheKey(reqBytes []byte) string {
+	h := sha256.New()
+	h.Write([]byte(c.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(c.EndpointURL))
+	h.Write([]byte{0})
+	h.Write(reqBytes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// circuitChanged reports a change of the circuit breaker's state.
+func (c *Client) circuitChanged(change circuitChange) {
+	if change != (circuitChange{}) && c.OnCircuitChange != nil {
+		c.OnCircuitChange(change.from, change.to)
+	}
+}
+
+// send sends one request, to a replica picked by the balancer if there is
+// one, or to the mock, and returns the answer and the usage the endpoint
+// reported, if any.
+func (c *Client) send(ctx context.Context, reqBytes []byte) (content string, usage *Usage, err error) {
+	if c.Mock != nil {
+		return c.Mock.answer(ctx, reqBytes)
+	}
+	url := c.EndpointURL
+	if c.Balancer != nil {
+		r := c.Balancer.acquire()
+		url = r.URL
+		defer func() { c.Balancer.release(r, err) }()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBytes))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -77,22 +273,88 @@ func (c *Client) Analyze(ctx context.Context, prompt string) (string, error) {
 
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		}
+		return "", nil, &RequestError{Err: fmt.Errorf("failed to send request: %w", err)}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
+		return "", nil, &RequestError{StatusCode: resp.StatusCode, Err: fmt.Errorf("received non-200 status code: %d", resp.StatusCode)}
 	}
 
 	var respPayload ChatCompletionResponse
 	if err := json.NewDecoder(resp.Body).Decode(&respPayload); err != nil {
-		return "", fmt.Errorf("failed to decode response payload: %w", err)
+		return "", nil, &RequestError{StatusCode: resp.StatusCode, Err: fmt.Errorf("failed to decode response payload: %w", err)}
 	}
 
 	if len(respPayload.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
+		return "", nil, &RequestError{StatusCode: resp.StatusCode, Err: fmt.Errorf("no choices in response")}
 	}
+	return respPayload.Choices[0].Message.Content, respPayload.Usage, nil
+}
+
+// RequestError is a request the endpoint did not serve: it could not be sent,
+// or the endpoint answered with an error status or an invalid response.
+type RequestError struct {
+	// StatusCode is the HTTP status of the answer, or 0 if there was none.
+	StatusCode int
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Transient reports whether the request may succeed if it is sent again:
+// the endpoint was not reached, timed out, was rate limited or failed.
+func (e *RequestError) Transient() bool {
+	switch {
+	case e.StatusCode == 0, e.StatusCode == http.StatusRequestTimeout, e.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// Unavailable reports whether an error means that the endpoint could not
+// serve the request, so that another endpoint may: transient errors, an
+// endpoint that rejects the key or does not know the model, invalid responses
+// and an open circuit breaker. Errors of the request itself, such as a bad
+// request, and other errors raised before sending, such as a canceled
+// context, are not.
+func Unavailable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		return false
+	}
+	switch reqErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return reqErr.Transient() || reqErr.StatusCode == http.StatusOK
+}
+
+// PromptTokens counts the input tokens of a request with the messages.
+func PromptTokens(messages []Message) int {
+	count := tokens.ReplyOverhead
+	for _, message := range messages {
+		count += tokens.Count(message.Content) + tokens.MessageOverhead
+	}
+	return count
+}
 
-	return respPayload.Choices[0].Message.Content, nil
+// countUsage counts the usage of a request locally.
+func countUsage(messages []Message, content string) *Usage {
+	usage := &Usage{PromptTokens: PromptTokens(messages), Counted: true}
+	usage.CompletionTokens = tokens.Count(content)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
 }
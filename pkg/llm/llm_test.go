@@ -3,9 +3,14 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"llm-data-analyzer/pkg/tokens"
 )
 
 func TestAnalyze(t *testing.T) {
@@ -50,4 +55,170 @@ func TestAnalyze(t *testing.T) {
 	if response != expectedResponse {
 		t.Errorf("Expected response '%s', got '%s'", expectedResponse, response)
 	}
-}
\ No newline at end of file
+}
+
+func TestUsage(t *testing.T) {
+	reportUsage := true
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := ChatCompletionResponse{
+			Choices: []Choice{{Message: Message{Role: "assistant", Content: "This is a test response."}}},
+		}
+		if reportUsage {
+			resp.Usage = &Usage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer mockServer.Close()
+
+	var usages []Usage
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.OnUsage = func(usage Usage) {
+		usages = append(usages, usage)
+	}
+
+	if _, err := client.Analyze(context.Background(), "This is a test prompt."); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	reportUsage = false
+	if _, err := client.Analyze(context.Background(), "This is a test prompt."); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if len(usages) != 2 {
+		t.Fatalf("expected 2 usages, got %d", len(usages))
+	}
+	if usages[0] != (Usage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}) {
+		t.Errorf("unexpected reported usage: %+v", usages[0])
+	}
+	counted := usages[1]
+	if !counted.Counted || counted.PromptTokens <= tokens.MessageOverhead+tokens.ReplyOverhead || counted.CompletionTokens == 0 ||
+		counted.TotalTokens != counted.PromptTokens+counted.CompletionTokens {
+		t.Errorf("unexpected counted usage: %+v", counted)
+	}
+}
+
+func TestBeforeRequest(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	stop := errors.New("stop")
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.SystemPrompt = "You are terse."
+	client.BeforeRequest = func(messages []Message) error {
+		if len(messages) != 2 || messages[0].Role != "system" {
+			t.Errorf("expected the system prompt and the prompt, got %+v", messages)
+		}
+		if PromptTokens(messages) <= 2*tokens.MessageOverhead+tokens.ReplyOverhead {
+			t.Errorf("unexpected prompt tokens: %d", PromptTokens(messages))
+		}
+		return stop
+	}
+	if _, err := client.Analyze(context.Background(), "This is a test prompt."); !errors.Is(err, stop) {
+		t.Errorf("expected the hook's error, got %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("expected no request, got %d", requests)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[requests]
+		requests++
+		w.WriteHeader(status)
+		w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.RetryDelay = time.Millisecond
+	client.Retries = 1
+	_, err := client.Analyze(context.Background(), "This is a test prompt.")
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || reqErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the status of the last attempt, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected 2 attempts, got %d", requests)
+	}
+
+	requests = 0
+	client.Retries = 2
+	if response, err := client.Analyze(context.Background(), "This is a test prompt."); err != nil || response != "ok" {
+		t.Errorf("expected the third attempt to succeed, got %q, %v", response, err)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&RequestError{Err: errors.New("connection refused")}, true},
+		{&RequestError{StatusCode: http.StatusInternalServerError, Err: errors.New("500")}, true},
+		{&RequestError{StatusCode: http.StatusTooManyRequests, Err: errors.New("429")}, true},
+		{&RequestError{StatusCode: http.StatusUnauthorized, Err: errors.New("401")}, true},
+		{&RequestError{StatusCode: http.StatusOK, Err: errors.New("no choices in response")}, true},
+		{&RequestError{StatusCode: http.StatusBadRequest, Err: errors.New("400")}, false},
+		{context.Canceled, false},
+		{errors.New("budget exceeded"), false},
+	}
+	for _, tt := range tests {
+		wrapped := fmt.Errorf("failed to analyze chunk 1: %w", tt.err)
+		if got := Unavailable(wrapped); got != tt.want {
+			t.Errorf("Unavailable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+type mapCache map[string]string
+
+func (m mapCache) Get(key string) (string, bool) {
+	response, ok := m[key]
+	return response, ok
+}
+
+func (m mapCache) Put(key, response string) error {
+	m[key] = response
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"choices": [{"message": {"content": "answer %d"}}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}}`, requests)
+	}))
+	defer mockServer.Close()
+
+	cache := mapCache{}
+	usages := 0
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.Name = "test"
+	client.Cache = cache
+	client.OnUsage = func(Usage) { usages++ }
+	for i := 0; i < 2; i++ {
+		if response, err := client.Analyze(context.Background(), "This is a test prompt."); err != nil || response != "answer 1" {
+			t.Fatalf("expected the first answer, got %q, %v", response, err)
+		}
+	}
+	if requests != 1 || usages != 1 {
+		t.Errorf("expected 1 request and 1 usage, got %d and %d", requests, usages)
+	}
+
+	// A different model, endpoint name or prompt is a different request.
+	client.Model = "other-model"
+	client.Analyze(context.Background(), "This is a test prompt.")
+	client.Name = "other"
+	client.Analyze(context.Background(), "This is a test prompt.")
+	client.Analyze(context.Background(), "This is another test prompt.")
+	if requests != 4 || len(cache) != 4 {
+		t.Errorf("expected 4 requests and 4 cached responses, got %d and %d", requests, len(cache))
+	}
+}
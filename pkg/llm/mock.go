@@ -0,0 +1,287 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mock answers requests locally instead of sending them, for developing
+// prompts and pipelines without a model. Its answers are deterministic: the
+// Response if set, a JSON document that is valid under the json_schema of the
+// request's response_format, or else a digest of the request. It is safe for
+// concurrent use.
+type Mock struct {
+	// Response, if set, is the answer to every request without a
+	// json_schema response_format.
+	Response string
+	// Latency delays every answer.
+	Latency time.Duration
+	// FailureRate is the share of requests, between 0 and 1, that fail with
+	// status 500.
+	FailureRate float64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// NewMock creates a Mock whose failures are drawn from the seed.
+func NewMock(seed int64) *Mock {
+	return &Mock{rand: rand.New(rand.NewSource(seed))}
+}
+
+// fail reports whether the next request fails.
+func (m *Mock) fail() bool {
+	if m.FailureRate <= 0 {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rand.Float64() < m.FailureRate
+}
+
+// answer answers a request like send, with the usage left to be counted.
+func (m *Mock) answer(ctx context.Context, reqBytes []byte) (string, *Usage, error) {
+	if m.Latency > 0 {
+		timer := time.NewTimer(m.Latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", nil, ctx.Err()
+		}
+	}
+	if m.fail() {
+		return "", nil, &RequestError{StatusCode: http.StatusInternalServerError, Err: fmt.Errorf("received non-200 status code: %d (mock failure)", http.StatusInternalServerError)}
+	}
+
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(reqBytes, &req); err != nil {
+		return "", nil, fmt.Errorf("failed to decode request payload: %w", err)
+	}
+	if format := req.ResponseFormat; format != nil && format.JSONSchema != nil {
+		doc, err := exampleJSON(format.JSONSchema.Schema)
+		if err != nil {
+			return "", nil, &RequestError{StatusCode: http.StatusBadRequest, Err: fmt.Errorf("mock cannot answer schema %s: %w", format.JSONSchema.Name, err)}
+		}
+		return doc, nil, nil
+	}
+	if m.Response != "" {
+		return m.Response, nil, nil
+	}
+	return digest(req, reqBytes), nil, nil
+}
+
+// digest describes a request in a few lines: its size, its hash and the
+// beginning of its last message.
+func digest(req ChatCompletionRequest, reqBytes []byte) string {
+	sum := sha256.Sum256(reqBytes)
+	var last string
+	if len(req.Messages) > 0 {
+		last = strings.Join(strings.Fields(req.Messages[len(req.Messages)-1].Content), " ")
+		if r := []rune(last); len(r) > 200 {
+			last = string(r[:200]) + "..."
+		}
+	}
+	return fmt.Sprintf("Mock response of model %s to %d message(s), %d prompt tokens, request %s.\nLast message: %s",
+		req.Model, len(req.Messages), PromptTokens(req.Messages), hex.EncodeToString(sum[:6]), last)
+}
+
+// maxExampleDepth bounds the nesting of example documents, so that recursive
+// schemas end.
+const maxExampleDepth = 16
+
+// exampleJSON returns a JSON document that is valid under the schema, for the
+// common keywords: type, properties, items, enum, const, the bounds of
+// numbers, strings and arrays, formats, local $refs, allOf, anyOf and oneOf.
+func exampleJSON(schema json.RawMessage) (string, error) {
+	var root any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+	g := exampleGenerator{root: root}
+	doc, err := json.MarshalIndent(g.example(root, 0), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if g.err != nil {
+		return "", g.err
+	}
+	return string(doc), nil
+}
+
+type exampleGenerator struct {
+	root any
+	err  error
+}
+
+func (g *exampleGenerator) example(node any, depth int) any {
+	s, ok := node.(map[string]any)
+	if !ok || depth > maxExampleDepth {
+		return nil
+	}
+	if ref, ok := s["$ref"].(string); ok {
+		return g.example(g.resolve(ref), depth+1)
+	}
+	if c, ok := s["const"]; ok {
+		return c
+	}
+	if enum, ok := s["enum"].([]any); ok && len(enum) > 0 {
+		return enum[0]
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		// The parts are taken to be objects, whose properties are merged.
+		merged := g.object(s, depth)
+		for _, part := range all {
+			if object, ok := g.example(part, depth+1).(map[string]any); ok {
+				for k, v := range object {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	}
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if choices, ok := s[key].([]any); ok && len(choices) > 0 {
+			return g.example(choices[0], depth+1)
+		}
+	}
+
+	switch typ := schemaType(s); typ {
+	case "object":
+		return g.object(s, depth)
+	case "array":
+		n := max(1, intKeyword(s, "minItems"))
+		if maxItems, ok := s["maxItems"].(float64); ok {
+			n = min(n, int(maxItems))
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i] = g.example(s["items"], depth+1)
+		}
+		return items
+	case "string":
+		return exampleString(s)
+	case "integer", "number":
+		return exampleNumber(s, typ == "integer")
+	case "boolean":
+		return false
+	}
+	return nil
+}
+
+// object returns an object with all properties of the schema.
+func (g *exampleGenerator) object(s map[string]any, depth int) map[string]any {
+	object := map[string]any{}
+	properties, _ := s["properties"].(map[string]any)
+	for name, property := range properties {
+		object[name] = g.example(property, depth+1)
+	}
+	return object
+}
+
+// resolve returns the node of a local $ref such as "#/$defs/item".
+func (g *exampleGenerator) resolve(ref string) any {
+	if !strings.HasPrefix(ref, "#") {
+		if g.err == nil {
+			g.err = fmt.Errorf("unsupported $ref '%s': only local references are resolved", ref)
+		}
+		return nil
+	}
+	node := g.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = object[part]
+	}
+	return node
+}
+
+// schemaType returns the type of a schema: the first non-null one of a list,
+// or one implied by its keywords.
+func schemaType(s map[string]any) string {
+	switch t := s["type"].(type) {
+	case string:
+		return t
+	case []any:
+		for _, v := range t {
+			if name, ok := v.(string); ok && name != "null" {
+				return name
+			}
+		}
+		return "null"
+	}
+	switch {
+	case s["properties"] != nil:
+		return "object"
+	case s["items"] != nil:
+		return "array"
+	}
+	return "string"
+}
+
+func intKeyword(s map[string]any, key string) int {
+	n, _ := s[key].(float64)
+	return int(n)
+}
+
+func exampleString(s map[string]any) string {
+	var text string
+	switch s["format"] {
+	case "date":
+		text = "2026-01-01"
+	case "date-time":
+		text = "2026-01-01T00:00:00Z"
+	case "time":
+		text = "00:00:00Z"
+	case "email":
+		text = "mock@example.com"
+	case "uri", "url":
+		text = "https://example.com/"
+	case "uuid":
+		text = "00000000-0000-4000-8000-000000000000"
+	default:
+		text = "mock"
+	}
+	if minLength := intKeyword(s, "minLength"); len(text) < minLength {
+		text += strings.Repeat("x", minLength-len(text))
+	}
+	if maxLength, ok := s["maxLength"].(float64); ok && len(text) > int(maxLength) {
+		text = text[:int(maxLength)]
+	}
+	return text
+}
+
+func exampleNumber(s map[string]any, integer bool) float64 {
+	n := 0.0
+	if minimum, ok := s["minimum"].(float64); ok && n < minimum {
+		n = minimum
+	}
+	if minimum, ok := s["exclusiveMinimum"].(float64); ok && n <= minimum {
+		n = minimum + 1
+	}
+	if maximum, ok := s["maximum"].(float64); ok && n > maximum {
+		n = maximum
+	}
+	if maximum, ok := s["exclusiveMaximum"].(float64); ok && n >= maximum {
+		n = maximum - 1
+	}
+	if integer && n != float64(int64(n)) {
+		// Round up into the range.
+		n = float64(int64(n) + 1)
+	}
+	return n
+}
@@ -0,0 +1,94 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMock(t *testing.T) {
+	client := NewClient("", "", "mock-model")
+	client.Mock = NewMock(1)
+	first, err := client.Analyze(context.Background(), "Analyze this text.")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if !strings.Contains(first, "mock-model") || !strings.Contains(first, "Analyze this text.") {
+		t.Errorf("expected a digest of the request, got %q", first)
+	}
+	if again, _ := client.Analyze(context.Background(), "Analyze this text."); again != first {
+		t.Errorf("expected the same digest, got %q and %q", first, again)
+	}
+	if other, _ := client.Analyze(context.Background(), "Analyze that text."); other == first {
+		t.Error("expected another digest for another request")
+	}
+
+	client.Mock.Response = "canned"
+	if response, _ := client.Analyze(context.Background(), "Analyze this text."); response != "canned" {
+		t.Errorf("expected the canned response, got %q", response)
+	}
+
+	client.Mock.FailureRate = 1
+	var reqErr *RequestError
+	if _, err := client.Analyze(context.Background(), "Analyze this text."); !errors.As(err, &reqErr) || reqErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected a mock failure, got %v", err)
+	}
+
+	client.Mock.FailureRate = 0
+	client.Mock.Latency = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := client.Analyze(ctx, "Analyze this text."); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the latency to be canceled, got %v", err)
+	}
+}
+
+func TestMockSchema(t *testing.T) {
+	schema := `{
+		"type": "object",
+		"properties": {
+			"title": {"type": "string", "minLength": 6},
+			"severity": {"enum": ["high", "low"]},
+			"count": {"type": "integer", "exclusiveMinimum": 0.5},
+			"date": {"type": "string", "format": "date"},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 2},
+			"owner": {"$ref": "#/$defs/person"},
+			"note": {"type": ["null", "boolean"]}
+		},
+		"$defs": {"person": {"properties": {"name": {"const": "mock"}}}}
+	}`
+	client := NewClient("", "", "mock-model")
+	client.Mock = NewMock(1)
+	client.Mock.Response = "ignored"
+	format := &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchema{Name: "test", Schema: json.RawMessage(schema)}}
+	response, err := client.Chat(context.Background(), []Message{{Role: "user", Content: "Analyze this text."}}, format)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(response), &got); err != nil {
+		t.Fatalf("expected JSON, got %q", response)
+	}
+	want := map[string]any{
+		"title":    "mockxx",
+		"severity": "high",
+		"count":    2.0,
+		"date":     "2026-01-01",
+		"tags":     []any{"mock", "mock"},
+		"owner":    map[string]any{"name": "mock"},
+		"note":     false,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	format.JSONSchema.Schema = json.RawMessage(`{"$ref": "other.json"}`)
+	if _, err := client.Chat(context.Background(), []Message{{Role: "user", Content: "Analyze this text."}}, format); err == nil {
+		t.Error("expected an error for a remote $ref")
+	}
+}
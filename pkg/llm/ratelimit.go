@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket that holds at most limit units and refills at
+// limit units per minute. Reservations may take more units than available;
+// the caller then waits until the deficit has refilled.
+type bucket struct {
+	limit     float64
+	available float64
+	last      time.Time
+}
+
+func newBucket(perMinute int, now time.Time) *bucket {
+	return &bucket{limit: float64(perMinute), available: float64(perMinute), last: now}
+}
+
+// reserve takes n units and returns how long the caller must wait before
+// using them.
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	rate := b.limit / time.Minute.Seconds()
+	b.available = min(b.limit, b.available+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	b.available -= n
+	if b.available >= 0 {
+		return 0
+	}
+	return time.Duration(-b.available / rate * float64(time.Second))
+}
+
+// RateLimiter spaces the requests to an endpoint to stay within its requests
+// per minute and tokens per minute. It is safe for concurrent use.
+type RateLimiter struct {
+	mu       sync.Mutex
+	requests *bucket
+	tokens   *bucket
+	now      func() time.Time
+}
+
+// NewRateLimiter creates a RateLimiter. A limit of zero is not enforced.
+func NewRateLimiter(requestsPerMinute, tokensPerMinute int) *RateLimiter {
+	l := &RateLimiter{now: time.Now}
+	start := l.now()
+	if requestsPerMinute > 0 {
+		l.requests = newBucket(requestsPerMinute, start)
+	}
+	if tokensPerMinute > 0 {
+		l.tokens = newBucket(tokensPerMinute, start)
+	}
+	return l
+}
+
+// reserve reserves capacity for one request with the given tokens and
+// returns how long to wait before sending it.
+func (l *RateLimiter) reserve(tokens int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	if l.requests != nil {
+		wait = l.requests.reserve(1, now)
+	}
+	if l.tokens != nil {
+		wait = max(wait, l.tokens.reserve(float64(tokens), now))
+	}
+	return wait
+}
+
+// Wait reserves capacity for one request with the given tokens and blocks
+// until the request may be sent, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context, tokens int) error {
+	wait := l.reserve(tokens)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*RateLimiter)
+)
+
+// SharedRateLimiter returns the rate limiter of the named endpoint, creating
+// it on first use, so that all clients of an endpoint share its quota. It
+// returns nil if neither limit is set.
+func SharedRateLimiter(endpoint string, requestsPerMinute, tokensPerMinute int) *RateLimiter {
+	if requestsPerMinute <= 0 && tokensPerMinute <= 0 {
+		return nil
+	}
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	if l, ok := rateLimiters[endpoint]; ok {
+		return l
+	}
+	l := NewRateLimiter(requestsPerMinute, tokensPerMinute)
+	rateLimiters[endpoint] = l
+	return l
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewRateLimiter(60, 1000)
+	l.now = func() time.Time { return now }
+	l.requests.last, l.tokens.last = now, now
+
+	// The first request fits into the full buckets.
+	if wait := l.reserve(400); wait != 0 {
+		t.Errorf("expected no wait, got %v", wait)
+	}
+	// 700 tokens leave a deficit of 100 tokens, refilled in 6 seconds.
+	if wait := l.reserve(700); wait != 6*time.Second {
+		t.Errorf("expected a wait of 6s for the tokens, got %v", wait)
+	}
+
+	now = now.Add(time.Minute)
+	// 60 requests per minute allow a burst of 60, then one per second.
+	for i := 0; i < 60; i++ {
+		if wait := l.reserve(0); wait != 0 {
+			t.Fatalf("expected no wait for request %d, got %v", i+1, wait)
+		}
+	}
+	if wait := l.reserve(0); wait != time.Second {
+		t.Errorf("expected a wait of 1s for the requests, got %v", wait)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := NewRateLimiter(1, 0)
+	if err := l.Wait(context.Background(), 0); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, 0); err != context.DeadlineExceeded {
+		t.Errorf("expected the second request to wait for the next minute, got %v", err)
+	}
+}
+
+func TestSharedRateLimiter(t *testing.T) {
+	if SharedRateLimiter("unlimited", 0, 0) != nil {
+		t.Error("expected no limiter without limits")
+	}
+	l := SharedRateLimiter("shared", 10, 0)
+	if l == nil || SharedRateLimiter("shared", 10, 0) != l {
+		t.Error("expected the clients of an endpoint to share its limiter")
+	}
+	if SharedRateLimiter("other", 10, 0) == l {
+		t.Error("expected endpoints to have their own limiters")
+	}
+}
@@ -0,0 +1,131 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrNotRecorded is returned in replay mode for a request that is not in the
+// recording.
+var ErrNotRecorded = errors.New("no recorded response")
+
+// exchange is the file of one recorded request. It holds the final outcome of
+// the request: the answer and usage, or the error.
+type exchange struct {
+	Endpoint   string          `json:"endpoint"`
+	Request    json.RawMessage `json:"request"`
+	Response   string          `json:"response,omitempty"`
+	Usage      *Usage          `json:"usage,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Recording is a directory of requests and their responses, one file per
+// request. A request is identified by the endpoint name and its payload, but
+// not by the URL, so that a recording can be replayed against other hosts.
+type Recording struct {
+	dir string
+	// Replay answers requests from the recording instead of sending them.
+	Replay bool
+}
+
+// NewRecording creates a Recording in the directory. In replay mode, the
+// directory must exist.
+func NewRecording(dir string, replay bool) (*Recording, error) {
+	if replay {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recording: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("recording %s is not a directory", dir)
+		}
+	}
+	return &Recording{dir: dir, Replay: replay}, nil
+}
+
+// Dir returns the directory of the recording.
+func (r *Recording) Dir() string {
+	return r.dir
+}
+
+func (r *Recording) key(endpoint string, reqBytes []byte) string {
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write(reqBytes)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *Recording) path(key string) string {
+	return filepath.Join(r.dir, key+".json")
+}
+
+// save records the outcome of a request. A later outcome of the same request,
+// such as a successful retry, replaces an earlier one.
+func (r *Recording) save(key, endpoint string, reqBytes []byte, content string, usage *Usage, err error) error {
+	e := exchange{Endpoint: endpoint, Request: reqBytes, Response: content, Usage: usage}
+	var reqErr *RequestError
+	if errors.As(err, &reqErr) {
+		e.StatusCode = reqErr.StatusCode
+		e.Error = reqErr.Err.Error()
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode recorded request: %w", err)
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	if err := os.WriteFile(r.path(key), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to record request: %w", err)
+	}
+	return nil
+}
+
+// load returns the recorded outcome of a request.
+func (r *Recording) load(key, endpoint string) (string, *Usage, error) {
+	data, err := os.ReadFile(r.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil, fmt.Errorf("%w for request %s to endpoint '%s' in %s; record it again with --record", ErrNotRecorded, key[:12], endpoint, r.dir)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read recorded request: %w", err)
+	}
+	var e exchange
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", nil, fmt.Errorf("failed to decode recorded request %s: %w", r.path(key), err)
+	}
+	if e.Error != "" {
+		return "", nil, &RequestError{StatusCode: e.StatusCode, Err: errors.New(e.Error)}
+	}
+	return e.Response, e.Usage, nil
+}
+
+// exchange sends one request, or answers it from the recording in replay
+// mode. In record mode, the outcome of a request the endpoint answered or
+// failed is recorded; requests that were not sent, such as canceled ones, are
+// not.
+func (c *Client) exchange(ctx context.Context, reqBytes []byte) (string, *Usage, error) {
+	if c.Recording == nil {
+		return c.send(ctx, reqBytes)
+	}
+	key := c.Recording.key(c.Name, reqBytes)
+	if c.Recording.Replay {
+		return c.Recording.load(key, c.Name)
+	}
+	content, usage, err := c.send(ctx, reqBytes)
+	var reqErr *RequestError
+	if err == nil || errors.As(err, &reqErr) {
+		if saveErr := c.Recording.save(key, c.Name, reqBytes, content, usage, err); saveErr != nil {
+			return "", nil, saveErr
+		}
+	}
+	return content, usage, err
+}
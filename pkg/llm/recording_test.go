@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecording(t *testing.T) {
+	statuses := []int{http.StatusOK, http.StatusBadRequest}
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[requests])
+		requests++
+		w.Write([]byte(`{"choices": [{"message": {"content": "recorded"}}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}}`))
+	}))
+
+	dir := t.TempDir()
+	rec, _ := NewRecording(dir, false)
+	client := NewClient(mockServer.URL, "test-api-key", "test-model")
+	client.Name = "test"
+	client.Recording = rec
+	if _, err := client.Analyze(context.Background(), "first"); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if _, err := client.Analyze(context.Background(), "second"); err == nil {
+		t.Fatal("expected the bad request to fail")
+	}
+	mockServer.Close()
+
+	// The recording is replayed against another URL.
+	replay, err := NewRecording(dir, true)
+	if err != nil {
+		t.Fatalf("NewRecording failed: %v", err)
+	}
+	var usage Usage
+	client = NewClient("http://127.0.0.1:1", "test-api-key", "test-model")
+	client.Name = "test"
+	client.Recording = replay
+	client.OnUsage = func(u Usage) { usage = u }
+	if response, err := client.Analyze(context.Background(), "first"); err != nil || response != "recorded" {
+		t.Errorf("expected the recorded answer, got %q, %v", response, err)
+	}
+	if usage.TotalTokens != 7 {
+		t.Errorf("expected the recorded usage, got %+v", usage)
+	}
+	var reqErr *RequestError
+	if _, err := client.Analyze(context.Background(), "second"); !errors.As(err, &reqErr) || reqErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected the recorded error, got %v", err)
+	}
+	if _, err := client.Analyze(context.Background(), "third"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("expected a replay miss, got %v", err)
+	}
+
+	if _, err := NewRecording(dir+"/missing", true); err == nil {
+		t.Error("expected an error for a missing recording")
+	}
+}
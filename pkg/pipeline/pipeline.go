@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Stage modes.
+const (
+	// ModeMap analyzes every chunk of the input.
+	ModeMap = "map"
+	// ModeReduce summarizes the input, or the results of a map stage.
+	ModeReduce = "reduce"
+	// ModePerRecord analyzes every record of a JSONL input.
+	ModePerRecord = "per-record"
+	// ModeFilter keeps the records of a JSONL input the model selects.
+	ModeFilter = "filter"
+)
+
+// DefaultCacheDir is the cache directory, relative to the pipeline file, if
+// the pipeline does not set one.
+const DefaultCacheDir = ".pipeline-cache"
+
+// keyFile holds the cache key of a stage's cached output.
+const keyFile = "key"
+
+// startFile holds the cache key of a stage's last started run.
+const startFile = "started"
+
+// Stage is one step of a pipeline.
+type Stage struct {
+	// Name identifies the stage; other stages use it as their input.
+	Name string `yaml:"name"`
+	// Input is the name of an earlier stage or the path of a file.
+	Input string `yaml:"input"`
+	// Mode is ModeMap, ModeReduce, ModePerRecord or ModeFilter.
+	Mode string `yaml:"mode"`
+	// Endpoint is the name of the endpoint in the config file. If empty, the
+	// pipeline's endpoint is used.
+	Endpoint string `yaml:"endpoint"`
+	// Prompt is the path of the prompt file.
+	Prompt string `yaml:"prompt"`
+	// Schema is the path of an optional JSON Schema file for the results.
+	Schema string `yaml:"schema"`
+	// Strategy is the reduce strategy of a reduce stage.
+	Strategy string `yaml:"strategy"`
+	// Output is an optional path the stage's output is copied to.
+	Output string `yaml:"output"`
+}
+
+// Pipeline is a set of stages read from a pipeline file.
+type Pipeline struct {
+	// Endpoint is the default endpoint of the stages.
+	Endpoint string `yaml:"endpoint"`
+	// CacheDir holds the outputs of the stages.
+	CacheDir string  `yaml:"cache_dir"`
+	Stages   []Stage `yaml:"stages"`
+}
+
+// validName matches the stage names, which are also the directories of the
+// stages in the cache directory.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Load reads a pipeline file. Relative paths in the file are resolved
+// against the file's directory.
+func Load(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline file: %w", err)
+	}
+	return Parse(data, filepath.Dir(path))
+}
+
+// Parse parses and validates a pipeline. Relative paths are resolved against
+// dir.
+func Parse(data []byte, dir string) (*Pipeline, error) {
+	var p Pipeline
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline file: %w", err)
+	}
+	if len(p.Stages) == 0 {
+		return nil, fmt.Errorf("pipeline has no stages")
+	}
+
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	if p.CacheDir == "" {
+		p.CacheDir = DefaultCacheDir
+	}
+	p.CacheDir = resolve(p.CacheDir)
+
+	names := make(map[string]bool)
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		if stage.Name == "" {
+			return nil, fmt.Errorf("stage %d has no name", i+1)
+		}
+		if !validName.MatchString(stage.Name) {
+			return nil, fmt.Errorf("stage %d has invalid name '%s': must consist of letters, digits, '_' and '-'", i+1, stage.Name)
+		}
+		if names[stage.Name] {
+			return nil, fmt.Errorf("duplicate stage '%s'", stage.Name)
+		}
+		names[stage.Name] = true
+	}
+
+	for i := range p.Stages {
+		stage := &p.Stages[i]
+		switch stage.Mode {
+		case ModeMap, ModeReduce, ModePerRecord, ModeFilter:
+		default:
+			return nil, fmt.Errorf("stage '%s' has invalid mode '%s': must be '%s', '%s', '%s' or '%s'", stage.Name, stage.Mode, ModeMap, ModeReduce, ModePerRecord, ModeFilter)
+		}
+		if stage.Input == "" {
+			return nil, fmt.Errorf("stage '%s' has no input", stage.Name)
+		}
+		if stage.Prompt == "" && !(stage.Mode == ModeReduce && stage.Strategy == "merge") {
+			return nil, fmt.Errorf("stage '%s' has no prompt", stage.Name)
+		}
+		if stage.Strategy != "" && stage.Mode != ModeReduce {
+			return nil, fmt.Errorf("stage '%s': strategy is only valid for reduce stages", stage.Name)
+		}
+		if stage.Endpoint == "" {
+			stage.Endpoint = p.Endpoint
+		}
+		if !names[stage.Input] {
+			stage.Input = resolve(stage.Input)
+		}
+		stage.Prompt = resolve(stage.Prompt)
+		stage.Schema = resolve(stage.Schema)
+		stage.Output = resolve(stage.Output)
+	}
+
+	if _, err := p.Order(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Dependency returns the stage whose output is the input of the given stage,
+// or nil if the input is a file.
+func (p *Pipeline) Dependency(stage *Stage) *Stage {
+	for i := range p.Stages {
+		if p.Stages[i].Name == stage.Input {
+			return &p.Stages[i]
+		}
+	}
+	return nil
+}
+
+// Order returns the stages in dependency order. Stages keep the order of the
+// pipeline file where possible.
+func (p *Pipeline) Order() ([]*Stage, error) {
+	var ordered []*Stage
+	done := make(map[string]bool)
+	for len(ordered) < len(p.Stages) {
+		progress := false
+		for i := range p.Stages {
+			stage := &p.Stages[i]
+			if done[stage.Name] {
+				continue
+			}
+			if dep := p.Dependency(stage); dep != nil && !done[dep.Name] {
+				continue
+			}
+			ordered = append(ordered, stage)
+			done[stage.Name] = true
+			progress = true
+		}
+		if !progress {
+			var cycle []string
+			for _, stage := range p.Stages {
+				if !done[stage.Name] {
+					cycle = append(cycle, stage.Name)
+				}
+			}
+			return nil, fmt.Errorf("stages have a dependency cycle: %s", strings.Join(cycle, ", "))
+		}
+	}
+	return ordered, nil
+}
+
+// Dir returns the cache directory of a stage.
+func (p *Pipeline) Dir(stage *Stage) string {
+	return filepath.Join(p.CacheDir, stage.Name)
+}
+
+// OutputPath returns the path of a stage's output in its cache directory.
+// Per-record and filter stages write JSONL, the others text.
+func (p *Pipeline) OutputPath(stage *Stage) string {
+	name := "output.txt"
+	if stage.Mode == ModePerRecord || stage.Mode == ModeFilter {
+		name = "output.jsonl"
+	}
+	return filepath.Join(p.Dir(stage), name)
+}
+
+// Key returns a cache key for the given parts, e.g. the prompt, the endpoint
+// configuration and the hash of the input.
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s\n", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashFile returns the SHA-256 of a file's content.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read input file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Cached reports whether the stage's output was produced with the given key.
+func (p *Pipeline) Cached(stage *Stage, key string) bool {
+	saved, err := os.ReadFile(filepath.Join(p.Dir(stage), keyFile))
+	if err != nil || string(saved) != key {
+		return false
+	}
+	_, err = os.Stat(p.OutputPath(stage))
+	return err == nil
+}
+
+// Reset empties the cache directory of a stage before it runs.
+func (p *Pipeline) Reset(stage *Stage) error {
+	dir := p.Dir(stage)
+	if err := os.RemoveAll(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to clear cache of stage '%s': %w", stage.Name, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache of stage '%s': %w", stage.Name, err)
+	}
+	return nil
+}
+
+// Start records the key of a stage's run before it starts, so that a run that
+// stops early can be resumed.
+func (p *Pipeline) Start(stage *Stage, key string) error {
+	if err := os.WriteFile(filepath.Join(p.Dir(stage), startFile), []byte(key), 0644); err != nil {
+		return fmt.Errorf("failed to save cache key of stage '%s': %w", stage.Name, err)
+	}
+	return nil
+}
+
+// Started reports whether the stage's last run was started with the given key.
+func (p *Pipeline) Started(stage *Stage, key string) bool {
+	saved, err := os.ReadFile(filepath.Join(p.Dir(stage), startFile))
+	return err == nil && string(saved) == key
+}
+
+// Commit records the key of a stage's finished output.
+func (p *Pipeline) Commit(stage *Stage, key string) error {
+	if err := os.WriteFile(filepath.Join(p.Dir(stage), keyFile), []byte(key), 0644); err != nil {
+		return fmt.Errorf("failed to save cache key of stage '%s': %w", stage.Name, err)
+	}
+	return nil
+}
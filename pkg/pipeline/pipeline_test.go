@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const pipelineYAML = `
+endpoint: local
+stages:
+  - name: summary
+    input: details
+    mode: reduce
+    prompt: prompts/summary.txt
+    output: report.md
+  - name: triage
+    input: tickets.jsonl
+    mode: per-record
+    prompt: prompts/triage.txt
+  - name: details
+    input: triage
+    mode: map
+    endpoint: large
+    prompt: prompts/details.txt
+`
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(pipelineYAML), "/work")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if p.CacheDir != filepath.Join("/work", DefaultCacheDir) {
+		t.Errorf("unexpected cache dir %s", p.CacheDir)
+	}
+
+	order, err := p.Order()
+	if err != nil {
+		t.Fatalf("Order failed: %v", err)
+	}
+	var names []string
+	for _, stage := range order {
+		names = append(names, stage.Name)
+	}
+	if strings.Join(names, ",") != "triage,details,summary" {
+		t.Errorf("unexpected order: %v", names)
+	}
+
+	triage, details := order[0], order[1]
+	if triage.Input != "/work/tickets.jsonl" || triage.Endpoint != "local" || triage.Prompt != "/work/prompts/triage.txt" {
+		t.Errorf("unexpected stage: %+v", triage)
+	}
+	if details.Input != "triage" || details.Endpoint != "large" || p.Dependency(details) != triage {
+		t.Errorf("unexpected stage: %+v", details)
+	}
+	if p.Dependency(triage) != nil {
+		t.Error("expected no dependency for a file input")
+	}
+	if !strings.HasSuffix(p.OutputPath(triage), "output.jsonl") || !strings.HasSuffix(p.OutputPath(details), "output.txt") {
+		t.Error("unexpected output paths")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		"stages: []",
+		"stages:\n  - name: a\n    input: x\n    mode: classify\n    prompt: p",
+		"stages:\n  - name: a\n    input: x\n    mode: map",
+		"stages:\n  - name: a\n    input: x\n    mode: map\n    prompt: p\n    strategy: refine",
+		"stages:\n  - name: a\n    input: b\n    mode: map\n    prompt: p\n  - name: b\n    input: a\n    mode: map\n    prompt: p",
+		"stages:\n  - name: a\n    input: x\n    mode: map\n    prompt: p\n  - name: a\n    input: x\n    mode: map\n    prompt: p",
+		"stages:\n  - name: ..\n    input: x\n    mode: map\n    prompt: p",
+		"stages:\n  - name: .\n    input: x\n    mode: map\n    prompt: p",
+		"stages:\n  - name: ../x\n    input: x\n    mode: map\n    prompt: p",
+	} {
+		if _, err := Parse([]byte(invalid), "."); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	p, err := Parse([]byte(pipelineYAML), t.TempDir())
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	stage := &p.Stages[1]
+	key := Key("prompt", "input-hash")
+	if key == Key("prompt", "other-hash") || key == Key("promptinput-hash") {
+		t.Error("expected distinct keys")
+	}
+
+	if p.Cached(stage, key) {
+		t.Error("expected no cached output")
+	}
+	if err := p.Reset(stage); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if p.Started(stage, key) {
+		t.Error("expected no started run after Reset")
+	}
+	if err := p.Start(stage, key); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if !p.Started(stage, key) || p.Started(stage, Key("changed")) {
+		t.Error("unexpected started run after Start")
+	}
+	os.WriteFile(p.OutputPath(stage), []byte("{}\n"), 0644)
+	if p.Cached(stage, key) {
+		t.Error("expected no cached output before Commit")
+	}
+	if err := p.Commit(stage, key); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if !p.Cached(stage, key) || p.Cached(stage, Key("changed")) {
+		t.Error("unexpected cache state after Commit")
+	}
+}
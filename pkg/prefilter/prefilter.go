@@ -0,0 +1,125 @@
+package prefilter
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+// promptTemplate asks whether a chunk is relevant to the analysis goal.
+const promptTemplate = `You are a filter in front of a detailed analysis. The analysis has this goal:
+
+%s
+
+Decide whether the text below contains anything relevant to this goal. Answer with a single word: yes or no.
+
+--- Data ---
+%s`
+
+// Decision is the prefilter's verdict on one chunk.
+type Decision struct {
+	Index int `json:"index"`
+	// Hash is the hash of the chunk text the decision was made for.
+	Hash     string `json:"hash"`
+	Relevant bool   `json:"relevant"`
+	// Answer is the model's raw answer.
+	Answer string `json:"answer"`
+}
+
+// Filter asks a cheap endpoint whether chunks are relevant to the analysis
+// goal.
+type Filter struct {
+	client *llm.Client
+	goal   string
+
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency int
+}
+
+// NewFilter creates a Filter for the given analysis goal, typically the
+// analysis prompt.
+func NewFilter(client *llm.Client, goal string) *Filter {
+	return &Filter{client: client, goal: goal, Concurrency: 1}
+}
+
+// Run decides on every chunk. Decisions keep the order of the chunks. On
+// error, the decisions made so far are returned with it.
+func (f *Filter) Run(ctx context.Context, chunks []splitter.Chunk) ([]Decision, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	decisions := make([]Decision, len(chunks))
+	decided := make([]bool, len(chunks))
+	sem := make(chan struct{}, max(f.Concurrency, 1))
+	errorChan := make(chan error, len(chunks))
+	var wg sync.WaitGroup
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk splitter.Chunk) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			answer, err := f.client.Analyze(ctx, Prompt(f.goal, chunk))
+			if err != nil {
+				errorChan <- fmt.Errorf("failed to prefilter chunk %d: %w", chunk.Index, err)
+				cancel()
+				return
+			}
+			decisions[i] = Decision{
+				Index:    chunk.Index,
+				Hash:     chunk.Hash,
+				Relevant: Relevant(answer),
+				Answer:   strings.TrimSpace(answer),
+			}
+			decided[i] = true
+		}(i, chunk)
+	}
+
+	wg.Wait()
+	close(errorChan)
+
+	// Return the first error encountered
+	for err := range errorChan {
+		return made(decisions, decided), err
+	}
+	if err := ctx.Err(); err != nil {
+		return made(decisions, decided), err
+	}
+	return decisions, nil
+}
+
+// made returns the decisions that were made.
+func made(decisions []Decision, decided []bool) []Decision {
+	var result []Decision
+	for i, decision := range decisions {
+		if decided[i] {
+			result = append(result, decision)
+		}
+	}
+	return result
+}
+
+// Prompt returns the prompt that asks whether a chunk is relevant to the
+// goal.
+func Prompt(goal string, chunk splitter.Chunk) string {
+	return fmt.Sprintf(promptTemplate, strings.TrimSpace(goal), chunk.Text)
+}
+
+var firstWord = regexp.MustCompile(`[A-Za-z]+`)
+
+// Relevant interprets an answer of the model. Only a clear "no" drops a
+// chunk; unclear answers keep it.
+func Relevant(answer string) bool {
+	word := strings.ToLower(firstWord.FindString(answer))
+	return word != "no"
+}
@@ -0,0 +1,95 @@
+package prefilter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+func TestRelevant(t *testing.T) {
+	for answer, expected := range map[string]bool{
+		"yes":                      true,
+		"No.":                      false,
+		"  **No** - routine noise": false,
+		"Yes, it mentions errors":  true,
+		"Not sure":                 true,
+		"":                         true,
+	} {
+		if Relevant(answer) != expected {
+			t.Errorf("Relevant(%q) = %v, expected %v", answer, !expected, expected)
+		}
+	}
+}
+
+func TestFilterRun(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		prompt := req.Messages[0].Content
+		if !strings.Contains(prompt, "Find failed logins") {
+			t.Errorf("expected the goal in the prompt, got %q", prompt)
+		}
+		answer := "no"
+		if strings.Contains(prompt, "authentication failure") {
+			answer = "Yes."
+		}
+		json.NewEncoder(w).Encode(llm.ChatCompletionResponse{
+			Choices: []llm.Choice{{Message: llm.Message{Role: "assistant", Content: answer}}},
+		})
+	}))
+	defer mockServer.Close()
+
+	f := NewFilter(llm.NewClient(mockServer.URL, "test-key", "test-model"), "Find failed logins.")
+	f.Concurrency = 2
+	chunks := []splitter.Chunk{
+		{Index: 1, Hash: "a", Text: "GET /health 200"},
+		{Index: 2, Hash: "b", Text: "sshd: authentication failure for root"},
+		{Index: 3, Hash: "c", Text: "GET /health 200"},
+	}
+	decisions, err := f.Run(context.Background(), chunks)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if len(decisions) != 3 || decisions[0].Relevant || !decisions[1].Relevant || decisions[2].Relevant {
+		t.Errorf("unexpected decisions: %+v", decisions)
+	}
+	if decisions[1].Index != 2 || decisions[1].Hash != "b" || decisions[1].Answer != "Yes." {
+		t.Errorf("unexpected decision: %+v", decisions[1])
+	}
+}
+
+func TestFilterRunError(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(req.Messages[0].Content, "broken") {
+			// Fail after the other chunk is decided.
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"choices": [{"message": {"content": "yes"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	f := NewFilter(llm.NewClient(mockServer.URL, "test-key", "test-model"), "Find failed logins.")
+	f.Concurrency = 2
+	chunks := []splitter.Chunk{
+		{Index: 1, Hash: "a", Text: "sshd: authentication failure"},
+		{Index: 2, Hash: "b", Text: "broken"},
+	}
+	decisions, err := f.Run(context.Background(), chunks)
+	if err == nil || !strings.Contains(err.Error(), "chunk 2") {
+		t.Errorf("expected an error for chunk 2, got %v", err)
+	}
+	if len(decisions) != 1 || decisions[0].Index != 1 {
+		t.Errorf("expected the decision on chunk 1, got %+v", decisions)
+	}
+}
@@ -0,0 +1,397 @@
+package records
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+const (
+	// DefaultBatchSize is the default maximum number of records per request.
+	DefaultBatchSize = 20
+	// DefaultRetries is the default number of retries for a record the model
+	// skipped or answered with an invalid result.
+	DefaultRetries = 2
+)
+
+// ErrorField is the field of an output record that holds the error of a
+// record without a valid result.
+const ErrorField = "_error"
+
+// instruction explains the expected answer format after the user's prompt.
+const instruction = `Apply the instructions above to each record below separately. Every record has an "id". Respond only with a JSON array that contains exactly one object per record. Each object must have the field "id" with the id of its record, followed by your result fields.`
+
+// Record is one line of a JSONL input.
+type Record struct {
+	// ID is the 1-based line number of the record.
+	ID   int
+	Data json.RawMessage
+}
+
+// Result is the answer of the model for one record.
+type Result struct {
+	Record Record
+	// Fields are the result fields, without "id".
+	Fields map[string]json.RawMessage
+	// Err is set if no valid result was received after all retries.
+	Err error
+}
+
+// Read reads JSONL records. Blank lines are skipped but counted.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if !json.Valid(text) {
+			return nil, fmt.Errorf("invalid JSON in line %d", line)
+		}
+		records = append(records, Record{ID: line, Data: json.RawMessage(append([]byte(nil), text...))})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading input: %w", err)
+	}
+	return records, nil
+}
+
+// Processor analyzes records in batches and asks for one result per record.
+type Processor struct {
+	client   *llm.Client
+	splitter *splitter.Splitter
+	prompt   string
+
+	// BatchSize is the maximum number of records per request.
+	BatchSize int
+	// MaxTokens is the maximum number of record tokens per request.
+	MaxTokens int
+	// Retries is the number of times a record without a valid result is sent
+	// again on its own.
+	Retries int
+	// Concurrency is the maximum number of requests in flight.
+	Concurrency int
+	// Schema, if set, is the JSON Schema every result object must match.
+	Schema *schema.Schema
+	// Progress, if set, is called after every request.
+	Progress func(done, total int)
+}
+
+// NewProcessor creates a Processor. The splitter counts the tokens of the
+// records.
+func NewProcessor(client *llm.Client, s *splitter.Splitter, prompt string, maxTokens int) *Processor {
+	return &Processor{
+		client:      client,
+		splitter:    s,
+		prompt:      prompt,
+		BatchSize:   DefaultBatchSize,
+		MaxTokens:   maxTokens,
+		Retries:     DefaultRetries,
+		Concurrency: 1,
+	}
+}
+
+// Run analyzes all records and returns their results in input order. A
+// record that is too large for MaxTokens is an error; a record without a
+// valid result after all retries has Result.Err set. If a request fails, Run
+// returns the error with the results of the batches that were completed, so
+// that they can be kept.
+func (p *Processor) Run(ctx context.Context, records []Record) ([]Result, error) {
+	batches, err := p.batch(records)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(records))
+	completed := make([]bool, len(records))
+	position := make(map[int]int, len(records))
+	for i, record := range records {
+		position[record.ID] = i
+		results[i].Record = record
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := make(chan struct{}, max(p.Concurrency, 1))
+	errorChan := make(chan error, len(batches))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch []Record) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			fields, failures, err := p.analyze(ctx, batch)
+			if err != nil {
+				errorChan <- err
+				cancel()
+				return
+			}
+			// Retry every failed record on its own.
+			for _, record := range batch {
+				for attempt := 0; failures[record.ID] != nil && attempt < p.Retries; attempt++ {
+					retried, retryFailures, err := p.analyze(ctx, []Record{record})
+					if err != nil {
+						errorChan <- err
+						cancel()
+						return
+					}
+					fields[record.ID] = retried[record.ID]
+					failures[record.ID] = retryFailures[record.ID]
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, record := range batch {
+				result := &results[position[record.ID]]
+				result.Fields = fields[record.ID]
+				result.Err = failures[record.ID]
+				completed[position[record.ID]] = true
+			}
+			done++
+			if p.Progress != nil {
+				p.Progress(done, len(batches))
+			}
+		}(batch)
+	}
+
+	wg.Wait()
+	close(errorChan)
+
+	err = <-errorChan
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		var done []Result
+		for i, result := range results {
+			if completed[i] {
+				done = append(done, result)
+			}
+		}
+		// Return the first error encountered
+		return done, err
+	}
+	return results, nil
+}
+
+// batch groups records into batches of at most BatchSize records and
+// MaxTokens tokens.
+func (p *Processor) batch(records []Record) ([][]Record, error) {
+	batchSize := max(p.BatchSize, 1)
+	var batches [][]Record
+	var current []Record
+	currentTokens := 0
+	for _, record := range records {
+		tokens := len(p.splitter.Encode(formatRecord(record)))
+		if tokens > p.MaxTokens {
+			return nil, fmt.Errorf("record in line %d is too long to fit in a batch: %d tokens", record.ID, tokens)
+		}
+		if len(current) == batchSize || currentTokens+tokens > p.MaxTokens {
+			batches = append(batches, current)
+			current = nil
+			currentTokens = 0
+		}
+		current = append(current, record)
+		currentTokens += tokens
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return batches, nil
+}
+
+// Prompts returns the prompt of every request Run would send first, before
+// any retries.
+func (p *Processor) Prompts(records []Record) ([]string, error) {
+	batches, err := p.batch(records)
+	if err != nil {
+		return nil, err
+	}
+	prompts := make([]string, len(batches))
+	for i, batch := range batches {
+		prompts[i] = buildPrompt(p.prompt, batch)
+	}
+	return prompts, nil
+}
+
+// analyze sends one batch and returns the valid result fields and the
+// failure of every other record. Only request errors are returned as error.
+func (p *Processor) analyze(ctx context.Context, batch []Record) (map[int]map[string]json.RawMessage, map[int]error, error) {
+	response, err := p.client.Analyze(ctx, buildPrompt(p.prompt, batch))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to analyze records in lines %d-%d: %w", batch[0].ID, batch[len(batch)-1].ID, err)
+	}
+	fields, failures := parseResponse(response, batch, p.Schema)
+	return fields, failures, nil
+}
+
+func formatRecord(record Record) string {
+	return fmt.Sprintf(`{"id": %d, "record": %s}`, record.ID, record.Data)
+}
+
+// buildPrompt formats a batch of records for the model.
+func buildPrompt(prompt string, batch []Record) string {
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\n")
+	b.WriteString(instruction)
+	b.WriteString("\n\n--- Records ---\n")
+	for _, record := range batch {
+		b.WriteString(formatRecord(record))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// parseResponse matches the result objects of a response to the records of
+// the batch by id.
+func parseResponse(response string, batch []Record, sch *schema.Schema) (map[int]map[string]json.RawMessage, map[int]error) {
+	fields := make(map[int]map[string]json.RawMessage)
+	failures := make(map[int]error)
+	fail := func(err error) (map[int]map[string]json.RawMessage, map[int]error) {
+		for _, record := range batch {
+			failures[record.ID] = err
+		}
+		return fields, failures
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(schema.ExtractJSON(response)), &items); err != nil {
+		return fail(fmt.Errorf("response is not a JSON array: %w", err))
+	}
+
+	wanted := make(map[int]bool, len(batch))
+	for _, record := range batch {
+		wanted[record.ID] = true
+	}
+	for _, item := range items {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(item, &object); err != nil {
+			continue
+		}
+		var id int
+		if err := json.Unmarshal(object["id"], &id); err != nil || !wanted[id] {
+			continue
+		}
+		delete(object, "id")
+		if sch != nil {
+			encoded, _ := json.Marshal(object)
+			if _, err := sch.Validate(string(encoded)); err != nil {
+				failures[id] = err
+				continue
+			}
+		}
+		fields[id] = object
+		delete(failures, id)
+	}
+
+	for _, record := range batch {
+		if fields[record.ID] == nil && failures[record.ID] == nil {
+			failures[record.ID] = fmt.Errorf("no result for record %d", record.ID)
+		}
+	}
+	return fields, failures
+}
+
+// Join returns the original record with the result fields added as one JSON
+// line. Result fields replace record fields of the same name. A record that
+// is not an object is kept in the field "record". For a failed result, the
+// error is written to ErrorField.
+func Join(result Result) ([]byte, error) {
+	object := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(result.Record.Data, &object); err != nil {
+		object = map[string]json.RawMessage{"record": result.Record.Data}
+	}
+	for name, value := range result.Fields {
+		object[name] = value
+	}
+	if result.Err != nil {
+		message, _ := json.Marshal(result.Err.Error())
+		object[ErrorField] = message
+	}
+
+	// Keep the original field order and add the result fields after it.
+	var b bytes.Buffer
+	b.WriteString("{")
+	written := make(map[string]bool)
+	write := func(name string) {
+		if written[name] {
+			return
+		}
+		if len(written) > 0 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(name)
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(object[name])
+		written[name] = true
+	}
+	for _, name := range fieldOrder(result.Record.Data) {
+		if _, ok := object[name]; ok {
+			write(name)
+		}
+	}
+	var names []string
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		write(name)
+	}
+	b.WriteString("}")
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, b.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to encode record %d: %w", result.Record.ID, err)
+	}
+	return compact.Bytes(), nil
+}
+
+// fieldOrder returns the top-level field names of a JSON object in document
+// order.
+func fieldOrder(data json.RawMessage) []string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+	var names []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return names
+		}
+		name, _ := token.(string)
+		names = append(names, name)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return names
+		}
+	}
+	return names
+}
@@ -0,0 +1,152 @@
+package records
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+func TestRead(t *testing.T) {
+	records, err := Read(strings.NewReader("{\"a\": 1}\n\n{\"a\": 2}\n"))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(records) != 2 || records[0].ID != 1 || records[1].ID != 3 {
+		t.Errorf("unexpected records: %+v", records)
+	}
+	if _, err := Read(strings.NewReader("{\"a\": 1}\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error for line 2, got %v", err)
+	}
+}
+
+func TestProcessorRun(t *testing.T) {
+	idPattern := regexp.MustCompile(`\{"id": (\d+), "record"`)
+	var mu sync.Mutex
+	var requests [][]string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var ids []string
+		for _, m := range idPattern.FindAllStringSubmatch(req.Messages[0].Content, -1) {
+			ids = append(ids, m[1])
+		}
+		mu.Lock()
+		requests = append(requests, ids)
+		mu.Unlock()
+
+		// Skip record 2 in batches and mangle record 4 always.
+		var items []string
+		for _, id := range ids {
+			switch {
+			case id == "2" && len(ids) > 1:
+			case id == "4":
+				items = append(items, `{"id": 4, "label": 7}`)
+			default:
+				items = append(items, fmt.Sprintf(`{"id": %s, "label": "label-%s"}`, id, id))
+			}
+		}
+		content, _ := json.Marshal("```json\n[" + strings.Join(items, ",") + "]\n```")
+		fmt.Fprintf(w, `{"choices": [{"message": {"content": %s}}]}`, content)
+	}))
+	defer mockServer.Close()
+
+	s, err := splitter.NewSplitter(1000)
+	if err != nil {
+		t.Fatalf("failed to create splitter: %v", err)
+	}
+	sch, err := schema.Parse("label", []byte(`{"type": "object", "properties": {"label": {"type": "string"}}, "required": ["label"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse schema: %v", err)
+	}
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	p := NewProcessor(client, s, "Classify the ticket.", 1000)
+	p.BatchSize = 3
+	p.Retries = 1
+	p.Concurrency = 2
+	p.Schema = sch
+
+	records, _ := Read(strings.NewReader(`{"ticket": "a"}
+{"ticket": "b"}
+{"ticket": "c"}
+{"ticket": "d"}
+"e"
+`))
+	results, err := p.Run(context.Background(), records)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	var lines []string
+	for _, result := range results {
+		line, err := Join(result)
+		if err != nil {
+			t.Fatalf("Join failed: %v", err)
+		}
+		lines = append(lines, string(line))
+	}
+	expected := []string{
+		`{"ticket":"a","label":"label-1"}`,
+		`{"ticket":"b","label":"label-2"}`,
+		`{"ticket":"c","label":"label-3"}`,
+		`{"ticket":"d","_error":`,
+		`{"label":"label-5","record":"e"}`,
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) {
+			t.Errorf("line %d: expected %s, got %s", i+1, expected[i], line)
+		}
+	}
+
+	// 2 batches, one retry for record 2 and one for record 4.
+	if len(requests) != 4 {
+		t.Errorf("expected 4 requests, got %d: %v", len(requests), requests)
+	}
+}
+
+func TestProcessorRunError(t *testing.T) {
+	idPattern := regexp.MustCompile(`\{"id": (\d+), "record"`)
+	requests := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail every request after the first.
+		requests++
+		if requests > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var items []string
+		for _, m := range idPattern.FindAllStringSubmatch(req.Messages[0].Content, -1) {
+			items = append(items, fmt.Sprintf(`{"id": %s, "label": "label-%s"}`, m[1], m[1]))
+		}
+		content, _ := json.Marshal("[" + strings.Join(items, ",") + "]")
+		fmt.Fprintf(w, `{"choices": [{"message": {"content": %s}}]}`, content)
+	}))
+	defer mockServer.Close()
+
+	s, err := splitter.NewSplitter(1000)
+	if err != nil {
+		t.Fatalf("failed to create splitter: %v", err)
+	}
+	p := NewProcessor(llm.NewClient(mockServer.URL, "test-key", "test-model"), s, "Classify the ticket.", 1000)
+	p.BatchSize = 2
+
+	records, _ := Read(strings.NewReader("{\"ticket\": \"a\"}\n{\"ticket\": \"b\"}\n{\"ticket\": \"c\"}\n{\"ticket\": \"d\"}\n"))
+	results, err := p.Run(context.Background(), records)
+	if err == nil {
+		t.Fatal("expected the failed request to fail the run")
+	}
+	if len(results) != 2 || results[0].Err != nil || results[1].Err != nil || results[1].Record.ID != results[0].Record.ID+1 {
+		t.Errorf("expected the results of the completed batch, got %+v", results)
+	}
+}
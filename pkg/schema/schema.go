@@ -0,0 +1,168 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"llm-data-analyzer/pkg/llm"
+)
+
+// DefaultRetries is the default number of repair attempts for a response
+// that fails validation.
+const DefaultRetries = 2
+
+// Schema is a compiled JSON Schema for LLM responses.
+type Schema struct {
+	// Name identifies the schema in response_format requests.
+	Name string
+	raw  json.RawMessage
+	sch  *jsonschema.Schema
+}
+
+// Load reads and compiles a JSON Schema file.
+func Load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %w", err)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return Parse(name, data)
+}
+
+// Parse compiles a JSON Schema document.
+func Parse(name string, data []byte) (*Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON in schema %s: %w", name, err)
+	}
+	compiler := jsonschema.NewCompiler()
+	url := "mem://" + name + ".json"
+	if err := compiler.AddResource(url, doc); err != nil {
+		return nil, fmt.Errorf("failed to add schema %s: %w", name, err)
+	}
+	sch, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile schema %s: %w", name, err)
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return nil, fmt.Errorf("invalid JSON in schema %s: %w", name, err)
+	}
+	return &Schema{Name: sanitizeName(name), raw: compact.Bytes(), sch: sch}, nil
+}
+
+// Raw returns the schema document.
+func (s *Schema) Raw() json.RawMessage {
+	return s.raw
+}
+
+// ResponseFormat returns the response_format that asks the model to follow
+// the schema.
+func (s *Schema) ResponseFormat() *llm.ResponseFormat {
+	return &llm.ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &llm.JSONSchema{
+			Name:   s.Name,
+			Schema: s.raw,
+		},
+	}
+}
+
+// Instruction tells the model to answer with JSON matching the schema. It is
+// added to the prompt for endpoints without native json_schema support.
+func (s *Schema) Instruction() string {
+	return "Respond only with a JSON document, without any other text, that matches this JSON Schema:\n" + string(s.raw)
+}
+
+// Validate extracts the JSON document from a response and validates it
+// against the schema. It returns the document, indented.
+func (s *Schema) Validate(response string) (string, error) {
+	text := ExtractJSON(response)
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(text))
+	if err != nil {
+		return "", fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	if err := s.sch.Validate(doc); err != nil {
+		return "", fmt.Errorf("response does not match the schema: %w", err)
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, []byte(text), "", "  "); err != nil {
+		return "", fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	return indented.String(), nil
+}
+
+// Analyze sends a prompt and returns a response that is valid under the
+// schema. Endpoints that support it get the schema as response_format; for
+// others it is described in the prompt. A response that fails validation is
+// sent back with the validation error up to retries times.
+func Analyze(ctx context.Context, client *llm.Client, prompt string, s *Schema, retries int) (string, error) {
+	var format *llm.ResponseFormat
+	if client.SupportsJSONSchema {
+		format = s.ResponseFormat()
+	} else {
+		prompt = prompt + "\n\n" + s.Instruction()
+	}
+
+	messages := []llm.Message{{Role: "user", Content: prompt}}
+	for attempt := 0; ; attempt++ {
+		response, err := client.Chat(ctx, messages, format)
+		if err != nil {
+			return "", err
+		}
+		result, err := s.Validate(response)
+		if err == nil {
+			return result, nil
+		}
+		if attempt >= retries {
+			return "", fmt.Errorf("invalid structured response after %d attempts: %w", attempt+1, err)
+		}
+		messages = append(messages,
+			llm.Message{Role: "assistant", Content: response},
+			llm.Message{Role: "user", Content: fmt.Sprintf("Your response failed validation:\n%v\n\nReturn the corrected JSON document only.", err)},
+		)
+	}
+}
+
+var fence = regexp.MustCompile("(?s)^```[a-zA-Z]*\\s*\n(.*?)\n?```$")
+
+// ExtractJSON strips markdown code fences and text around the JSON document
+// of a response.
+func ExtractJSON(response string) string {
+	text := strings.TrimSpace(response)
+	if m := fence.FindStringSubmatch(text); m != nil {
+		text = strings.TrimSpace(m[1])
+	}
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+		return text
+	}
+	start := strings.IndexAny(text, "{[")
+	end := strings.LastIndexAny(text, "}]")
+	if start >= 0 && end > start {
+		return text[start : end+1]
+	}
+	return text
+}
+
+var invalidName = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// sanitizeName makes a schema name acceptable as a response_format name.
+func sanitizeName(name string) string {
+	name = invalidName.ReplaceAllString(name, "_")
+	if name == "" {
+		return "response"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/llm"
+)
+
+const findingsSchema = `{
+  "type": "object",
+  "properties": {
+    "findings": {"type": "array", "items": {"type": "string"}},
+    "errors": {"type": "integer"}
+  },
+  "required": ["findings", "errors"]
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Parse("findings", []byte(findingsSchema))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	result, err := s.Validate("Here you go:\n```json\n{\"findings\": [\"disk full\"], \"errors\": 3}\n```")
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := "{\n  \"findings\": [\n    \"disk full\"\n  ],\n  \"errors\": 3\n}"
+	if result != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+
+	if _, err := s.Validate(`{"findings": "disk full"}`); err == nil {
+		t.Error("Expected a validation error")
+	}
+	if _, err := s.Validate("no JSON here"); err == nil {
+		t.Error("Expected a JSON error")
+	}
+}
+
+func TestAnalyzeRepair(t *testing.T) {
+	var requests []llm.ChatCompletionRequest
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		requests = append(requests, req)
+
+		content := `{"findings": ["disk full"]}`
+		if len(requests) > 1 {
+			content = `{"findings": ["disk full"], "errors": 1}`
+		}
+		json.NewEncoder(w).Encode(llm.ChatCompletionResponse{
+			Choices: []llm.Choice{{Message: llm.Message{Role: "assistant", Content: content}}},
+		})
+	}))
+	defer mockServer.Close()
+
+	s, err := Parse("findings", []byte(findingsSchema))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	client.SupportsJSONSchema = true
+
+	result, err := Analyze(context.Background(), client, "Analyze this:", s, 1)
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if !strings.Contains(result, `"errors": 1`) {
+		t.Errorf("Unexpected result: %s", result)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	if requests[0].ResponseFormat == nil || requests[0].ResponseFormat.Type != "json_schema" || requests[0].ResponseFormat.JSONSchema.Name != "findings" {
+		t.Errorf("Expected a json_schema response format, got %+v", requests[0].ResponseFormat)
+	}
+	repair := requests[1].Messages
+	if len(repair) != 3 || repair[1].Role != "assistant" || !strings.Contains(repair[2].Content, "failed validation") {
+		t.Errorf("Unexpected repair conversation: %+v", repair)
+	}
+
+	// Without retries, the invalid first response is an error.
+	requests = nil
+	if _, err := Analyze(context.Background(), client, "Analyze this:", s, 0); err == nil {
+		t.Error("Expected an error without retries")
+	}
+}
@@ -0,0 +1,213 @@
+package splitter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Chunk is a piece of the input text together with its metadata.
+type Chunk struct {
+	// Index is the 1-based position of the chunk in the input.
+	Index int `json:"index"`
+	// Source is the path of the input file the chunk was read from.
+	Source string `json:"source,omitempty"`
+	// StartByte and EndByte delimit the chunk in the input, EndByte exclusive.
+	// For documents they refer to the extracted text.
+	StartByte int `json:"start_byte"`
+	EndByte   int `json:"end_byte"`
+	// StartLine and EndLine are the 1-based, inclusive line range of the chunk.
+	StartLine int `json:"start_line"`
+	EndLine   int `json:"end_line"`
+	// Tokens is the number of tokens in Text.
+	Tokens int `json:"tokens"`
+	// Hash is the hex-encoded SHA-256 of Text.
+	Hash string `json:"hash"`
+	// Section is the heading breadcrumb of the section the chunk starts in,
+	// e.g. "# Ops > ## Incidents".
+	Section string `json:"section,omitempty"`
+	// StartPage and EndPage are the page range of the chunk for paginated
+	// documents, or zero.
+	StartPage int `json:"start_page,omitempty"`
+	EndPage   int `json:"end_page,omitempty"`
+	// Extracted is set if the chunk was cut from the text extracted from a
+	// document, so that its offsets and lines do not match the source file.
+	Extracted bool `json:"extracted,omitempty"`
+
+	Text string `json:"-"`
+}
+
+// Location describes where the chunk comes from, e.g.
+// "lines 12,340–12,910 of app.log". A chunk extracted from a document is
+// located by its pages and section, and by lines of the extracted text only
+// if it has neither.
+func (c Chunk) Location() string {
+	var parts []string
+	if c.StartPage > 0 {
+		parts = append(parts, describeRange("page", c.StartPage, c.EndPage))
+	}
+	switch {
+	case !c.Extracted:
+		parts = append(parts, describeRange("line", c.StartLine, c.EndLine))
+	case c.Section != "":
+		parts = append(parts, fmt.Sprintf("section %q", c.Section))
+	case c.StartPage == 0:
+		parts = append(parts, describeRange("line", c.StartLine, c.EndLine)+" of the extracted text")
+	}
+	location := strings.Join(parts, ", ")
+	if c.Source != "" {
+		location += " of " + c.Source
+	}
+	return location
+}
+
+func describeRange(unit string, start, end int) string {
+	if end <= start {
+		return fmt.Sprintf("%s %s", unit, formatNumber(start))
+	}
+	return fmt.Sprintf("%ss %s–%s", unit, formatNumber(start), formatNumber(end))
+}
+
+// formatNumber formats n with thousands separators.
+func formatNumber(n int) string {
+	if n < 0 {
+		return "-" + formatNumber(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// WriteManifest writes the metadata of the chunks as JSONL, one chunk per line.
+func WriteManifest(w io.Writer, chunks []Chunk) error {
+	encoder := json.NewEncoder(w)
+	for _, chunk := range chunks {
+		if err := encoder.Encode(chunk); err != nil {
+			return fmt.Errorf("failed to encode metadata of chunk %d: %w", chunk.Index, err)
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads chunk metadata written by WriteManifest. The Text of the
+// returned chunks is empty.
+func ReadManifest(r io.Reader) ([]Chunk, error) {
+	var chunks []Chunk
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var chunk Chunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			return nil, fmt.Errorf("invalid chunk metadata: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chunk metadata: %w", err)
+	}
+	return chunks, nil
+}
+
+// pageMarker matches the page markers written by the extractor package.
+var pageMarker = regexp.MustCompile(`(?m)^\[Page (\d+)\]$`)
+
+// annotator fills in the positional metadata of chunks cut from one text.
+// Chunks must be annotated in order of their offsets.
+type annotator struct {
+	content   string
+	extracted bool
+	pos       int
+	line      int
+	pages     []marker
+	sections  []marker
+}
+
+// marker is a page number or section breadcrumb that is in effect from the
+// given offset on.
+type marker struct {
+	offset int
+	page   int
+	title  string
+}
+
+func newAnnotator(content string, documentMarkers bool) *annotator {
+	a := &annotator{content: content, line: 1, extracted: documentMarkers}
+	if !documentMarkers {
+		return a
+	}
+	for _, m := range pageMarker.FindAllStringSubmatchIndex(content, -1) {
+		page, _ := strconv.Atoi(content[m[2]:m[3]])
+		a.pages = append(a.pages, marker{offset: m[0], page: page})
+	}
+	for _, section := range parseMarkdownSections(content) {
+		a.sections = append(a.sections, marker{offset: section.offset, title: section.breadcrumb})
+	}
+	return a
+}
+
+// lineAt returns the 1-based line number of the byte at offset.
+func (a *annotator) lineAt(offset int) int {
+	if offset < a.pos {
+		a.pos, a.line = 0, 1
+	}
+	a.line += strings.Count(a.content[a.pos:offset], "\n")
+	a.pos = offset
+	return a.line
+}
+
+// annotate sets the index, offsets, line and page ranges, token count and
+// hash of a chunk covering content[start:end].
+func (a *annotator) annotate(chunk *Chunk, index, start, end, tokens int) {
+	chunk.Index = index
+	chunk.StartByte = start
+	chunk.EndByte = end
+	chunk.StartLine = a.lineAt(start)
+	last := end - 1
+	if last < start {
+		last = start
+	}
+	chunk.EndLine = a.lineAt(last)
+	chunk.Tokens = tokens
+	chunk.Hash = hashText(chunk.Text)
+	chunk.Extracted = a.extracted
+
+	if len(a.pages) > 0 {
+		chunk.StartPage = a.markerAt(a.pages, start, true).page
+		chunk.EndPage = a.markerAt(a.pages, last, false).page
+	}
+	if chunk.Section == "" && len(a.sections) > 0 {
+		chunk.Section = a.markerAt(a.sections, start, true).title
+	}
+}
+
+// markerAt returns the marker in effect at offset. With lookahead, a marker
+// that follows the offset after nothing but whitespace is already in effect,
+// so that a chunk starting with the blank line in front of "[Page 2]" belongs
+// to page 2.
+func (a *annotator) markerAt(markers []marker, offset int, lookahead bool) marker {
+	i := sort.Search(len(markers), func(i int) bool { return markers[i].offset > offset })
+	if lookahead && i < len(markers) && strings.TrimSpace(a.content[offset:markers[i].offset]) == "" {
+		return markers[i]
+	}
+	if i == 0 {
+		return marker{}
+	}
+	return markers[i-1]
+}
+
+func hashText(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
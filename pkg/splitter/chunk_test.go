@@ -0,0 +1,156 @@
+package splitter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSplitMetadata(t *testing.T) {
+	text := strings.Repeat("line one of the log\nline two of the log\n", 10)
+
+	s, err := NewSplitter(15)
+	if err != nil {
+		t.Fatalf("Failed to create splitter: %v", err)
+	}
+	chunks, err := s.Split(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	end := 0
+	for i, chunk := range chunks {
+		if chunk.Index != i+1 {
+			t.Errorf("Chunk %d has index %d", i, chunk.Index)
+		}
+		if chunk.StartByte != end {
+			t.Errorf("Chunk %d starts at %d, expected %d", chunk.Index, chunk.StartByte, end)
+		}
+		if text[chunk.StartByte:chunk.EndByte] != chunk.Text {
+			t.Errorf("Chunk %d offsets do not match its text", chunk.Index)
+		}
+		startLine := strings.Count(text[:chunk.StartByte], "\n") + 1
+		endLine := strings.Count(text[:chunk.EndByte-1], "\n") + 1
+		if chunk.StartLine != startLine || chunk.EndLine != endLine {
+			t.Errorf("Chunk %d has lines %d-%d, expected %d-%d", chunk.Index, chunk.StartLine, chunk.EndLine, startLine, endLine)
+		}
+		if chunk.Tokens == 0 || chunk.Tokens > 15 {
+			t.Errorf("Chunk %d has token count %d", chunk.Index, chunk.Tokens)
+		}
+		if chunk.Hash != hashText(chunk.Text) || len(chunk.Hash) != 64 {
+			t.Errorf("Chunk %d has unexpected hash %s", chunk.Index, chunk.Hash)
+		}
+		end = chunk.EndByte
+	}
+	if end != len(text) {
+		t.Errorf("Chunks end at %d, expected %d", end, len(text))
+	}
+}
+
+func TestSplitJSONLMetadata(t *testing.T) {
+	content := "{\"a\": 1}\r\n{\"b\": 2}\n{\"c\": 3}"
+
+	s, err := NewSplitter(8)
+	if err != nil {
+		t.Fatalf("Failed to create splitter: %v", err)
+	}
+	chunks, err := s.SplitJSONL(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("SplitJSONL failed: %v", err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected at least 2 chunks, got %d", len(chunks))
+	}
+
+	first, last := chunks[0], chunks[len(chunks)-1]
+	if first.StartByte != 0 || first.StartLine != 1 {
+		t.Errorf("Unexpected start of first chunk: %+v", first)
+	}
+	if last.EndByte != len(content) || last.EndLine != 3 {
+		t.Errorf("Unexpected end of last chunk: %+v", last)
+	}
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].StartByte != chunks[i-1].EndByte || chunks[i].StartLine != chunks[i-1].EndLine+1 {
+			t.Errorf("Chunk %d does not continue chunk %d: %+v %+v", i+1, i, chunks[i-1], chunks[i])
+		}
+	}
+}
+
+func TestSplitDocumentMarkers(t *testing.T) {
+	text := "[Page 1]\n\n# Report\n\nIntro text.\n\n[Page 2]\n\n## Findings\n\nMore text here.\n"
+
+	s, err := NewSplitter(1000)
+	if err != nil {
+		t.Fatalf("Failed to create splitter: %v", err)
+	}
+	s.DocumentMarkers = true
+
+	chunks, err := s.Split(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("Expected 1 chunk, got %d", len(chunks))
+	}
+	if chunks[0].StartPage != 1 || chunks[0].EndPage != 2 {
+		t.Errorf("Expected pages 1-2, got %d-%d", chunks[0].StartPage, chunks[0].EndPage)
+	}
+
+	// The second half starts right before the "[Page 2]" marker.
+	second := strings.Index(text, "\n[Page 2]")
+	a := newAnnotator(text, true)
+	chunk := Chunk{Text: text[second:]}
+	a.annotate(&chunk, 2, second, len(text), 0)
+	if chunk.StartPage != 2 || chunk.Section != "# Report" {
+		t.Errorf("Expected page 2 in '# Report', got page %d in '%s'", chunk.StartPage, chunk.Section)
+	}
+}
+
+func TestChunkLocation(t *testing.T) {
+	chunk := Chunk{Source: "app.log", StartLine: 12340, EndLine: 12910}
+	if got := chunk.Location(); got != "lines 12,340–12,910 of app.log" {
+		t.Errorf("Unexpected location: %s", got)
+	}
+
+	chunk = Chunk{Source: "report.pdf", StartLine: 3, EndLine: 3, StartPage: 2, EndPage: 2}
+	if got := chunk.Location(); got != "page 2, line 3 of report.pdf" {
+		t.Errorf("Unexpected location: %s", got)
+	}
+
+	// Lines of extracted text do not match the source file.
+	chunk = Chunk{Source: "report.pdf", StartLine: 3, EndLine: 40, StartPage: 2, EndPage: 3, Extracted: true}
+	if got := chunk.Location(); got != "pages 2–3 of report.pdf" {
+		t.Errorf("Unexpected location: %s", got)
+	}
+	chunk = Chunk{Source: "guide.html", StartLine: 3, EndLine: 40, Section: "# Setup", Extracted: true}
+	if got := chunk.Location(); got != `section "# Setup" of guide.html` {
+		t.Errorf("Unexpected location: %s", got)
+	}
+	chunk = Chunk{Source: "guide.html", StartLine: 3, EndLine: 40, Extracted: true}
+	if got := chunk.Location(); got != "lines 3–40 of the extracted text of guide.html" {
+		t.Errorf("Unexpected location: %s", got)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	chunks := []Chunk{
+		{Index: 1, Source: "app.log", StartByte: 0, EndByte: 10, StartLine: 1, EndLine: 2, Tokens: 3, Hash: "abc", Text: "ignored"},
+		{Index: 2, Source: "app.log", StartByte: 10, EndByte: 20, StartLine: 3, EndLine: 4, Tokens: 3, Hash: "def", Section: "# A"},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteManifest(&buf, chunks); err != nil {
+		t.Fatalf("WriteManifest failed: %v", err)
+	}
+	read, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatalf("ReadManifest failed: %v", err)
+	}
+	if len(read) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(read))
+	}
+	chunks[0].Text = ""
+	if read[0] != chunks[0] || read[1] != chunks[1] {
+		t.Errorf("Manifest round trip mismatch: %+v", read)
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 
+	"llm-data-analyzer/pkg/tokens"
+
 	"github.com/pkoukk/tiktoken-go"
 )
 
@@ -14,11 +17,15 @@ import (
 type Splitter struct {
 	chunkSize int
 	tkm       *tiktoken.Tiktoken
+
+	// DocumentMarkers enables reading the page markers and markdown headings
+	// written by the extractor package into the metadata of every chunk.
+	DocumentMarkers bool
 }
 
 // NewSplitter creates a new Splitter.
 func NewSplitter(chunkSize int) (*Splitter, error) {
-	tkm, err := tiktoken.GetEncoding("cl100k_base")
+	tkm, err := tokens.Encoding()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tiktoken encoding: %w", err)
 	}
@@ -33,37 +40,75 @@ func (s *Splitter) Encode(text string) []int {
 	return s.tkm.Encode(text, nil, nil)
 }
 
-// Split reads from an io.Reader and returns a slice of strings, where each string
-// is a chunk of text with at most s.chunkSize tokens.
-func (s *Splitter) Split(reader io.Reader) ([]string, error) {
+// Decode returns the text for the given token IDs.
+func (s *Splitter) Decode(tokens []int) string {
+	return s.tkm.Decode(tokens)
+}
+
+// Split reads from an io.Reader and returns chunks of text with at most
+// s.chunkSize tokens each.
+func (s *Splitter) Split(reader io.Reader) ([]Chunk, error) {
 	content, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read content: %w", err)
 	}
 
-	tokens := s.Encode(string(content))
+	text := string(content)
+	tokens := s.Encode(text)
+	a := newAnnotator(text, s.DocumentMarkers)
 
-	var chunks []string
+	var chunks []Chunk
+	offset := 0
 	for i := 0; i < len(tokens); i += s.chunkSize {
 		end := i + s.chunkSize
 		if end > len(tokens) {
 			end = len(tokens)
 		}
-		chunks = append(chunks, s.tkm.Decode(tokens[i:end]))
+		chunk := Chunk{Text: s.tkm.Decode(tokens[i:end])}
+		a.annotate(&chunk, len(chunks)+1, offset, offset+len(chunk.Text), end-i)
+		offset += len(chunk.Text)
+		chunks = append(chunks, chunk)
 	}
 
 	return chunks, nil
 }
 
 // SplitJSONL reads a JSONL file from an io.Reader and groups lines into chunks.
-func (s *Splitter) SplitJSONL(reader io.Reader) ([]string, error) {
-	var chunks []string
+func (s *Splitter) SplitJSONL(reader io.Reader) ([]Chunk, error) {
+	var chunks []Chunk
 	var currentChunk strings.Builder
 	var currentTokenCount int
+	var startByte, startLine, endLine int
+	var offset, lineNumber, lineBytes int
+
+	flush := func() {
+		chunks = append(chunks, Chunk{
+			Index:     len(chunks) + 1,
+			StartByte: startByte,
+			EndByte:   offset,
+			StartLine: startLine,
+			EndLine:   endLine,
+			Tokens:    currentTokenCount,
+			Hash:      hashText(currentChunk.String()),
+			Text:      currentChunk.String(),
+		})
+		currentChunk.Reset()
+		currentTokenCount = 0
+	}
 
 	scanner := bufio.NewScanner(reader)
+	// Record the raw length of each line, including its line ending, to
+	// compute byte offsets.
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineBytes = advance
+		}
+		return advance, token, err
+	})
 	for scanner.Scan() {
 		line := scanner.Text()
+		lineNumber++
 
 		// Validate JSONL line
 		var js json.RawMessage
@@ -80,17 +125,17 @@ func (s *Splitter) SplitJSONL(reader io.Reader) ([]string, error) {
 
 		if currentTokenCount+lineTokenCount > s.chunkSize {
 			// Finalize the current chunk
-			chunks = append(chunks, currentChunk.String())
-			// Start a new chunk
-			currentChunk.Reset()
-			currentChunk.WriteString(line)
-			currentChunk.WriteString("\n")
-			currentTokenCount = lineTokenCount
-		} else {
-			currentChunk.WriteString(line)
-			currentChunk.WriteString("\n")
-			currentTokenCount += lineTokenCount
+			flush()
 		}
+		if currentChunk.Len() == 0 {
+			startByte = offset
+			startLine = lineNumber
+		}
+		currentChunk.WriteString(line)
+		currentChunk.WriteString("\n")
+		currentTokenCount += lineTokenCount
+		offset += lineBytes
+		endLine = lineNumber
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -99,8 +144,162 @@ func (s *Splitter) SplitJSONL(reader io.Reader) ([]string, error) {
 
 	// Add the last chunk if it's not empty
 	if currentChunk.Len() > 0 {
-		chunks = append(chunks, currentChunk.String())
+		flush()
+	}
+
+	return chunks, nil
+}
+
+// markdownHeading matches ATX headings such as "## Incidents".
+var markdownHeading = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+
+// mdSection is a heading together with the text that follows it, up to the
+// next heading.
+type mdSection struct {
+	breadcrumb string
+	text       string
+	offset     int
+}
+
+// SplitMarkdown splits a markdown document at its headings and packs whole
+// sections into chunks of at most s.chunkSize tokens. Each chunk is prefixed
+// with the heading breadcrumb of its first section. Sections that are too
+// large for a single chunk are split by tokens, and every piece gets the
+// section's breadcrumb. Byte offsets and line ranges of the chunks refer to
+// the document without the breadcrumb prefixes.
+func (s *Splitter) SplitMarkdown(reader io.Reader) ([]Chunk, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content: %w", err)
+	}
+
+	text := string(content)
+	a := newAnnotator(text, s.DocumentMarkers)
+
+	var chunks []Chunk
+	var current strings.Builder
+	var currentSection string
+	var currentTokenCount int
+	var startByte, endByte int
+	empty := true
+
+	flush := func() {
+		if !empty {
+			chunk := Chunk{Text: current.String(), Section: currentSection}
+			a.annotate(&chunk, len(chunks)+1, startByte, endByte, currentTokenCount)
+			chunks = append(chunks, chunk)
+		}
+		current.Reset()
+		currentTokenCount = 0
+		empty = true
+	}
+	write := func(piece string, offset, tokens int) {
+		if empty {
+			startByte = offset
+			empty = false
+		}
+		current.WriteString(piece)
+		currentTokenCount += tokens
+		endByte = offset + len(piece)
+	}
+	start := func(breadcrumb string) {
+		currentSection = breadcrumb
+		if breadcrumb == "" {
+			return
+		}
+		prefix := breadcrumb + "\n\n"
+		prefixTokens := len(s.Encode(prefix))
+		// Leave the breadcrumb out if it would not leave room for any text.
+		if prefixTokens >= s.chunkSize {
+			return
+		}
+		current.WriteString(prefix)
+		currentTokenCount = prefixTokens
 	}
 
+	for _, section := range parseMarkdownSections(text) {
+		tokens := s.Encode(section.text)
+
+		if !empty && currentTokenCount+len(tokens) > s.chunkSize {
+			flush()
+		}
+		if current.Len() == 0 {
+			start(section.breadcrumb)
+		}
+		if currentTokenCount+len(tokens) <= s.chunkSize {
+			write(section.text, section.offset, len(tokens))
+			continue
+		}
+
+		// The section does not fit into an empty chunk: split it by tokens.
+		room := s.chunkSize - currentTokenCount
+		offset := section.offset
+		for i := 0; i < len(tokens); i += room {
+			end := i + room
+			if end > len(tokens) {
+				end = len(tokens)
+			}
+			if current.Len() == 0 {
+				start(section.breadcrumb)
+			}
+			piece := s.tkm.Decode(tokens[i:end])
+			write(piece, offset, end-i)
+			offset += len(piece)
+			flush()
+		}
+	}
+	flush()
+
 	return chunks, nil
 }
+
+// parseMarkdownSections splits markdown text at ATX headings outside of code
+// fences and computes the breadcrumb of every section.
+func parseMarkdownSections(content string) []mdSection {
+	var sections []mdSection
+	var headings [6]string
+	var current strings.Builder
+	breadcrumb := ""
+	inFence := false
+	offset, sectionStart := 0, 0
+
+	for _, line := range strings.SplitAfter(content, "\n") {
+		lineStart := offset
+		offset += len(line)
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+
+		m := markdownHeading.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if inFence || m == nil {
+			current.WriteString(line)
+			continue
+		}
+
+		if current.Len() > 0 {
+			sections = append(sections, mdSection{breadcrumb: breadcrumb, text: current.String(), offset: sectionStart})
+			current.Reset()
+		}
+		sectionStart = lineStart
+
+		level := len(m[1])
+		headings[level-1] = m[1] + " " + m[2]
+		for i := level; i < len(headings); i++ {
+			headings[i] = ""
+		}
+		var parts []string
+		for _, h := range headings {
+			if h != "" {
+				parts = append(parts, h)
+			}
+		}
+		breadcrumb = strings.Join(parts, " > ")
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		sections = append(sections, mdSection{breadcrumb: breadcrumb, text: current.String(), offset: sectionStart})
+	}
+
+	return sections
+}
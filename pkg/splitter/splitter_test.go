@@ -27,7 +27,7 @@ func TestSplitter(t *testing.T) {
 
 	// Check token count of each chunk
 	for i, chunk := range chunks {
-		tokens := s.tkm.Encode(chunk, nil, nil)
+		tokens := s.tkm.Encode(chunk.Text, nil, nil)
 		if len(tokens) > chunkSize {
 			t.Errorf("Chunk %d has %d tokens, which is more than the chunk size of %d", i, len(tokens), chunkSize)
 		}
@@ -35,13 +35,13 @@ func TestSplitter(t *testing.T) {
 
 	// Check content of chunks
 	expectedChunk1 := "This is a test sentence"
-	if chunks[0] != expectedChunk1 {
-		t.Errorf("Expected chunk 1 to be '%s', got '%s'", expectedChunk1, chunks[0])
+	if chunks[0].Text != expectedChunk1 {
+		t.Errorf("Expected chunk 1 to be '%s', got '%s'", expectedChunk1, chunks[0].Text)
 	}
 
 	expectedChunk2 := " for the splitter."
-	if chunks[1] != expectedChunk2 {
-		t.Errorf("Expected chunk 2 to be '%s', got '%s'", expectedChunk2, chunks[1])
+	if chunks[1].Text != expectedChunk2 {
+		t.Errorf("Expected chunk 2 to be '%s', got '%s'", expectedChunk2, chunks[1].Text)
 	}
 }
 
@@ -71,21 +71,85 @@ func TestSplitterJSONL(t *testing.T) {
 	// The first line should be in the first chunk
 	expectedChunk1 := `{"key": "value1", "text": "This is the first line."}
 `
-	if chunks[0] != expectedChunk1 {
-		t.Errorf("Expected chunk 1 to be '%s', got '%s'", expectedChunk1, chunks[0])
+	if chunks[0].Text != expectedChunk1 {
+		t.Errorf("Expected chunk 1 to be '%s', got '%s'", expectedChunk1, chunks[0].Text)
 	}
 
 	// The second line should be in the second chunk
 	expectedChunk2 := `{"key": "value2", "text": "This is the second line, which is a bit longer."}
 `
-	if chunks[1] != expectedChunk2 {
-		t.Errorf("Expected chunk 2 to be '%s', got '%s'", expectedChunk2, chunks[1])
+	if chunks[1].Text != expectedChunk2 {
+		t.Errorf("Expected chunk 2 to be '%s', got '%s'", expectedChunk2, chunks[1].Text)
 	}
 
 	// The third line should be in the third chunk
 	expectedChunk3 := `{"key": "value3", "text": "Third line."}
 `
-	if chunks[2] != expectedChunk3 {
-		t.Errorf("Expected chunk 3 to be '%s', got '%s'", expectedChunk3, chunks[2])
+	if chunks[2].Text != expectedChunk3 {
+		t.Errorf("Expected chunk 3 to be '%s', got '%s'", expectedChunk3, chunks[2].Text)
 	}
-}
\ No newline at end of file
+}
+
+func TestSplitMarkdown(t *testing.T) {
+	doc := `Preamble.
+# Ops
+Overview.
+## Incidents
+### 2025-10
+Disk full on db-1.
+` + "```" + `
+# not a heading
+` + "```" + `
+## Changes
+Upgraded the kernel.
+`
+
+	s, err := NewSplitter(1000)
+	if err != nil {
+		t.Fatalf("Failed to create splitter: %v", err)
+	}
+
+	// Everything fits into one chunk, which keeps the preamble's empty breadcrumb.
+	chunks, err := s.SplitMarkdown(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("SplitMarkdown failed: %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("Expected 1 chunk, got %d", len(chunks))
+	}
+	if chunks[0].Text != doc || chunks[0].Section != "" {
+		t.Errorf("Unexpected chunk: %+v", chunks[0])
+	}
+
+	sections := parseMarkdownSections(doc)
+	expected := []string{"", "# Ops", "# Ops > ## Incidents", "# Ops > ## Incidents > ### 2025-10", "# Ops > ## Changes"}
+	if len(sections) != len(expected) {
+		t.Fatalf("Expected %d sections, got %d", len(expected), len(sections))
+	}
+	for i, section := range sections {
+		if section.breadcrumb != expected[i] {
+			t.Errorf("Section %d: expected breadcrumb '%s', got '%s'", i, expected[i], section.breadcrumb)
+		}
+	}
+
+	// With a small budget every chunk starts with its section's breadcrumb.
+	s.chunkSize = 40
+	chunks, err = s.SplitMarkdown(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("SplitMarkdown failed: %v", err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if chunk.Section != "" && !strings.HasPrefix(chunk.Text, chunk.Section+"\n\n") {
+			t.Errorf("Chunk %d does not start with its breadcrumb '%s': %q", i, chunk.Section, chunk.Text)
+		}
+		if tokens := len(s.Encode(chunk.Text)); tokens > s.chunkSize {
+			t.Errorf("Chunk %d has %d tokens, more than the chunk size of %d", i, tokens, s.chunkSize)
+		}
+	}
+	if last := chunks[len(chunks)-1]; last.Section != "# Ops > ## Changes" {
+		t.Errorf("Expected last chunk in '# Ops > ## Changes', got '%s'", last.Section)
+	}
+}
@@ -0,0 +1,335 @@
+// Package stats collects the token usage and cost of a run per stage and per
+// endpoint, and saves it as run_stats.json in the work directory.
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+)
+
+// FileName is the name of the statistics file in the work directory.
+const FileName = "run_stats.json"
+
+// Stages of an analysis.
+const (
+	StagePrefilter = "prefilter"
+	StageMap       = "map"
+	StageReduce    = "reduce"
+	StageExtract   = "extract"
+)
+
+// Entry is the usage of one stage on one endpoint, or a total of entries.
+type Entry struct {
+	Stage        string  `json:"stage,omitempty"`
+	Endpoint     string  `json:"endpoint,omitempty"`
+	Requests     int     `json:"requests"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+	// CountedRequests is the number of requests whose usage the endpoint did
+	// not report and that were counted locally.
+	CountedRequests int `json:"counted_requests,omitempty"`
+}
+
+func (e *Entry) add(other Entry) {
+	e.Requests += other.Requests
+	e.InputTokens += other.InputTokens
+	e.OutputTokens += other.OutputTokens
+	e.Cost += other.Cost
+	e.CountedRequests += other.CountedRequests
+}
+
+// Prefilter are the decisions of the relevance prefilter.
+type Prefilter struct {
+	Chunks   int `json:"chunks"`
+	Relevant int `json:"relevant"`
+	Skipped  int `json:"skipped"`
+}
+
+// CircuitEvent is a change of the state of an endpoint's circuit breaker.
+type CircuitEvent struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Endpoint string    `json:"endpoint"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+}
+
+// file is the layout of run_stats.json.
+type file struct {
+	Stages         []Entry        `json:"stages"`
+	Endpoints      []Entry        `json:"endpoints"`
+	Total          Entry          `json:"total"`
+	Prefilter      *Prefilter     `json:"prefilter,omitempty"`
+	CircuitBreaker []CircuitEvent `json:"circuit_breaker,omitempty"`
+}
+
+// ErrBudgetExceeded is returned for a request that would exceed the token or
+// cost budget of the run.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Stats collects the usage of a run. It is safe for concurrent use.
+type Stats struct {
+	mu        sync.Mutex
+	entries   []Entry
+	prefilter *Prefilter
+	circuit   []CircuitEvent
+
+	// maxTokens and maxCost limit the recorded usage, including the usage
+	// of earlier runs loaded from the work directory.
+	maxTokens int
+	maxCost   float64
+}
+
+// New creates empty statistics.
+func New() *Stats {
+	return &Stats{}
+}
+
+// Load reads the statistics of earlier stages from the work directory, or
+// returns empty statistics if there are none.
+func Load(dir string) (*Stats, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run statistics: %w", err)
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse run statistics: %w", err)
+	}
+	return &Stats{entries: f.Stages, prefilter: f.Prefilter, circuit: f.CircuitBreaker}, nil
+}
+
+// Reset removes the usage and the circuit breaker events of a stage before it
+// runs again.
+func (s *Stats) Reset(stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries[:0]
+	for _, entry := range s.entries {
+		if entry.Stage != stage {
+			entries = append(entries, entry)
+		}
+	}
+	s.entries = entries
+	events := s.circuit[:0]
+	for _, event := range s.circuit {
+		if event.Stage != stage {
+			events = append(events, event)
+		}
+	}
+	s.circuit = events
+	if stage == StagePrefilter {
+		s.prefilter = nil
+	}
+}
+
+// SetBudget limits the tokens and the cost of all recorded usage: the
+// requests made from now on, and the stages of earlier runs that are not
+// reset. Zero means no limit.
+func (s *Stats) SetBudget(maxTokens int, maxCost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxTokens, s.maxCost = maxTokens, maxCost
+}
+
+// Allow returns ErrBudgetExceeded if a request with the given input tokens
+// would exceed the budget. The size of the answer is not known in advance,
+// so requests that are already in flight may still exceed it.
+func (s *Stats) Allow(endpointConf config.EndpointConfig, inputTokens int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var spent Entry
+	for _, entry := range s.entries {
+		spent.add(entry)
+	}
+	if s.maxTokens > 0 && spent.InputTokens+spent.OutputTokens+inputTokens > s.maxTokens {
+		return fmt.Errorf("%w: %d tokens used, the next request needs %d more, --max-total-tokens is %d",
+			ErrBudgetExceeded, spent.InputTokens+spent.OutputTokens, inputTokens, s.maxTokens)
+	}
+	if cost := endpointConf.Cost(inputTokens, 0); s.maxCost > 0 && spent.Cost+cost > s.maxCost {
+		return fmt.Errorf("%w: %.4f spent, the next request costs at least %.4f more, --max-cost is %.4f",
+			ErrBudgetExceeded, spent.Cost, cost, s.maxCost)
+	}
+	return nil
+}
+
+// Track records the usage of every request of the client for the stage, at
+// the prices of the endpoint, and the changes of its circuit breaker, and
+// stops requests that would exceed the budget.
+func (s *Stats) Track(client *llm.Client, stage string, endpointConf config.EndpointConfig) {
+	client.OnUsage = func(usage llm.Usage) {
+		s.Add(stage, endpointConf.Name, usage, endpointConf.Cost(usage.PromptTokens, usage.CompletionTokens))
+	}
+	client.BeforeRequest = func(messages []llm.Message) error {
+		return s.Allow(endpointConf, llm.PromptTokens(messages))
+	}
+	client.OnCircuitChange = func(from, to llm.CircuitState) {
+		s.AddCircuitEvent(stage, endpointConf.Name, string(from), string(to))
+	}
+}
+
+// AddCircuitEvent records a change of the state of an endpoint's circuit
+// breaker.
+func (s *Stats) AddCircuitEvent(stage, endpoint, from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.circuit = append(s.circuit, CircuitEvent{Time: time.Now().UTC(), Stage: stage, Endpoint: endpoint, From: from, To: to})
+}
+
+// CircuitEvents returns the changes of the circuit breakers' states, in the
+// order they happened.
+func (s *Stats) CircuitEvents() []CircuitEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CircuitEvent(nil), s.circuit...)
+}
+
+// Add records the usage of one request.
+func (s *Stats) Add(stage, endpoint string, usage llm.Usage, cost float64) {
+	request := Entry{Requests: 1, InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens, Cost: cost}
+	if usage.Counted {
+		request.CountedRequests = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.entries {
+		if s.entries[i].Stage == stage && s.entries[i].Endpoint == endpoint {
+			s.entries[i].add(request)
+			return
+		}
+	}
+	request.Stage, request.Endpoint = stage, endpoint
+	s.entries = append(s.entries, request)
+}
+
+// SetPrefilter records the decisions of the prefilter.
+func (s *Stats) SetPrefilter(chunks, relevant int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefilter = &Prefilter{Chunks: chunks, Relevant: relevant, Skipped: chunks - relevant}
+}
+
+// Stages returns the usage per stage and endpoint, in the order the stages
+// first made a request.
+func (s *Stats) Stages() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Entry(nil), s.entries...)
+}
+
+// Endpoints returns the usage per endpoint.
+func (s *Stats) Endpoints() []Entry {
+	var endpoints []Entry
+	for _, entry := range s.Stages() {
+		found := false
+		for i := range endpoints {
+			if endpoints[i].Endpoint == entry.Endpoint {
+				endpoints[i].add(entry)
+				found = true
+				break
+			}
+		}
+		if !found {
+			entry.Stage = ""
+			endpoints = append(endpoints, entry)
+		}
+	}
+	return endpoints
+}
+
+// Total returns the usage of all stages.
+func (s *Stats) Total() Entry {
+	var total Entry
+	for _, entry := range s.Stages() {
+		total.add(entry)
+	}
+	return total
+}
+
+// Write saves the statistics to the work directory.
+func (s *Stats) Write(dir string) error {
+	s.mu.Lock()
+	prefilter := s.prefilter
+	s.mu.Unlock()
+	data, err := json.MarshalIndent(file{
+		Stages:         s.Stages(),
+		Endpoints:      s.Endpoints(),
+		Total:          s.Total(),
+		Prefilter:      prefilter,
+		CircuitBreaker: s.CircuitEvents(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode run statistics: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, FileName), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write run statistics: %w", err)
+	}
+	return nil
+}
+
+// WriteTable prints the usage per stage and endpoint, the totals per
+// endpoint and the prefilter decisions.
+func (s *Stats) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tENDPOINT\tREQUESTS\tINPUT TOKENS\tOUTPUT TOKENS\tCOST")
+	for _, entry := range s.Stages() {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%.4f\n", entry.Stage, entry.Endpoint, entry.Requests, entry.InputTokens, entry.OutputTokens, entry.Cost)
+	}
+	if endpoints := s.Endpoints(); len(endpoints) > 1 {
+		for _, entry := range endpoints {
+			fmt.Fprintf(tw, "all\t%s\t%d\t%d\t%d\t%.4f\n", entry.Endpoint, entry.Requests, entry.InputTokens, entry.OutputTokens, entry.Cost)
+		}
+	}
+	total := s.Total()
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t%d\t%.4f\n", total.Requests, total.InputTokens, total.OutputTokens, total.Cost)
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write run statistics: %w", err)
+	}
+
+	if total.CountedRequests > 0 {
+		fmt.Fprintf(w, "The endpoint reported no usage for %d requests; their tokens were counted locally.\n", total.CountedRequests)
+	}
+	s.mu.Lock()
+	prefilter := s.prefilter
+	s.mu.Unlock()
+	if prefilter != nil {
+		fmt.Fprintf(w, "Prefilter: %d of %d chunks relevant, %d skipped\n", prefilter.Relevant, prefilter.Chunks, prefilter.Skipped)
+	}
+	writeCircuitSummary(w, s.CircuitEvents())
+	return nil
+}
+
+// writeCircuitSummary prints how often the circuit breaker of each endpoint
+// opened, and its last state.
+func writeCircuitSummary(w io.Writer, events []CircuitEvent) {
+	var endpoints []string
+	opened := make(map[string]int)
+	last := make(map[string]string)
+	for _, event := range events {
+		if _, ok := last[event.Endpoint]; !ok {
+			endpoints = append(endpoints, event.Endpoint)
+		}
+		if event.To == string(llm.CircuitOpen) {
+			opened[event.Endpoint]++
+		}
+		last[event.Endpoint] = event.To
+	}
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(w, "Circuit breaker of endpoint %s: opened %d time(s), last state %s\n", endpoint, opened[endpoint], last[endpoint])
+	}
+}
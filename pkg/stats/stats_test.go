@@ -0,0 +1,162 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"llm-data-analyzer/pkg/config"
+	"llm-data-analyzer/pkg/llm"
+)
+
+func TestStats(t *testing.T) {
+	s := New()
+	s.Add(StageMap, "big", llm.Usage{PromptTokens: 100, CompletionTokens: 10}, 0.5)
+	s.Add(StagePrefilter, "small", llm.Usage{PromptTokens: 80, CompletionTokens: 1, Counted: true}, 0.01)
+	s.Add(StageMap, "big", llm.Usage{PromptTokens: 120, CompletionTokens: 20}, 0.75)
+	s.Add(StageReduce, "big", llm.Usage{PromptTokens: 50, CompletionTokens: 40}, 0.25)
+	s.SetPrefilter(10, 3)
+
+	stages := s.Stages()
+	if len(stages) != 3 || stages[0].Stage != StageMap || stages[0].Requests != 2 || stages[0].InputTokens != 220 || stages[0].Cost != 1.25 {
+		t.Errorf("unexpected stages: %+v", stages)
+	}
+	endpoints := s.Endpoints()
+	if len(endpoints) != 2 || endpoints[0].Endpoint != "big" || endpoints[0].Requests != 3 || endpoints[0].OutputTokens != 70 || endpoints[0].Stage != "" {
+		t.Errorf("unexpected endpoints: %+v", endpoints)
+	}
+	if total := s.Total(); total.Requests != 4 || total.InputTokens != 350 || total.CountedRequests != 1 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+
+	var b bytes.Buffer
+	if err := s.WriteTable(&b); err != nil {
+		t.Fatalf("WriteTable failed: %v", err)
+	}
+	for _, expected := range []string{"map", "all", "total", "1.5100", "counted locally", "Prefilter: 3 of 10 chunks relevant, 7 skipped"} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected %q in the table:\n%s", expected, b.String())
+		}
+	}
+
+	dir := t.TempDir()
+	if err := s.Write(dir); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil || len(f.Stages) != 3 || len(f.Endpoints) != 2 || f.Total.Requests != 4 || f.Prefilter.Skipped != 7 {
+		t.Errorf("unexpected %s: %s", FileName, data)
+	}
+
+	// A stage that runs again replaces its earlier usage.
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	loaded.Reset(StageMap)
+	loaded.Reset(StagePrefilter)
+	if stages := loaded.Stages(); len(stages) != 1 || stages[0].Stage != StageReduce {
+		t.Errorf("unexpected stages after reset: %+v", stages)
+	}
+	if loaded.prefilter != nil {
+		t.Error("expected the prefilter decisions to be reset")
+	}
+}
+
+func TestTrack(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"choices": [{"message": {"content": "ok"}}], "usage": {"prompt_tokens": 1000, "completion_tokens": 100, "total_tokens": 1100}}`))
+	}))
+	defer mockServer.Close()
+
+	s := New()
+	client := llm.NewClient(mockServer.URL, "", "m")
+	s.Track(client, StageMap, config.EndpointConfig{Name: "big", InputPricePerMTok: 2, OutputPricePerMTok: 10})
+	if _, err := client.Analyze(context.Background(), "hello"); err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+	if total := s.Total(); total.Requests != 1 || total.InputTokens != 1000 || total.OutputTokens != 100 || total.Cost != 0.003 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	endpoint := config.EndpointConfig{Name: "big", InputPricePerMTok: 1000, OutputPricePerMTok: 1000}
+	s := New()
+	// Usage recorded before the budget is set counts, until its stage is reset.
+	s.Add(StageReduce, "big", llm.Usage{PromptTokens: 5000}, 5)
+	s.SetBudget(1000, 0.9)
+	if err := s.Allow(endpoint, 1); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("expected the recorded usage to exceed the budget, got %v", err)
+	}
+	s.Reset(StageReduce)
+
+	s.Add(StageMap, "big", llm.Usage{PromptTokens: 400, CompletionTokens: 100}, 0.5)
+	if err := s.Allow(endpoint, 300); err != nil {
+		t.Errorf("expected the request to be allowed, got %v", err)
+	}
+	if err := s.Allow(endpoint, 600); !errors.Is(err, ErrBudgetExceeded) || !strings.Contains(err.Error(), "--max-total-tokens") {
+		t.Errorf("expected the token budget to be exceeded, got %v", err)
+	}
+	// 0.5 spent plus 0.45 for 450 input tokens exceeds the cost budget.
+	if err := s.Allow(endpoint, 450); !errors.Is(err, ErrBudgetExceeded) || !strings.Contains(err.Error(), "--max-cost") {
+		t.Errorf("expected the cost budget to be exceeded, got %v", err)
+	}
+
+	s.SetBudget(0, 0)
+	if err := s.Allow(endpoint, 1000000); err != nil {
+		t.Errorf("expected no limit, got %v", err)
+	}
+}
+
+func TestCircuitEvents(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	s := New()
+	client := llm.NewClient(mockServer.URL, "", "m")
+	client.Breaker = llm.NewCircuitBreaker(2, time.Minute)
+	s.Track(client, StageMap, config.EndpointConfig{Name: "flaky"})
+	for i := 0; i < 3; i++ {
+		client.Analyze(context.Background(), "hello")
+	}
+	events := s.CircuitEvents()
+	if len(events) != 1 || events[0].Stage != StageMap || events[0].Endpoint != "flaky" || events[0].From != "closed" || events[0].To != "open" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	var b bytes.Buffer
+	if err := s.WriteTable(&b); err != nil {
+		t.Fatalf("WriteTable failed: %v", err)
+	}
+	if !strings.Contains(b.String(), "Circuit breaker of endpoint flaky: opened 1 time(s), last state open") {
+		t.Errorf("expected the circuit breaker in the table:\n%s", b.String())
+	}
+
+	dir := t.TempDir()
+	if err := s.Write(dir); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	loaded, err := Load(dir)
+	if err != nil || len(loaded.CircuitEvents()) != 1 {
+		t.Fatalf("expected the events to be loaded, got %+v, %v", loaded, err)
+	}
+	loaded.Reset(StageMap)
+	if events := loaded.CircuitEvents(); len(events) != 0 {
+		t.Errorf("expected the events of the stage to be reset, got %+v", events)
+	}
+}
@@ -0,0 +1,116 @@
+package summarizer
+
+import (
+	"fmt"
+	"strings"
+
+	"llm-data-analyzer/pkg/tokens"
+)
+
+// defaultOutputShare is the share of the context window that is kept free for
+// the answer when the client sets no MaxTokens.
+const defaultOutputShare = 0.25
+
+// budget describes how the context window of a summary request is divided
+// between its fixed parts and the text to summarize.
+type budget struct {
+	promptName      string
+	contextWindow   int
+	maxOutputTokens int
+	// defaultOutput is set if maxOutputTokens is the default share of the
+	// context window.
+	defaultOutput bool
+	systemPrompt  int
+	prompt        int
+	overhead      int
+}
+
+// input returns the number of tokens left for the text to summarize.
+func (b budget) input() int {
+	return b.contextWindow - b.maxOutputTokens - b.systemPrompt - b.prompt - b.overhead
+}
+
+// fixed returns the number of tokens of a request besides the text.
+func (b budget) fixed() int {
+	return b.systemPrompt + b.prompt + b.overhead
+}
+
+// BudgetError reports that a summary request cannot fit into the context
+// window of the model.
+type BudgetError struct {
+	// Budget names the budget that was exceeded.
+	Budget string
+	// PromptName names the prompt of the request, e.g. "merge prompt".
+	PromptName string
+
+	ContextWindow   int
+	MaxOutputTokens int
+	// DefaultOutput is set if MaxOutputTokens is the default share of the
+	// context window, because max_output_tokens is not set.
+	DefaultOutput bool
+	SystemPrompt  int
+	Prompt        int
+	Overhead      int
+	Text          int
+}
+
+func (e *BudgetError) Error() string {
+	parts := []string{
+		fmt.Sprintf("%s (%d)", e.PromptName, e.Prompt),
+		fmt.Sprintf("system prompt (%d)", e.SystemPrompt),
+		fmt.Sprintf("template overhead (%d)", e.Overhead),
+		fmt.Sprintf("max_output_tokens (%d)", e.MaxOutputTokens),
+	}
+	if e.DefaultOutput {
+		parts[3] = fmt.Sprintf("output reserve (%d, a quarter of the window as max_output_tokens is not set)", e.MaxOutputTokens)
+	}
+	used := e.Prompt + e.SystemPrompt + e.Overhead + e.MaxOutputTokens
+	if e.Text > 0 {
+		parts = append(parts, fmt.Sprintf("text (%d)", e.Text))
+		used += e.Text
+	}
+	msg := fmt.Sprintf("%s budget exceeded: %s = %d tokens, but context_window_size is %d",
+		e.Budget, strings.Join(parts, " + "), used, e.ContextWindow)
+	if e.Text == 0 {
+		msg += " (no room left for the text to summarize)"
+	}
+	return msg
+}
+
+// newBudget computes the budget of a summary request with the given prompt.
+// Without MaxTokens, the default share of the window is kept for the answer.
+// It fails if the fixed parts leave no room for text.
+func (s *Summarizer) newBudget(promptName, prompt string) (budget, error) {
+	b := budget{
+		promptName: promptName, contextWindow: s.chunkSize,
+		maxOutputTokens: s.client.MaxTokens,
+		prompt:          len(s.splitter.Encode(prompt)),
+		overhead:        len(s.splitter.Encode(summaryPrompt("", ""))) + tokens.MessageOverhead + tokens.ReplyOverhead,
+	}
+	if b.maxOutputTokens == 0 {
+		b.maxOutputTokens = int(float64(s.chunkSize) * defaultOutputShare)
+		b.defaultOutput = true
+	}
+	if s.client.SystemPrompt != "" {
+		b.systemPrompt = len(s.splitter.Encode(s.client.SystemPrompt)) + tokens.MessageOverhead
+	}
+	if b.input() < 1 {
+		return b, b.exceeded("context window", 0)
+	}
+	return b, nil
+}
+
+// exceeded returns a BudgetError for the given budget and text size.
+func (b budget) exceeded(name string, textTokens int) *BudgetError {
+	return &BudgetError{
+		Budget:          name,
+		PromptName:      b.promptName,
+		ContextWindow:   b.contextWindow,
+		MaxOutputTokens: b.maxOutputTokens,
+		DefaultOutput:   b.defaultOutput,
+		SystemPrompt:    b.systemPrompt,
+		Prompt:          b.prompt,
+		Overhead:        b.overhead,
+		Text:            textTokens,
+	}
+}
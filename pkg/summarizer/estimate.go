@@ -0,0 +1,146 @@
+package summarizer
+
+import "fmt"
+
+// Estimate is the projected work of a reduce.
+type Estimate struct {
+	// Depth is the number of sequential requests: the levels of the reduce
+	// tree, or the steps of a refine.
+	Depth        int
+	Requests     int
+	InputTokens  int
+	OutputTokens int
+}
+
+func (e *Estimate) add(inputTokens, outputTokens int) {
+	e.Requests++
+	e.InputTokens += inputTokens
+	e.OutputTokens += outputTokens
+}
+
+// Estimate projects the requests SummarizeResults would make for results of
+// the given token counts, without calling the model. Every answer is assumed
+// to be outputTokens long.
+func (s *Summarizer) Estimate(sizes []int, prompt string, outputTokens int) (Estimate, error) {
+	switch s.Strategy {
+	case StrategyTree, "":
+		return s.estimateTree(sizes, prompt, outputTokens)
+	case StrategyRefine:
+		return s.estimateRefine(sizes, prompt, outputTokens)
+	case StrategyMerge:
+		if prompt == "" {
+			return Estimate{}, nil
+		}
+		// The merged JSON is about as large as the results together.
+		total := 0
+		for _, size := range sizes {
+			total += size
+		}
+		return s.estimateTree([]int{total}, prompt, outputTokens)
+	}
+	return Estimate{}, fmt.Errorf("unknown reduce strategy '%s'", s.Strategy)
+}
+
+// estimateTree follows tree level by level on token counts.
+func (s *Summarizer) estimateTree(sizes []int, prompt string, outputTokens int) (Estimate, error) {
+	mergePrompt := s.MergePrompt
+	if mergePrompt == "" {
+		mergePrompt = DefaultMergePrompt
+	}
+	final, err := s.newBudget("summary prompt", prompt+s.schemaInstruction())
+	if err != nil {
+		return Estimate{}, err
+	}
+	var merge budget
+	separatorTokens := len(s.splitter.Encode(resultSeparator))
+	joined := func(sizes []int) int {
+		total := 0
+		for i, size := range sizes {
+			if i > 0 {
+				total += separatorTokens
+			}
+			total += size
+		}
+		return total
+	}
+
+	var e Estimate
+	items := sizes
+	for level := 1; ; level++ {
+		if level > maxIterations {
+			return e, fmt.Errorf("estimated reduce exceeds max iterations (%d): answers of %d tokens do not shrink the results", maxIterations, outputTokens)
+		}
+		if total := joined(items); total <= final.input() {
+			e.add(final.fixed()+total, outputTokens)
+			e.Depth = level
+			return e, nil
+		}
+
+		if level == 1 {
+			if merge, err = s.newBudget("merge prompt", mergePrompt); err != nil {
+				return e, err
+			}
+		}
+		var next []int
+		for _, indices := range s.pack(items, merge.input()) {
+			if len(indices) == 1 && items[indices[0]] > merge.input() {
+				for rest := items[indices[0]]; rest > 0; rest -= merge.input() {
+					e.add(merge.fixed()+min(rest, merge.input()), outputTokens)
+					next = append(next, outputTokens)
+				}
+				continue
+			}
+			group := make([]int, len(indices))
+			for i, index := range indices {
+				group[i] = items[index]
+			}
+			e.add(merge.fixed()+joined(group), outputTokens)
+			next = append(next, outputTokens)
+		}
+		items = next
+	}
+}
+
+// estimateRefine follows refine on token counts. Every step after the first
+// sends the report, assumed to be outputTokens long, with the next piece.
+func (s *Summarizer) estimateRefine(sizes []int, prompt string, outputTokens int) (Estimate, error) {
+	template := s.RefineTemplate
+	if template == "" {
+		template = DefaultRefineTemplate
+	}
+	if err := checkRefineTemplate(template); err != nil {
+		return Estimate{}, err
+	}
+	first, err := s.newBudget("summary prompt", prompt+s.schemaInstruction())
+	if err != nil {
+		return Estimate{}, err
+	}
+	step, err := s.newBudget("refine prompt", renderTemplate(template, map[string]string{"instructions": prompt})+s.schemaInstruction())
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	firstSize, stepSize := s.pieceSizes(first, step)
+	var e Estimate
+	for _, size := range sizes {
+		pieceSize := stepSize
+		if e.Requests == 0 {
+			pieceSize = firstSize
+		}
+		if size > 0 && pieceSize < 1 {
+			return e, step.exceeded("refine step", size)
+		}
+		for rest := size; rest > 0; rest -= pieceSize {
+			if e.Requests == 0 {
+				e.add(first.fixed()+min(rest, pieceSize), outputTokens)
+				continue
+			}
+			e.add(step.fixed()+outputTokens+min(rest, pieceSize), outputTokens)
+		}
+	}
+	if e.Requests == 0 {
+		e.add(first.fixed(), outputTokens)
+	}
+	e.Depth = e.Requests
+	return e, nil
+}
@@ -0,0 +1,65 @@
+package summarizer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"llm-data-analyzer/pkg/llm"
+)
+
+func TestEstimate(t *testing.T) {
+	var calls int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"choices": [{"message": {"content": "summary"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	var results []string
+	var sizes []int
+	for i := 0; i < 20; i++ {
+		result := strings.Repeat("alpha beta gamma ", 20)
+		results = append(results, result)
+		sizes = append(sizes, 60)
+	}
+
+	for _, strategy := range []string{StrategyTree, StrategyRefine} {
+		atomic.StoreInt32(&calls, 0)
+		client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+		summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+		if err != nil {
+			t.Fatalf("failed to create summarizer: %v", err)
+		}
+		summarizer.FanIn = 4
+		summarizer.Strategy = strategy
+
+		// "summary" is one token.
+		estimate, err := summarizer.Estimate(sizes, "Summarize.", 1)
+		if err != nil {
+			t.Fatalf("%s: Estimate failed: %v", strategy, err)
+		}
+		if _, err := summarizer.SummarizeResults(context.Background(), results, "Summarize."); err != nil {
+			t.Fatalf("%s: SummarizeResults failed: %v", strategy, err)
+		}
+		if estimate.Requests != int(atomic.LoadInt32(&calls)) {
+			t.Errorf("%s: estimated %d requests, made %d", strategy, estimate.Requests, calls)
+		}
+		if estimate.OutputTokens != estimate.Requests || estimate.InputTokens < 20*60 {
+			t.Errorf("%s: unexpected estimate: %+v", strategy, estimate)
+		}
+		if strategy == StrategyTree && estimate.Depth != 2 {
+			t.Errorf("expected a reduce depth of 2, got %d", estimate.Depth)
+		}
+	}
+
+	summarizer, _ := NewSummarizer(llm.NewClient(mockServer.URL, "", "m"), 1000, false, &cobra.Command{})
+	summarizer.Strategy = StrategyMerge
+	if estimate, err := summarizer.Estimate(sizes, "", 1); err != nil || estimate.Requests != 0 {
+		t.Errorf("expected no requests for a merge without prompt, got %+v, %v", estimate, err)
+	}
+}
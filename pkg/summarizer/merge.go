@@ -0,0 +1,302 @@
+package summarizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"llm-data-analyzer/pkg/schema"
+)
+
+// Merge rules of the merge strategy.
+const (
+	// RuleConcat appends arrays.
+	RuleConcat = "concat"
+	// RuleSum adds numbers.
+	RuleSum = "sum"
+	// RuleUnion appends arrays and drops duplicate elements.
+	RuleUnion = "union"
+	// RuleDedupe appends arrays of objects and keeps the first object for
+	// every value of a key field. It is written as "dedupe:<key>".
+	RuleDedupe = "dedupe"
+	// RuleMax keeps the largest number, or the last string in lexical order.
+	RuleMax = "max"
+	// RuleFirst keeps the first value.
+	RuleFirst = "first"
+)
+
+// MergeRule is the rule for one field of the JSON results.
+type MergeRule struct {
+	Kind string
+	// Key is the field that identifies an object for RuleDedupe.
+	Key string
+}
+
+// MergeRules maps dotted field paths, e.g. "stats.errors", to their rules.
+// Fields without a rule are merged by type: objects field by field, arrays
+// are concatenated, numbers summed, and for other values the first one is
+// kept.
+type MergeRules map[string]MergeRule
+
+// ParseMergeRules parses rules given as field path and rule name, such as
+// "findings: concat" or "incidents: dedupe:id".
+func ParseMergeRules(spec map[string]string) (MergeRules, error) {
+	rules := MergeRules{}
+	for path, value := range spec {
+		kind, key, _ := strings.Cut(strings.TrimSpace(value), ":")
+		switch kind {
+		case RuleConcat, RuleSum, RuleUnion, RuleMax, RuleFirst:
+			if key != "" {
+				return nil, fmt.Errorf("merge rule '%s' of field '%s' takes no key", kind, path)
+			}
+		case RuleDedupe:
+			if key == "" {
+				return nil, fmt.Errorf("merge rule of field '%s' must name the key, e.g. 'dedupe:id'", path)
+			}
+		default:
+			return nil, fmt.Errorf("unknown merge rule '%s' for field '%s'", value, path)
+		}
+		rules[path] = MergeRule{Kind: kind, Key: key}
+	}
+	return rules, nil
+}
+
+// MergeJSON merges JSON results deterministically according to the rules and
+// returns the merged document, indented.
+func MergeJSON(results []string, rules MergeRules) (string, error) {
+	var merged any
+	for i, result := range results {
+		decoder := json.NewDecoder(strings.NewReader(schema.ExtractJSON(result)))
+		decoder.UseNumber()
+		var doc any
+		if err := decoder.Decode(&doc); err != nil {
+			return "", fmt.Errorf("result %d is not valid JSON: %w", i+1, err)
+		}
+		var err error
+		if merged, err = mergeValue(rules, "", merged, doc); err != nil {
+			return "", fmt.Errorf("failed to merge result %d: %w", i+1, err)
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(merged); err != nil {
+		return "", fmt.Errorf("failed to encode merged results: %w", err)
+	}
+	return strings.TrimSuffix(out.String(), "\n"), nil
+}
+
+// mergeValue merges next into acc, which is nil for the first value of a
+// field.
+func mergeValue(rules MergeRules, path string, acc, next any) (any, error) {
+	if next == nil {
+		return acc, nil
+	}
+	rule, ok := rules[path]
+	if !ok {
+		rule = defaultRule(next)
+	}
+	if acc == nil && rule.Kind != RuleUnion && rule.Kind != RuleDedupe {
+		if object, ok := next.(map[string]any); ok && rule.Kind == "" {
+			return mergeObject(rules, path, map[string]any{}, object)
+		}
+		return next, nil
+	}
+
+	switch rule.Kind {
+	case RuleFirst:
+		return acc, nil
+	case RuleConcat, RuleUnion, RuleDedupe:
+		items, ok := next.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: rule '%s' needs an array, got %s", fieldName(path), rule.Kind, describe(next))
+		}
+		var combined []any
+		if acc != nil {
+			accItems, ok := acc.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: rule '%s' needs an array, got %s", fieldName(path), rule.Kind, describe(acc))
+			}
+			combined = append(combined, accItems...)
+		}
+		combined = append(combined, items...)
+		switch rule.Kind {
+		case RuleUnion:
+			return dedupe(combined, func(item any) any { return item }), nil
+		case RuleDedupe:
+			return dedupe(combined, func(item any) any {
+				if object, ok := item.(map[string]any); ok {
+					if key, ok := object[rule.Key]; ok {
+						return key
+					}
+				}
+				return item
+			}), nil
+		}
+		return combined, nil
+	case RuleSum, RuleMax:
+		return mergeScalar(rule.Kind, path, acc, next)
+	}
+
+	// Objects without an explicit rule are merged field by field.
+	accObject, ok1 := acc.(map[string]any)
+	nextObject, ok2 := next.(map[string]any)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s: cannot merge %s with %s", fieldName(path), describe(acc), describe(next))
+	}
+	return mergeObject(rules, path, accObject, nextObject)
+}
+
+func mergeObject(rules MergeRules, path string, acc, next map[string]any) (any, error) {
+	for name, value := range next {
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+		merged, err := mergeValue(rules, fieldPath, acc[name], value)
+		if err != nil {
+			return nil, err
+		}
+		acc[name] = merged
+	}
+	return acc, nil
+}
+
+// defaultRule returns the rule for a field without an explicit rule. Objects
+// get the empty rule, which merges them field by field.
+func defaultRule(value any) MergeRule {
+	switch value.(type) {
+	case map[string]any:
+		return MergeRule{}
+	case []any:
+		return MergeRule{Kind: RuleConcat}
+	case json.Number:
+		return MergeRule{Kind: RuleSum}
+	}
+	return MergeRule{Kind: RuleFirst}
+}
+
+// mergeScalar applies RuleSum or RuleMax.
+func mergeScalar(kind, path string, acc, next any) (any, error) {
+	if accString, ok := acc.(string); ok && kind == RuleMax {
+		nextString, ok := next.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: cannot compare %s with %s", fieldName(path), describe(acc), describe(next))
+		}
+		return max(accString, nextString), nil
+	}
+
+	a, ok1 := acc.(json.Number)
+	b, ok2 := next.(json.Number)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s: rule '%s' needs numbers, got %s and %s", fieldName(path), kind, describe(acc), describe(next))
+	}
+	if kind == RuleSum {
+		if x, err := a.Int64(); err == nil {
+			if y, err := b.Int64(); err == nil {
+				return json.Number(strconv.FormatInt(x+y, 10)), nil
+			}
+		}
+	}
+	x, err := a.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid number %s", fieldName(path), a)
+	}
+	y, err := b.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid number %s", fieldName(path), b)
+	}
+	if kind == RuleMax {
+		if y > x {
+			return b, nil
+		}
+		return a, nil
+	}
+	return json.Number(strconv.FormatFloat(x+y, 'f', -1, 64)), nil
+}
+
+// dedupe keeps the first item for every distinct key.
+func dedupe(items []any, key func(any) any) []any {
+	seen := make(map[string]bool)
+	result := []any{}
+	for _, item := range items {
+		encoded, _ := json.Marshal(key(item))
+		if seen[string(encoded)] {
+			continue
+		}
+		seen[string(encoded)] = true
+		result = append(result, item)
+	}
+	return result
+}
+
+func describe(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case json.Number:
+		return "a number"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
+
+func fieldName(path string) string {
+	if path == "" {
+		return "top level"
+	}
+	return "field '" + path + "'"
+}
+
+// conformPrompt asks the LLM to restructure merged data that is not valid
+// under the FinalSchema.
+const conformPrompt = `Restructure the merged data below into a JSON document that matches the required schema.
+Keep every value that fits the schema and do not invent values.`
+
+// mergeResults merges JSON results with MergeRules. With a summary prompt,
+// the LLM writes a narrative over the merged data, which is returned in front
+// of the data. With a FinalSchema, the output is a document valid under it:
+// the answer to the summary prompt, or else the merged data, which the LLM
+// restructures only if it does not validate.
+func (s *Summarizer) mergeResults(ctx context.Context, results []string, prompt string) (string, error) {
+	merged, err := MergeJSON(results, s.MergeRules)
+	if err != nil {
+		return "", err
+	}
+	if s.verbose {
+		s.cmd.Printf("Merged %d results into %d bytes of JSON.\n", len(results), len(merged))
+	}
+	if prompt == "" {
+		if s.FinalSchema == nil {
+			return merged, nil
+		}
+		valid, err := s.FinalSchema.Validate(merged)
+		if err == nil {
+			return valid, nil
+		}
+		if s.verbose {
+			s.cmd.Printf("Merged data does not match the summary schema (%v), restructuring it.\n", err)
+		}
+		prompt = conformPrompt
+	}
+
+	// With a FinalSchema, the final request is validated and repaired.
+	narrative, err := s.tree(ctx, []string{merged}, prompt)
+	if err != nil {
+		return "", err
+	}
+	if s.FinalSchema != nil {
+		return narrative, nil
+	}
+	return narrative + "\n\n--- Merged Data ---\n" + merged, nil
+}
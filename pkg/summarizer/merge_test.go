@@ -0,0 +1,169 @@
+package summarizer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
+	"github.com/spf13/cobra"
+)
+
+func TestMergeJSON(t *testing.T) {
+	rules, err := ParseMergeRules(map[string]string{
+		"hosts":        "union",
+		"incidents":    "dedupe:id",
+		"severity":     "max",
+		"last_seen":    "max",
+		"stats.errors": "sum",
+		"stats.peak":   "max",
+	})
+	if err != nil {
+		t.Fatalf("ParseMergeRules failed: %v", err)
+	}
+
+	results := []string{
+		`{"findings": ["disk full"], "hosts": ["a", "b", "a"], "incidents": [{"id": 1, "note": "first"}], "severity": 2, "last_seen": "2025-10-01", "stats": {"errors": 3, "peak": 1.5}, "title": "one"}`,
+		"```json\n{\"findings\": [\"oom\"], \"hosts\": [\"b\", \"c\"], \"incidents\": [{\"id\": 1, \"note\": \"again\"}, {\"id\": 2}], \"severity\": 5, \"last_seen\": \"2025-09-30\", \"stats\": {\"errors\": 4, \"peak\": 0.5}, \"title\": \"two\"}\n```",
+		`{"findings": [], "stats": {"errors": 0.5}}`,
+	}
+	merged, err := MergeJSON(results, rules)
+	if err != nil {
+		t.Fatalf("MergeJSON failed: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(merged), &got); err != nil {
+		t.Fatalf("merged result is not JSON: %v", err)
+	}
+	expected := map[string]any{
+		"findings":  []any{"disk full", "oom"},
+		"hosts":     []any{"a", "b", "c"},
+		"incidents": []any{map[string]any{"id": 1.0, "note": "first"}, map[string]any{"id": 2.0}},
+		"severity":  5.0,
+		"last_seen": "2025-10-01",
+		"stats":     map[string]any{"errors": 7.5, "peak": 1.5},
+		"title":     "one",
+	}
+	gotJSON, _ := json.Marshal(got)
+	expectedJSON, _ := json.Marshal(expected)
+	if string(gotJSON) != string(expectedJSON) {
+		t.Errorf("expected %s, got %s", expectedJSON, gotJSON)
+	}
+
+	// Merging is deterministic.
+	again, _ := MergeJSON(results, rules)
+	if again != merged {
+		t.Error("MergeJSON is not deterministic")
+	}
+
+	if _, err := MergeJSON([]string{`{"hosts": ["a"]}`, `{"hosts": "b"}`}, rules); err == nil || !strings.Contains(err.Error(), "field 'hosts'") {
+		t.Errorf("expected an error for field 'hosts', got %v", err)
+	}
+	if _, err := MergeJSON([]string{"not JSON"}, rules); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestParseMergeRules(t *testing.T) {
+	for _, spec := range []map[string]string{
+		{"a": "average"},
+		{"a": "dedupe"},
+		{"a": "sum:x"},
+	} {
+		if _, err := ParseMergeRules(spec); err == nil {
+			t.Errorf("expected an error for %v", spec)
+		}
+	}
+}
+
+func TestSummarizeResultsMerge(t *testing.T) {
+	calls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !strings.Contains(req.Messages[0].Content, `"errors": 5`) {
+			t.Errorf("expected the merged data in the prompt, got %q", req.Messages[0].Content)
+		}
+		w.Write([]byte(`{"choices": [{"message": {"content": "Five errors."}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.Strategy = StrategyMerge
+	results := []string{`{"errors": 2}`, `{"errors": 3}`}
+
+	// Without a summary prompt, the LLM is not called.
+	result, err := summarizer.SummarizeResults(context.Background(), results, "")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "{\n  \"errors\": 5\n}" || calls != 0 {
+		t.Errorf("unexpected result %q after %d calls", result, calls)
+	}
+
+	result, err = summarizer.SummarizeResults(context.Background(), results, "Describe the data:")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if !strings.HasPrefix(result, "Five errors.\n\n--- Merged Data ---\n{") || calls != 1 {
+		t.Errorf("unexpected result %q after %d calls", result, calls)
+	}
+}
+
+func TestSummarizeResultsMergeSchema(t *testing.T) {
+	var prompts []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		prompts = append(prompts, req.Messages[0].Content)
+		w.Write([]byte(`{"choices": [{"message": {"content": "{\"total_errors\": 5}"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.Strategy = StrategyMerge
+	results := []string{`{"errors": 2}`, `{"errors": 3}`}
+
+	// Merged data that is valid under the schema is the output.
+	summarizer.FinalSchema, _ = schema.Parse("report", []byte(`{"type": "object", "required": ["errors"]}`))
+	result, err := summarizer.SummarizeResults(context.Background(), results, "")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "{\n  \"errors\": 5\n}" || len(prompts) != 0 {
+		t.Errorf("unexpected result %q after %d calls", result, len(prompts))
+	}
+
+	// Merged data that is not valid is restructured by the LLM.
+	summarizer.FinalSchema, _ = schema.Parse("report", []byte(`{"type": "object", "required": ["total_errors"]}`))
+	result, err = summarizer.SummarizeResults(context.Background(), results, "")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "{\n  \"total_errors\": 5\n}" || len(prompts) != 1 || !strings.Contains(prompts[0], `"errors": 5`) {
+		t.Errorf("unexpected result %q after prompts %q", result, prompts)
+	}
+
+	// The answer to a summary prompt is the output, not wrapped with the data.
+	result, err = summarizer.SummarizeResults(context.Background(), results, "Describe the data:")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "{\n  \"total_errors\": 5\n}" || len(prompts) != 2 {
+		t.Errorf("unexpected result %q after %d calls", result, len(prompts))
+	}
+}
@@ -0,0 +1,135 @@
+package summarizer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DefaultRefineTemplate is the prompt of a refine step. {{instructions}} is
+// replaced with the summary prompt, {{existing_report}} with the report so
+// far and {{new_findings}} with the next intermediate result.
+const DefaultRefineTemplate = `{{instructions}}
+
+You are updating an existing report with new findings. Integrate the new findings into the report, keeping its chronological order and structure, and return the complete updated report.
+
+--- Existing Report ---
+{{existing_report}}
+
+--- New Findings ---
+{{new_findings}}`
+
+// renderTemplate replaces {{name}} placeholders with their values.
+func renderTemplate(template string, vars map[string]string) string {
+	var pairs []string
+	for name, value := range vars {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
+
+// checkRefineTemplate verifies that a refine template contains the
+// placeholders for the report and the new findings.
+func checkRefineTemplate(template string) error {
+	for _, name := range []string{"existing_report", "new_findings"} {
+		if !strings.Contains(template, "{{"+name+"}}") {
+			return fmt.Errorf("refine prompt template is missing the {{%s}} placeholder", name)
+		}
+	}
+	return nil
+}
+
+// refine walks the results in order and keeps a running report: the first
+// result is summarized with the summary prompt, and every further result is
+// merged into the report with the refine template. In the summary prompt,
+// {{level}} is the step number and {{stage}} is "refine". Results that do not fit
+// next to the report are split by tokens and merged piece by piece. With a
+// FinalSchema, only the last step is asked for JSON.
+func (s *Summarizer) refine(ctx context.Context, results []string, prompt string) (string, error) {
+	template := s.RefineTemplate
+	if template == "" {
+		template = DefaultRefineTemplate
+	}
+	if err := checkRefineTemplate(template); err != nil {
+		return "", err
+	}
+
+	first, err := s.newBudget("summary prompt", prompt+s.schemaInstruction())
+	if err != nil {
+		return "", err
+	}
+	step, err := s.newBudget("refine prompt", renderTemplate(template, map[string]string{"instructions": prompt})+s.schemaInstruction())
+	if err != nil {
+		return "", err
+	}
+
+	firstSize, stepSize := s.pieceSizes(first, step)
+	var pieces []string
+	for _, result := range results {
+		tokens := s.splitter.Encode(result)
+		size := stepSize
+		if len(pieces) == 0 {
+			size = firstSize
+		}
+		if size < 1 {
+			return "", step.exceeded("refine step", len(tokens))
+		}
+		for i := 0; i < len(tokens); i += size {
+			end := min(i+size, len(tokens))
+			pieces = append(pieces, s.splitter.Decode(tokens[i:end]))
+		}
+	}
+	if len(pieces) == 0 {
+		pieces = []string{""}
+	}
+
+	if s.verbose {
+		s.cmd.Printf("Refine step 1/%d\n", len(pieces))
+	}
+	analyze := func(prompt string, last bool) (string, error) {
+		if last {
+			return s.analyzeFinal(ctx, prompt)
+		}
+		return s.client.Analyze(ctx, prompt)
+	}
+
+	report, err := analyze(summaryPrompt(renderLevel(prompt, 1, StrategyRefine, 1), pieces[0]), len(pieces) == 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the initial report: %w", err)
+	}
+
+	for i, piece := range pieces[1:] {
+		if s.verbose {
+			s.cmd.Printf("Refine step %d/%d\n", i+2, len(pieces))
+		}
+		reportTokens := len(s.splitter.Encode(report))
+		pieceTokens := len(s.splitter.Encode(piece))
+		if reportTokens+pieceTokens > step.input() {
+			return "", step.exceeded("refine step", reportTokens+pieceTokens)
+		}
+
+		fullPrompt := renderTemplate(template, map[string]string{
+			"instructions":    renderLevel(prompt, i+2, StrategyRefine, 1),
+			"existing_report": report,
+			"new_findings":    piece,
+		})
+		report, err = analyze(fullPrompt, i+2 == len(pieces))
+		if err != nil {
+			return "", fmt.Errorf("failed to refine the report in step %d: %w", i+2, err)
+		}
+	}
+
+	return report, nil
+}
+
+// pieceSizes returns the maximum size of the first piece of a refine, which
+// only has to fit next to the summary prompt, and of every further piece,
+// which has to fit next to the report. The report is at most MaxTokens long,
+// or else gets half of the budget.
+func (s *Summarizer) pieceSizes(first, step budget) (int, int) {
+	reserve := s.client.MaxTokens
+	if reserve == 0 || reserve >= step.input() {
+		reserve = step.input() / 2
+	}
+	return first.input(), step.input() - reserve
+}
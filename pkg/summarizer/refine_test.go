@@ -0,0 +1,71 @@
+package summarizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"llm-data-analyzer/pkg/llm"
+)
+
+func TestRefine(t *testing.T) {
+	var prompts []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		prompts = append(prompts, req.Messages[len(req.Messages)-1].Content)
+		fmt.Fprintf(w, `{"choices": [{"message": {"content": "report %d"}}]}`, len(prompts))
+	}))
+	defer mockServer.Close()
+
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.Strategy = StrategyRefine
+	summarizer.RefineTemplate = "{{instructions}}\nREPORT: {{existing_report}}\nNEW: {{new_findings}}"
+
+	results := []string{"08:00 disk alert", "09:00 failover", "10:00 recovery"}
+	result, err := summarizer.SummarizeResults(context.Background(), results, "Write a timeline.")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "report 3" {
+		t.Errorf("unexpected result: %s", result)
+	}
+
+	if len(prompts) != 3 {
+		t.Fatalf("expected 3 calls, got %d", len(prompts))
+	}
+	if !strings.Contains(prompts[0], "Write a timeline.") || !strings.Contains(prompts[0], "08:00 disk alert") {
+		t.Errorf("unexpected initial prompt: %q", prompts[0])
+	}
+	expected := "Write a timeline.\nREPORT: report 1\nNEW: 09:00 failover"
+	if prompts[1] != expected {
+		t.Errorf("expected refine prompt %q, got %q", expected, prompts[1])
+	}
+	if !strings.Contains(prompts[2], "REPORT: report 2\nNEW: 10:00 recovery") {
+		t.Errorf("unexpected last prompt: %q", prompts[2])
+	}
+}
+
+func TestRefineTemplateCheck(t *testing.T) {
+	client := llm.NewClient("http://localhost", "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.Strategy = StrategyRefine
+	summarizer.RefineTemplate = "Update {{existing_report}}"
+
+	_, err = summarizer.SummarizeResults(context.Background(), []string{"a"}, "prompt")
+	if err == nil || !strings.Contains(err.Error(), "{{new_findings}}") {
+		t.Errorf("expected missing placeholder error, got %v", err)
+	}
+}
@@ -3,22 +3,74 @@ package summarizer
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/spf13/cobra"
 	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
 	"llm-data-analyzer/pkg/splitter"
-	"github.com/spf13/cobra"
 )
 
 const maxIterations = 10 // Add a constant for the max number of iterations
 
+// Reduce strategies.
+const (
+	// StrategyTree merges the results in a fan-in tree.
+	StrategyTree = "tree"
+	// StrategyRefine walks the results in order and keeps a running report.
+	StrategyRefine = "refine"
+	// StrategyMerge merges JSON results without the LLM, see MergeJSON.
+	StrategyMerge = "merge"
+)
+
+const (
+	// DefaultFanIn is the default number of results merged by one reduce node.
+	DefaultFanIn = 8
+	// DefaultConcurrency is the default number of reduce nodes run at once.
+	DefaultConcurrency = 8
+)
+
+// DefaultMergePrompt is used for the intermediate levels of the reduce tree
+// when no merge prompt is configured.
+const DefaultMergePrompt = `Merge these intermediate results into one. Keep every concrete detail, number and [chunk N] tag. Do not write conclusions.`
+
+// resultSeparator separates the results merged by one LLM call.
+const resultSeparator = "\n\n---\n\n"
+
 // Summarizer handles the recursive summarization of text.
 type Summarizer struct {
-	client    *llm.Client
-	splitter  *splitter.Splitter
+	client   *llm.Client
+	splitter *splitter.Splitter
+	// chunkSize is the context window of the model. Each request must fit the
+	// prompts, the text and the client's MaxTokens for the answer into it.
 	chunkSize int
 	verbose   bool
 	cmd       *cobra.Command
+
+	// FanIn is the maximum number of results merged by one reduce node.
+	FanIn int
+	// Concurrency is the maximum number of reduce nodes summarized at the
+	// same time.
+	Concurrency int
+	// MergePrompt is the prompt for the intermediate levels of the reduce
+	// tree; the summary prompt is used for the final request only. If empty,
+	// DefaultMergePrompt is used.
+	MergePrompt string
+	// Strategy is StrategyTree, StrategyRefine or StrategyMerge.
+	Strategy string
+	// RefineTemplate is the prompt of a refine step. If empty,
+	// DefaultRefineTemplate is used.
+	RefineTemplate string
+	// FinalSchema, if set, is the JSON Schema of the final summary. The final
+	// request asks for JSON and its response is validated against the schema.
+	FinalSchema *schema.Schema
+	// SchemaRetries is the number of repair attempts for a final summary that
+	// fails validation.
+	SchemaRetries int
+	// MergeRules are the field rules of StrategyMerge.
+	MergeRules MergeRules
 }
 
 // NewSummarizer creates a new Summarizer.
@@ -28,71 +80,255 @@ func NewSummarizer(client *llm.Client, chunkSize int, verbose bool, cmd *cobra.C
 		return nil, fmt.Errorf("failed to create splitter: %w", err)
 	}
 	return &Summarizer{
-		client:    client,
-		splitter:  s,
-		chunkSize: chunkSize,
-		verbose:   verbose,
-		cmd:       cmd,
-	},
-	nil
+		client:        client,
+		splitter:      s,
+		chunkSize:     chunkSize,
+		verbose:       verbose,
+		cmd:           cmd,
+		FanIn:         DefaultFanIn,
+		Concurrency:   DefaultConcurrency,
+		Strategy:      StrategyTree,
+		SchemaRetries: schema.DefaultRetries,
+	}, nil
 }
 
 // Summarize performs recursive summarization if the text is too long.
 func (s *Summarizer) Summarize(ctx context.Context, text, prompt string) (string, error) {
-	currentText := text
-	iteration := 1
+	return s.SummarizeResults(ctx, []string{text}, prompt)
+}
+
+// SummarizeResults reduces a list of intermediate results to a single summary
+// using the configured Strategy. The prompt may only be empty for
+// StrategyMerge.
+func (s *Summarizer) SummarizeResults(ctx context.Context, results []string, prompt string) (string, error) {
+	switch s.Strategy {
+	case StrategyTree, "":
+		return s.tree(ctx, results, prompt)
+	case StrategyRefine:
+		return s.refine(ctx, results, prompt)
+	case StrategyMerge:
+		return s.mergeResults(ctx, results, prompt)
+	}
+	return "", fmt.Errorf("unknown reduce strategy '%s'", s.Strategy)
+}
+
+// tree merges the results in a tree if they do not fit into one request:
+// each level groups up to FanIn results per node and summarizes the nodes of
+// the level concurrently with the merge prompt, until the remaining results
+// fit into the final request with the summary prompt.
+//
+// Both prompts may use the template variables {{level}} (the 1-based reduce
+// level), {{stage}} ("merge" or "final") and {{results}} (the number of
+// results in the request).
+func (s *Summarizer) tree(ctx context.Context, results []string, prompt string) (string, error) {
+	mergePrompt := s.MergePrompt
+	if mergePrompt == "" {
+		mergePrompt = DefaultMergePrompt
+	}
+
+	items := results
+	final, err := s.newBudget("summary prompt", prompt+s.schemaInstruction())
+	if err != nil {
+		return "", err
+	}
+	var merge budget
 
-	for {
-		if iteration > maxIterations {
+	for level := 1; ; level++ {
+		if level > maxIterations {
 			return "", fmt.Errorf("summarization reached max iterations (%d), potential infinite loop", maxIterations)
 		}
 
+		currentText := strings.Join(items, resultSeparator)
 		if s.verbose {
-			s.cmd.Printf("Summarizer iteration %d: text length %d\n", iteration, len(currentText))
+			s.cmd.Printf("Summarizer level %d: %d results, text length %d\n", level, len(items), len(currentText))
 		}
-		iteration++
 
-		textTokens := s.splitter.Encode(currentText)
-		promptTokens := s.splitter.Encode(prompt)
-
-		if len(textTokens)+len(promptTokens) < s.chunkSize {
+		if len(s.splitter.Encode(currentText)) <= final.input() {
 			if s.verbose {
 				s.cmd.Println("Text is small enough, performing final analysis.")
 			}
-			fullPrompt := fmt.Sprintf("%s\n\n--- Text to Summarize ---\n%s", prompt, currentText)
-			return s.client.Analyze(ctx, fullPrompt)
+			finalPrompt := renderLevel(prompt, level, "final", len(items))
+			return s.analyzeFinal(ctx, summaryPrompt(finalPrompt, currentText))
 		}
 
-		chunks, err := s.splitter.Split(strings.NewReader(currentText))
+		if level == 1 {
+			if merge, err = s.newBudget("merge prompt", mergePrompt); err != nil {
+				return "", err
+			}
+		}
+		groups := s.group(items, merge.input())
+		if s.verbose {
+			s.cmd.Printf("Reduce level %d: merging %d results in %d nodes.\n", level, len(items), len(groups))
+		}
+
+		summaries, err := s.reduceLevel(ctx, level, groups, mergePrompt)
 		if err != nil {
-			return "", fmt.Errorf("failed to split text for summarization: %w", err)
+			return "", err
 		}
+		items = summaries
+	}
+}
 
-		if len(chunks) == 1 {
-			if s.verbose {
-				s.cmd.Println("Cannot split further, analyzing the whole text.")
+// renderLevel fills in the reduce level variables of a prompt.
+func renderLevel(prompt string, level int, stage string, results int) string {
+	return renderTemplate(prompt, map[string]string{
+		"level":   strconv.Itoa(level),
+		"stage":   stage,
+		"results": strconv.Itoa(results),
+	})
+}
+
+// group packs items into groups of at most FanIn items whose combined size
+// fits into the token budget. Items that are too large on their own are
+// split by tokens, and every piece forms its own group.
+func (s *Summarizer) group(items []string, budget int) [][]string {
+	tokens := make([][]int, len(items))
+	sizes := make([]int, len(items))
+	for i, item := range items {
+		tokens[i] = s.splitter.Encode(item)
+		sizes[i] = len(tokens[i])
+	}
+
+	var groups [][]string
+	for _, indices := range s.pack(sizes, budget) {
+		if len(indices) == 1 && sizes[indices[0]] > budget {
+			itemTokens := tokens[indices[0]]
+			for i := 0; i < len(itemTokens); i += budget {
+				end := min(i+budget, len(itemTokens))
+				groups = append(groups, []string{s.splitter.Decode(itemTokens[i:end])})
 			}
-			fullPrompt := fmt.Sprintf("%s\n\n--- Text to Summarize ---\n%s", prompt, currentText)
-			return s.client.Analyze(ctx, fullPrompt)
+			continue
+		}
+		group := make([]string, len(indices))
+		for i, index := range indices {
+			group[i] = items[index]
 		}
+		groups = append(groups, group)
+	}
+	return groups
+}
 
-		if s.verbose {
-			s.cmd.Printf("Splitting text into %d chunks for summarization.\n", len(chunks))
+// pack groups the indices of items with the given token counts into groups
+// of at most FanIn items whose combined size fits into the budget. An item
+// larger than the budget forms a group of its own.
+func (s *Summarizer) pack(sizes []int, budget int) [][]int {
+	fanIn := s.FanIn
+	if fanIn < 2 {
+		fanIn = 2
+	}
+	separatorTokens := len(s.splitter.Encode(resultSeparator))
+
+	var groups [][]int
+	var current []int
+	currentTokens := 0
+	flush := func() {
+		if len(current) > 0 {
+			groups = append(groups, current)
 		}
+		current = nil
+		currentTokens = 0
+	}
 
-		var summaries []string
-		for i, chunk := range chunks {
-			if s.verbose {
-				s.cmd.Printf("Summarizing sub-chunk %d/%d\n", i+1, len(chunks))
+	for i, size := range sizes {
+		if size > budget {
+			flush()
+			groups = append(groups, []int{i})
+			continue
+		}
+
+		needed := size
+		if len(current) > 0 {
+			needed += separatorTokens
+		}
+		if len(current) == fanIn || currentTokens+needed > budget {
+			flush()
+			needed = size
+		}
+		current = append(current, i)
+		currentTokens += needed
+	}
+	flush()
+
+	return groups
+}
+
+// reduceLevel summarizes the groups of one level concurrently, with at most
+// s.Concurrency requests in flight. The summaries keep the order of the groups.
+func (s *Summarizer) reduceLevel(ctx context.Context, level int, groups [][]string, prompt string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	summaries := make([]string, len(groups))
+	sem := make(chan struct{}, concurrency)
+	errorChan := make(chan error, len(groups))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	for i, group := range groups {
+		wg.Add(1)
+		go func(node int, group []string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				return
 			}
-			fullPrompt := fmt.Sprintf("%s\n\n--- Text to Summarize ---\n%s", prompt, chunk)
-			summary, err := s.client.Analyze(ctx, fullPrompt)
+
+			nodePrompt := renderLevel(prompt, level, "merge", len(group))
+			summary, err := s.client.Analyze(ctx, summaryPrompt(nodePrompt, strings.Join(group, resultSeparator)))
 			if err != nil {
-				return "", err
+				errorChan <- fmt.Errorf("failed to summarize node %d of level %d: %w", node+1, level, err)
+				cancel()
+				return
 			}
-			summaries = append(summaries, summary)
-		}
+			summaries[node] = summary
 
-		currentText = strings.Join(summaries, "\n\n---\n\n")
+			if s.verbose {
+				mu.Lock()
+				done++
+				s.cmd.Printf("Reduce level %d: %d/%d nodes done\n", level, done, len(groups))
+				mu.Unlock()
+			}
+		}(i, group)
+	}
+
+	wg.Wait()
+	close(errorChan)
+
+	// Return the first error encountered
+	for err := range errorChan {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	return summaries, nil
+}
+
+// analyzeFinal sends the final request of a reduction, which must produce
+// JSON valid under FinalSchema if one is set.
+func (s *Summarizer) analyzeFinal(ctx context.Context, prompt string) (string, error) {
+	if s.FinalSchema == nil {
+		return s.client.Analyze(ctx, prompt)
+	}
+	return schema.Analyze(ctx, s.client, prompt, s.FinalSchema, s.SchemaRetries)
+}
+
+// schemaInstruction returns the text schema.Analyze adds to the final prompt,
+// so that it can be budgeted for.
+func (s *Summarizer) schemaInstruction() string {
+	if s.FinalSchema == nil || s.client.SupportsJSONSchema {
+		return ""
+	}
+	return "\n\n" + s.FinalSchema.Instruction()
+}
+
+func summaryPrompt(prompt, text string) string {
+	return fmt.Sprintf("%s\n\n--- Text to Summarize ---\n%s", prompt, text)
 }
@@ -2,12 +2,18 @@ package summarizer
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"llm-data-analyzer/pkg/llm"
+	"llm-data-analyzer/pkg/schema"
 	"github.com/spf13/cobra"
 )
 
@@ -21,7 +27,7 @@ func TestSummarizer(t *testing.T) {
 	// 2. Create a client and summarizer
 	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
 	dummyCmd := &cobra.Command{}
-	summarizer, err := NewSummarizer(client, 10, false, dummyCmd) // small chunk size to force recursion
+	summarizer, err := NewSummarizer(client, 80, false, dummyCmd) // small context window to force recursion
 	if err != nil {
 		t.Fatalf("failed to create summarizer: %v", err)
 	}
@@ -40,3 +46,221 @@ func TestSummarizer(t *testing.T) {
 		t.Errorf("unexpected summary result: %s", result)
 	}
 }
+
+func TestGroupSmallBudget(t *testing.T) {
+	summarizer, err := NewSummarizer(llm.NewClient("http://localhost", "", "m"), 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+
+	// A budget of one token still splits an item into pieces.
+	item := "alpha beta gamma"
+	groups := summarizer.group([]string{item}, 1)
+	if len(groups) != len(summarizer.splitter.Encode(item)) {
+		t.Errorf("expected one group per token, got %d groups", len(groups))
+	}
+}
+
+func TestSummarizeResultsTree(t *testing.T) {
+	var calls, inFlight, maxInFlight int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"choices": [{"message": {"content": "summary"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.FanIn = 4
+	summarizer.Concurrency = 2
+
+	// 20 results of about 60 tokens each do not fit into one request.
+	var results []string
+	for i := 0; i < 20; i++ {
+		results = append(results, strings.Repeat("alpha beta gamma ", 20))
+	}
+
+	result, err := summarizer.SummarizeResults(context.Background(), results, "Summarize this:")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "summary" {
+		t.Errorf("unexpected summary result: %s", result)
+	}
+
+	// Level 1 merges 4 results per node (5 nodes), level 2 is the final call.
+	if calls != 6 {
+		t.Errorf("expected 6 calls, got %d", calls)
+	}
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 concurrent calls, got %d", maxInFlight)
+	}
+}
+
+func TestSummarizerBudget(t *testing.T) {
+	client := llm.NewClient("http://localhost", "test-key", "test-model")
+	client.MaxTokens = 100
+	summarizer, err := NewSummarizer(client, 110, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+
+	_, err = summarizer.Summarize(context.Background(), "text", "Summarize this:")
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a BudgetError, got %v", err)
+	}
+	if budgetErr.MaxOutputTokens != 100 || budgetErr.ContextWindow != 110 {
+		t.Errorf("unexpected budget error: %+v", budgetErr)
+	}
+	if !strings.Contains(err.Error(), "max_output_tokens (100)") {
+		t.Errorf("error does not explain the budget: %v", err)
+	}
+}
+
+func TestSummarizerBudgetDefaultOutput(t *testing.T) {
+	client := llm.NewClient("http://localhost", "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+
+	// Without max_output_tokens, a quarter of the window is kept for the answer.
+	b, err := summarizer.newBudget("prompt", "Summarize this:")
+	if err != nil {
+		t.Fatalf("newBudget failed: %v", err)
+	}
+	if b.maxOutputTokens != 250 {
+		t.Errorf("expected an output reserve of 250 tokens, got %d", b.maxOutputTokens)
+	}
+	if want := 1000 - 250 - b.prompt - b.overhead; b.input() != want {
+		t.Errorf("expected %d tokens for the text, got %d", want, b.input())
+	}
+
+	// A window that only the reserve leaves without room for text.
+	window := b.prompt + b.overhead + 4
+	summarizer, _ = NewSummarizer(client, window, false, &cobra.Command{})
+	_, err = summarizer.Summarize(context.Background(), "text", "Summarize this:")
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a BudgetError, got %v", err)
+	}
+	if !budgetErr.DefaultOutput || budgetErr.MaxOutputTokens != window/4 {
+		t.Errorf("unexpected budget error: %+v", budgetErr)
+	}
+	if !strings.Contains(err.Error(), "max_output_tokens is not set") {
+		t.Errorf("error does not explain the default reserve: %v", err)
+	}
+}
+
+func TestSummarizeResultsPrompts(t *testing.T) {
+	var mu sync.Mutex
+	var prompts []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		prompts = append(prompts, req.Messages[0].Content)
+		mu.Unlock()
+		w.Write([]byte(`{"choices": [{"message": {"content": "summary"}}]}`))
+	}))
+	defer mockServer.Close()
+
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.FanIn = 4
+	summarizer.MergePrompt = "MERGE level {{level}} ({{stage}}, {{results}} results)"
+
+	var results []string
+	for i := 0; i < 20; i++ {
+		results = append(results, strings.Repeat("alpha beta gamma ", 20))
+	}
+	if _, err := summarizer.SummarizeResults(context.Background(), results, "FINAL level {{level}} ({{stage}})"); err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+
+	merges, finals := 0, 0
+	for _, prompt := range prompts {
+		switch {
+		case strings.HasPrefix(prompt, "MERGE level 1 (merge, 4 results)"):
+			merges++
+		case strings.HasPrefix(prompt, "FINAL level 2 (final)"):
+			finals++
+		default:
+			t.Errorf("unexpected prompt: %q", prompt)
+		}
+	}
+	if merges != 5 || finals != 1 {
+		t.Errorf("expected 5 merge calls and 1 final call, got %d and %d", merges, finals)
+	}
+}
+
+func TestSummarizeFinalSchema(t *testing.T) {
+	var mu sync.Mutex
+	var formats []*llm.ResponseFormat
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req llm.ChatCompletionRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		formats = append(formats, req.ResponseFormat)
+		mu.Unlock()
+		content := "summary"
+		if req.ResponseFormat != nil {
+			content = `{"errors": 2}`
+		}
+		json.NewEncoder(w).Encode(llm.ChatCompletionResponse{
+			Choices: []llm.Choice{{Message: llm.Message{Role: "assistant", Content: content}}},
+		})
+	}))
+	defer mockServer.Close()
+
+	finalSchema, err := schema.Parse("report", []byte(`{"type": "object", "required": ["errors"]}`))
+	if err != nil {
+		t.Fatalf("failed to parse schema: %v", err)
+	}
+	client := llm.NewClient(mockServer.URL, "test-key", "test-model")
+	client.SupportsJSONSchema = true
+	summarizer, err := NewSummarizer(client, 1000, false, &cobra.Command{})
+	if err != nil {
+		t.Fatalf("failed to create summarizer: %v", err)
+	}
+	summarizer.FanIn = 4
+	summarizer.FinalSchema = finalSchema
+
+	var results []string
+	for i := 0; i < 20; i++ {
+		results = append(results, strings.Repeat("alpha beta gamma ", 20))
+	}
+	result, err := summarizer.SummarizeResults(context.Background(), results, "Summarize this:")
+	if err != nil {
+		t.Fatalf("SummarizeResults failed: %v", err)
+	}
+	if result != "{\n  \"errors\": 2\n}" {
+		t.Errorf("unexpected result: %q", result)
+	}
+
+	structured := 0
+	for _, format := range formats {
+		if format != nil {
+			structured++
+		}
+	}
+	if structured != 1 || len(formats) != 6 {
+		t.Errorf("expected only the last of 6 requests to be structured, got %d of %d", structured, len(formats))
+	}
+}
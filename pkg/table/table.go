@@ -0,0 +1,332 @@
+package table
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+	"llm-data-analyzer/pkg/schema"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+// Field types.
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+)
+
+// Provenance columns added to every row.
+const (
+	// ColumnChunk is the index of the first chunk the row was found in.
+	ColumnChunk = "_chunk"
+	// ColumnLocation is the location of that chunk in the input.
+	ColumnLocation = "_location"
+	// ColumnCount is the number of times the row was found.
+	ColumnCount = "_count"
+)
+
+// DefaultInstructions is used when no extraction prompt is given.
+const DefaultInstructions = "Extract every occurrence of the fields below from the data."
+
+// Field is a column of the extracted table.
+type Field struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"`
+	Description string `yaml:"description"`
+}
+
+// Spec lists the fields to extract.
+type Spec struct {
+	Fields []Field `yaml:"fields"`
+}
+
+// LoadSpec reads a field specification from a YAML file.
+func LoadSpec(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read field specification: %w", err)
+	}
+	return ParseSpec(data)
+}
+
+// ParseSpec parses a YAML field specification. The type of a field defaults
+// to string.
+func ParseSpec(data []byte) (*Spec, error) {
+	var spec Spec
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse field specification: %w", err)
+	}
+	if len(spec.Fields) == 0 {
+		return nil, fmt.Errorf("field specification has no fields")
+	}
+	seen := make(map[string]bool)
+	for i := range spec.Fields {
+		field := &spec.Fields[i]
+		if field.Name == "" {
+			return nil, fmt.Errorf("field %d has no name", i+1)
+		}
+		if strings.HasPrefix(field.Name, "_") {
+			return nil, fmt.Errorf("field name '%s' must not start with '_'", field.Name)
+		}
+		if seen[field.Name] {
+			return nil, fmt.Errorf("duplicate field '%s'", field.Name)
+		}
+		seen[field.Name] = true
+		switch field.Type {
+		case "":
+			field.Type = TypeString
+		case TypeString, TypeInteger, TypeNumber, TypeBoolean:
+		default:
+			return nil, fmt.Errorf("field '%s' has unknown type '%s'", field.Name, field.Type)
+		}
+	}
+	return &spec, nil
+}
+
+// Schema returns the JSON Schema of an extraction response: an object with a
+// "rows" array. The field types are not part of the schema; they are checked
+// and converted by Table.Add.
+func (s *Spec) Schema() (*schema.Schema, error) {
+	properties := make(map[string]any)
+	for _, field := range s.Fields {
+		properties[field.Name] = map[string]any{"description": fmt.Sprintf("%s (%s)", field.Description, field.Type)}
+	}
+	doc := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"rows": map[string]any{
+				"type": "array",
+				"items": map[string]any{
+					"type":       "object",
+					"properties": properties,
+				},
+			},
+		},
+		"required": []string{"rows"},
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode extraction schema: %w", err)
+	}
+	return schema.Parse("extraction", data)
+}
+
+// Prompt returns the extraction prompt for one chunk of text.
+func (s *Spec) Prompt(instructions, text string) string {
+	if strings.TrimSpace(instructions) == "" {
+		instructions = DefaultInstructions
+	}
+	var b strings.Builder
+	b.WriteString(instructions)
+	b.WriteString("\n\nFields:\n")
+	for _, field := range s.Fields {
+		fmt.Fprintf(&b, "- %s (%s): %s\n", field.Name, field.Type, field.Description)
+	}
+	b.WriteString("\nReturn a JSON object with a \"rows\" array that has one object per occurrence, with the fields above as keys. Use null for fields without a value. Return an empty array if there is nothing to extract.")
+	b.WriteString("\n\n--- Data ---\n")
+	b.WriteString(text)
+	return b.String()
+}
+
+// row is one extracted row and its provenance.
+type row struct {
+	values []any
+	chunk  splitter.Chunk
+	count  int
+}
+
+// Table collects the rows extracted from all chunks. Rows that repeat an
+// earlier row are counted but not added.
+type Table struct {
+	spec  *Spec
+	rows  []*row
+	index map[string]*row
+
+	// Rejected is the number of rows that failed the type check.
+	Rejected int
+}
+
+// New creates an empty Table for a field specification.
+func New(spec *Spec) *Table {
+	return &Table{spec: spec, index: make(map[string]*row)}
+}
+
+// Len returns the number of distinct rows.
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Add adds the rows of a validated extraction response for a chunk. Chunks
+// must be added in order for the provenance to name the first occurrence.
+func (t *Table) Add(chunk splitter.Chunk, response string) error {
+	var doc struct {
+		Rows []map[string]any `json:"rows"`
+	}
+	decoder := json.NewDecoder(strings.NewReader(response))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("invalid extraction response for chunk %d: %w", chunk.Index, err)
+	}
+
+	for _, object := range doc.Rows {
+		values, ok := t.convert(object)
+		if !ok {
+			t.Rejected++
+			continue
+		}
+		key, _ := json.Marshal(values)
+		if existing, ok := t.index[string(key)]; ok {
+			existing.count++
+			continue
+		}
+		r := &row{values: values, chunk: chunk, count: 1}
+		t.index[string(key)] = r
+		t.rows = append(t.rows, r)
+	}
+	return nil
+}
+
+// convert type-checks the values of a row in field order. Values are
+// converted where that is lossless, e.g. "42" for an integer field. A row
+// with an invalid value or without any value is rejected.
+func (t *Table) convert(object map[string]any) ([]any, bool) {
+	values := make([]any, len(t.spec.Fields))
+	empty := true
+	for i, field := range t.spec.Fields {
+		value, ok := convertValue(field.Type, object[field.Name])
+		if !ok {
+			return nil, false
+		}
+		if value != nil {
+			empty = false
+		}
+		values[i] = value
+	}
+	return values, !empty
+}
+
+func convertValue(fieldType string, value any) (any, bool) {
+	if s, ok := value.(string); ok {
+		value = strings.TrimSpace(s)
+		if value == "" {
+			return nil, true
+		}
+	}
+	if value == nil {
+		return nil, true
+	}
+
+	switch fieldType {
+	case TypeString:
+		switch v := value.(type) {
+		case string:
+			return v, true
+		case json.Number:
+			return v.String(), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case TypeInteger:
+		text := fmt.Sprint(value)
+		if _, ok := value.(bool); ok {
+			return nil, false
+		}
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return int64(f), true
+		}
+	case TypeNumber:
+		if _, ok := value.(bool); ok {
+			return nil, false
+		}
+		if f, err := strconv.ParseFloat(fmt.Sprint(value), 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f, true
+		}
+	case TypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case string:
+			if b, err := strconv.ParseBool(strings.ToLower(v)); err == nil {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// columns returns the header of the table.
+func (t *Table) columns() []string {
+	var columns []string
+	for _, field := range t.spec.Fields {
+		columns = append(columns, field.Name)
+	}
+	return append(columns, ColumnChunk, ColumnLocation, ColumnCount)
+}
+
+// WriteCSV writes the table as CSV with a header row. Empty values are
+// written as empty cells.
+func (t *Table) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(t.columns()); err != nil {
+		return fmt.Errorf("failed to write CSV header: %w", err)
+	}
+	for _, r := range t.rows {
+		var record []string
+		for _, value := range r.values {
+			switch v := value.(type) {
+			case nil:
+				record = append(record, "")
+			case float64:
+				record = append(record, strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				record = append(record, fmt.Sprint(v))
+			}
+		}
+		record = append(record, strconv.Itoa(r.chunk.Index), r.chunk.Location(), strconv.Itoa(r.count))
+		if err := writer.Write(record); err != nil {
+			return fmt.Errorf("failed to write CSV row: %w", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJSONL writes the table as JSONL, one object per row with the fields
+// in specification order.
+func (t *Table) WriteJSONL(w io.Writer) error {
+	columns := t.columns()
+	for _, r := range t.rows {
+		values := append(append([]any{}, r.values...), r.chunk.Index, r.chunk.Location(), r.count)
+		var b strings.Builder
+		b.WriteString("{")
+		for i, column := range columns {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			key, _ := json.Marshal(column)
+			value, err := json.Marshal(values[i])
+			if err != nil {
+				return fmt.Errorf("failed to encode row: %w", err)
+			}
+			b.Write(key)
+			b.WriteString(":")
+			b.Write(value)
+		}
+		b.WriteString("}\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return fmt.Errorf("failed to write row: %w", err)
+		}
+	}
+	return nil
+}
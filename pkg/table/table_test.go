@@ -0,0 +1,97 @@
+package table
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/splitter"
+)
+
+const specYAML = `
+fields:
+  - name: ip
+    description: Source IP address
+  - name: status
+    type: integer
+    description: HTTP status code
+  - name: blocked
+    type: boolean
+    description: Whether the request was blocked
+`
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec([]byte(specYAML))
+	if err != nil {
+		t.Fatalf("ParseSpec failed: %v", err)
+	}
+	if len(spec.Fields) != 3 || spec.Fields[0].Type != TypeString {
+		t.Errorf("unexpected spec: %+v", spec)
+	}
+	if _, err := spec.Schema(); err != nil {
+		t.Errorf("Schema failed: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"fields: []",
+		"fields:\n  - name: a\n    type: date",
+		"fields:\n  - name: a\n  - name: a",
+		"fields:\n  - name: _chunk",
+	} {
+		if _, err := ParseSpec([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	spec, err := ParseSpec([]byte(specYAML))
+	if err != nil {
+		t.Fatalf("ParseSpec failed: %v", err)
+	}
+	table := New(spec)
+
+	first := splitter.Chunk{Index: 1, Source: "app.log", StartLine: 1, EndLine: 40}
+	second := splitter.Chunk{Index: 2, Source: "app.log", StartLine: 41, EndLine: 80}
+	if err := table.Add(first, `{"rows": [
+		{"ip": "10.0.0.1", "status": 403, "blocked": true},
+		{"ip": "10.0.0.2", "status": "500", "blocked": null},
+		{"ip": "10.0.0.3", "status": "many"},
+		{"ip": null, "status": null}
+	]}`); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := table.Add(second, `{"rows": [
+		{"ip": " 10.0.0.1 ", "status": 403.0, "blocked": "true"},
+		{"ip": "10.0.0.4", "status": 200, "blocked": false}
+	]}`); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	if table.Len() != 3 || table.Rejected != 2 {
+		t.Errorf("expected 3 rows and 2 rejected, got %d and %d", table.Len(), table.Rejected)
+	}
+
+	var csvOut bytes.Buffer
+	if err := table.WriteCSV(&csvOut); err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+	expectedCSV := `ip,status,blocked,_chunk,_location,_count
+10.0.0.1,403,true,1,lines 1–40 of app.log,2
+10.0.0.2,500,,1,lines 1–40 of app.log,1
+10.0.0.4,200,false,2,lines 41–80 of app.log,1
+`
+	if csvOut.String() != expectedCSV {
+		t.Errorf("expected CSV:\n%s\ngot:\n%s", expectedCSV, csvOut.String())
+	}
+
+	var jsonlOut bytes.Buffer
+	if err := table.WriteJSONL(&jsonlOut); err != nil {
+		t.Fatalf("WriteJSONL failed: %v", err)
+	}
+	firstLine := strings.SplitN(jsonlOut.String(), "\n", 2)[0]
+	expectedLine := `{"ip":"10.0.0.1","status":403,"blocked":true,"_chunk":1,"_location":"lines 1–40 of app.log","_count":2}`
+	if firstLine != expectedLine {
+		t.Errorf("expected %s, got %s", expectedLine, firstLine)
+	}
+}
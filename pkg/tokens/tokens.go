@@ -0,0 +1,41 @@
+// Package tokens counts tokens with the cl100k_base encoding, the way the
+// splitter cuts chunks, and approximates the framing of chat requests.
+package tokens
+
+import (
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+const (
+	// MessageOverhead approximates the tokens used to frame each chat message.
+	MessageOverhead = 4
+	// ReplyOverhead approximates the tokens that prime the assistant's reply.
+	ReplyOverhead = 3
+)
+
+var (
+	encodingOnce sync.Once
+	encoding     *tiktoken.Tiktoken
+	encodingErr  error
+)
+
+// Encoding returns the cl100k_base encoding, which is loaded once and shared
+// by all splitters and token counts.
+func Encoding() (*tiktoken.Tiktoken, error) {
+	encodingOnce.Do(func() {
+		encoding, encodingErr = tiktoken.GetEncoding("cl100k_base")
+	})
+	return encoding, encodingErr
+}
+
+// Count counts the tokens of a text, or estimates them from its length if the
+// encoding is not available.
+func Count(text string) int {
+	tkm, err := Encoding()
+	if err != nil {
+		return (len(text) + 3) / 4
+	}
+	return len(tkm.Encode(text, nil, nil))
+}
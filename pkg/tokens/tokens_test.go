@@ -0,0 +1,19 @@
+package tokens
+
+import (
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	tkm, err := Encoding()
+	if err != nil {
+		t.Fatalf("Failed to get encoding: %v", err)
+	}
+	text := "The database was slow again."
+	if got, want := Count(text), len(tkm.Encode(text, nil, nil)); got != want || got == 0 {
+		t.Errorf("expected %d tokens, got %d", want, got)
+	}
+	if got := Count(""); got != 0 {
+		t.Errorf("expected no tokens for an empty text, got %d", got)
+	}
+}
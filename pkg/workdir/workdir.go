@@ -0,0 +1,326 @@
+// Package workdir reads and writes the work directory shared by the stages of
+// an analysis:
+//
+//	chunks.jsonl     metadata of every chunk, one JSON object per line
+//	text_N.txt       text of chunk N, written by the split stage
+//	chunk_N.txt      analysis result of chunk N, written by the map stage
+//	prefilter.jsonl  relevance decisions of the prefilter, if the map stage ran one
+//	served.jsonl     endpoint that analyzed each chunk, written by the map stage
+//	records.jsonl    valid results of the records in map-only mode
+//
+// Chunks are numbered from 1.
+package workdir
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"llm-data-analyzer/pkg/prefilter"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+// ManifestFile is the name of the chunk metadata file.
+const ManifestFile = "chunks.jsonl"
+
+// PrefilterFile is the name of the prefilter decisions file.
+const PrefilterFile = "prefilter.jsonl"
+
+// ServedFile is the name of the file that records which endpoint analyzed
+// each chunk.
+const ServedFile = "served.jsonl"
+
+// RecordsFile is the name of the file of the record results in map-only
+// mode.
+const RecordsFile = "records.jsonl"
+
+// TextPath returns the path of the text of a chunk.
+func TextPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("text_%d.txt", index))
+}
+
+// ResultPath returns the path of the analysis result of a chunk.
+func ResultPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("chunk_%d.txt", index))
+}
+
+// WriteChunks writes the manifest and the text of every chunk. Results of an
+// earlier split are kept only for chunks with the same index and hash.
+func WriteChunks(dir string, chunks []splitter.Chunk) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+	if err := removeStale(dir, chunks); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := os.WriteFile(TextPath(dir, chunk.Index), []byte(chunk.Text), 0644); err != nil {
+			return fmt.Errorf("failed to write text of chunk %d: %w", chunk.Index, err)
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return fmt.Errorf("failed to create chunk manifest: %w", err)
+	}
+	defer f.Close()
+	if err := splitter.WriteManifest(f, chunks); err != nil {
+		return fmt.Errorf("failed to write chunk manifest: %w", err)
+	}
+	return f.Close()
+}
+
+// removeStale removes the texts and results of the previous manifest that do
+// not belong to the new chunks.
+func removeStale(dir string, chunks []splitter.Chunk) error {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open chunk manifest: %w", err)
+	}
+	defer f.Close()
+	previous, err := splitter.ReadManifest(f)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[int]string, len(chunks))
+	for _, chunk := range chunks {
+		hashes[chunk.Index] = chunk.Hash
+	}
+	for _, chunk := range previous {
+		if hash, ok := hashes[chunk.Index]; ok && hash == chunk.Hash {
+			continue
+		}
+		for _, path := range []string{TextPath(dir, chunk.Index), ResultPath(dir, chunk.Index)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove stale file: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// ReadChunks reads the manifest and the text of every chunk.
+func ReadChunks(dir string) ([]splitter.Chunk, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no %s in %s, run the split stage first", ManifestFile, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk manifest: %w", err)
+	}
+	defer f.Close()
+
+	chunks, err := splitter.ReadManifest(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chunks {
+		text, err := os.ReadFile(TextPath(dir, chunks[i].Index))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read text of chunk %d: %w", chunks[i].Index, err)
+		}
+		chunks[i].Text = string(text)
+	}
+	return chunks, nil
+}
+
+// WriteResult saves the analysis result of a chunk.
+func WriteResult(dir string, index int, result string) error {
+	if err := os.WriteFile(ResultPath(dir, index), []byte(result), 0644); err != nil {
+		return fmt.Errorf("failed to write result for chunk %d: %w", index, err)
+	}
+	return nil
+}
+
+// Pending returns the chunks that have no analysis result yet.
+func Pending(dir string, chunks []splitter.Chunk) []splitter.Chunk {
+	var pending []splitter.Chunk
+	for _, chunk := range chunks {
+		if _, err := os.Stat(ResultPath(dir, chunk.Index)); err != nil {
+			pending = append(pending, chunk)
+		}
+	}
+	return pending
+}
+
+// ReadResults reads the analysis results of the chunks, in chunk order.
+func ReadResults(dir string, chunks []splitter.Chunk) ([]string, error) {
+	results := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		content, err := os.ReadFile(ResultPath(dir, chunk.Index))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no result for chunk %d in %s, run the map stage first", chunk.Index, dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read intermediate result of chunk %d: %w", chunk.Index, err)
+		}
+		results[i] = string(content)
+	}
+	return results, nil
+}
+
+// WriteDecisions saves the decisions of the prefilter, one JSON object per
+// line. Without decisions, an earlier decisions file is removed.
+func WriteDecisions(dir string, decisions []prefilter.Decision) error {
+	return writeLines(filepath.Join(dir, PrefilterFile), "prefilter decisions", decisions)
+}
+
+// ReadDecisions reads the decisions of the prefilter. It returns no decisions
+// if the prefilter did not run.
+func ReadDecisions(dir string) ([]prefilter.Decision, error) {
+	return readLines[prefilter.Decision](filepath.Join(dir, PrefilterFile), "prefilter decisions")
+}
+
+// Served records the endpoint that analyzed a chunk.
+type Served struct {
+	Index    int    `json:"index"`
+	Endpoint string `json:"endpoint"`
+	// Pieces is the number of parts the chunk was split into to fit the
+	// endpoint's chunk size, if it had to be split.
+	Pieces int `json:"pieces,omitempty"`
+}
+
+// WriteServed saves the endpoints that analyzed the chunks, one JSON object
+// per line.
+func WriteServed(dir string, served []Served) error {
+	return writeLines(filepath.Join(dir, ServedFile), "served endpoints", served)
+}
+
+// ReadServed reads the endpoints that analyzed the chunks. It returns nil if
+// the map stage did not run.
+func ReadServed(dir string) ([]Served, error) {
+	return readLines[Served](filepath.Join(dir, ServedFile), "served endpoints")
+}
+
+// recordResult is the valid result of a record.
+type recordResult struct {
+	ID int `json:"id"`
+	// Hash is the SHA-256 of the record, so that results of changed records
+	// are not reused.
+	Hash   string                     `json:"hash"`
+	Fields map[string]json.RawMessage `json:"fields"`
+}
+
+func recordHash(record records.Record) string {
+	sum := sha256.Sum256(record.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteRecordResults saves the valid results of the records, one JSON object
+// per line. Results without a valid result are left out, so that a resumed
+// run analyzes their records again.
+func WriteRecordResults(dir string, results []records.Result) error {
+	var valid []recordResult
+	for _, result := range results {
+		if result.Err == nil {
+			valid = append(valid, recordResult{ID: result.Record.ID, Hash: recordHash(result.Record), Fields: result.Fields})
+		}
+	}
+	return writeLines(filepath.Join(dir, RecordsFile), "record results", valid)
+}
+
+// ReadRecordResults reads the saved results of the records, by record ID.
+// Results of records that changed since are left out.
+func ReadRecordResults(dir string, recs []records.Record) (map[int]records.Result, error) {
+	saved, err := readLines[recordResult](filepath.Join(dir, RecordsFile), "record results")
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]recordResult, len(saved))
+	for _, result := range saved {
+		byID[result.ID] = result
+	}
+	results := make(map[int]records.Result)
+	for _, record := range recs {
+		if result, ok := byID[record.ID]; ok && result.Hash == recordHash(record) {
+			results[record.ID] = records.Result{Record: record, Fields: result.Fields}
+		}
+	}
+	return results, nil
+}
+
+// writeLines writes items to a file, one JSON object per line. Without items,
+// the file is removed.
+func writeLines[T any](path, name string, items []T) error {
+	if len(items) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return f.Close()
+}
+
+// readLines reads a file of JSON objects, one per line. It returns nil if the
+// file does not exist.
+func readLines[T any](path, name string) ([]T, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	var items []T
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var item T
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Relevant returns the chunks the prefilter kept. Chunks without a decision
+// for their current text are kept.
+func Relevant(dir string, chunks []splitter.Chunk) ([]splitter.Chunk, error) {
+	decisions, err := ReadDecisions(dir)
+	if err != nil {
+		return nil, err
+	}
+	dropped := make(map[int]string)
+	for _, decision := range decisions {
+		if !decision.Relevant {
+			dropped[decision.Index] = decision.Hash
+		}
+	}
+
+	var relevant []splitter.Chunk
+	for _, chunk := range chunks {
+		if hash, ok := dropped[chunk.Index]; ok && hash == chunk.Hash {
+			continue
+		}
+		relevant = append(relevant, chunk)
+	}
+	return relevant, nil
+}
@@ -0,0 +1,164 @@
+package workdir
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"llm-data-analyzer/pkg/prefilter"
+	"llm-data-analyzer/pkg/records"
+	"llm-data-analyzer/pkg/splitter"
+)
+
+func TestWorkDir(t *testing.T) {
+	dir := t.TempDir()
+	chunks := []splitter.Chunk{
+		{Index: 1, StartLine: 1, EndLine: 2, Text: "first\nchunk\n"},
+		{Index: 2, StartLine: 3, EndLine: 3, Text: "second chunk"},
+	}
+	if err := WriteChunks(dir, chunks); err != nil {
+		t.Fatalf("WriteChunks failed: %v", err)
+	}
+
+	read, err := ReadChunks(dir)
+	if err != nil {
+		t.Fatalf("ReadChunks failed: %v", err)
+	}
+	if len(read) != 2 || read[0].Text != chunks[0].Text || read[1].Text != chunks[1].Text || read[1].StartLine != 3 {
+		t.Errorf("unexpected chunks: %+v", read)
+	}
+
+	if _, err := ReadResults(dir, read); err == nil || !strings.Contains(err.Error(), "run the map stage first") {
+		t.Errorf("expected a missing result error, got %v", err)
+	}
+	for _, chunk := range read {
+		if err := WriteResult(dir, chunk.Index, "result "+chunk.Text); err != nil {
+			t.Fatalf("WriteResult failed: %v", err)
+		}
+	}
+	results, err := ReadResults(dir, read)
+	if err != nil {
+		t.Fatalf("ReadResults failed: %v", err)
+	}
+	if results[1] != "result second chunk" {
+		t.Errorf("unexpected results: %q", results)
+	}
+
+	// Splitting again keeps the results of unchanged chunks only.
+	changed := []splitter.Chunk{chunks[0], {Index: 2, Hash: "changed", Text: "other chunk"}}
+	if err := WriteChunks(dir, changed); err != nil {
+		t.Fatalf("WriteChunks failed: %v", err)
+	}
+	if _, err := os.Stat(ResultPath(dir, 1)); err != nil {
+		t.Errorf("expected the result of chunk 1 to be kept: %v", err)
+	}
+	if _, err := os.Stat(ResultPath(dir, 2)); !os.IsNotExist(err) {
+		t.Errorf("expected the result of chunk 2 to be removed, got %v", err)
+	}
+
+	if _, err := ReadChunks(t.TempDir()); err == nil || !strings.Contains(err.Error(), "run the split stage first") {
+		t.Errorf("expected a missing manifest error, got %v", err)
+	}
+}
+
+func TestRelevant(t *testing.T) {
+	dir := t.TempDir()
+	chunks := []splitter.Chunk{
+		{Index: 1, Hash: "a"},
+		{Index: 2, Hash: "b"},
+		{Index: 3, Hash: "c"},
+	}
+
+	relevant, err := Relevant(dir, chunks)
+	if err != nil || len(relevant) != 3 {
+		t.Fatalf("expected all chunks without decisions, got %v, %v", relevant, err)
+	}
+
+	decisions := []prefilter.Decision{
+		{Index: 1, Hash: "a", Relevant: false, Answer: "no"},
+		{Index: 2, Hash: "b", Relevant: true, Answer: "yes"},
+		{Index: 3, Hash: "old", Relevant: false, Answer: "no"},
+	}
+	if err := WriteDecisions(dir, decisions); err != nil {
+		t.Fatalf("WriteDecisions failed: %v", err)
+	}
+	read, err := ReadDecisions(dir)
+	if err != nil || len(read) != 3 || read[0] != decisions[0] {
+		t.Fatalf("unexpected decisions: %+v, %v", read, err)
+	}
+	relevant, err = Relevant(dir, chunks)
+	if err != nil {
+		t.Fatalf("Relevant failed: %v", err)
+	}
+	// Chunk 3 changed since the decision and is kept.
+	if len(relevant) != 2 || relevant[0].Index != 2 || relevant[1].Index != 3 {
+		t.Errorf("unexpected relevant chunks: %+v", relevant)
+	}
+
+	if err := WriteDecisions(dir, nil); err != nil {
+		t.Fatalf("WriteDecisions failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, PrefilterFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the decisions file to be removed, got %v", err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	dir := t.TempDir()
+	chunks := []splitter.Chunk{{Index: 1}, {Index: 2}, {Index: 3}}
+	if err := WriteResult(dir, 2, "done"); err != nil {
+		t.Fatalf("WriteResult failed: %v", err)
+	}
+	pending := Pending(dir, chunks)
+	if len(pending) != 2 || pending[0].Index != 1 || pending[1].Index != 3 {
+		t.Errorf("unexpected pending chunks: %+v", pending)
+	}
+}
+
+func TestServed(t *testing.T) {
+	dir := t.TempDir()
+	if served, err := ReadServed(dir); err != nil || served != nil {
+		t.Fatalf("expected no records before the map stage, got %v, %v", served, err)
+	}
+	served := []Served{
+		{Index: 1, Endpoint: "primary"},
+		{Index: 2, Endpoint: "small", Pieces: 3},
+	}
+	if err := WriteServed(dir, served); err != nil {
+		t.Fatalf("WriteServed failed: %v", err)
+	}
+	read, err := ReadServed(dir)
+	if err != nil || len(read) != 2 || read[0] != served[0] || read[1] != served[1] {
+		t.Errorf("unexpected records: %+v, %v", read, err)
+	}
+}
+
+func TestRecordResults(t *testing.T) {
+	dir := t.TempDir()
+	recs := []records.Record{
+		{ID: 1, Data: []byte(`{"ticket": "a"}`)},
+		{ID: 2, Data: []byte(`{"ticket": "b"}`)},
+		{ID: 3, Data: []byte(`{"ticket": "c"}`)},
+	}
+	results := []records.Result{
+		{Record: recs[0], Fields: map[string]json.RawMessage{"label": []byte(`"x"`)}},
+		{Record: recs[1], Err: errors.New("invalid result")},
+		{Record: recs[2], Fields: map[string]json.RawMessage{"label": []byte(`"z"`)}},
+	}
+	if err := WriteRecordResults(dir, results); err != nil {
+		t.Fatalf("WriteRecordResults failed: %v", err)
+	}
+
+	// Record 3 changed since.
+	recs[2].Data = []byte(`{"ticket": "changed"}`)
+	saved, err := ReadRecordResults(dir, recs)
+	if err != nil {
+		t.Fatalf("ReadRecordResults failed: %v", err)
+	}
+	if len(saved) != 1 || string(saved[1].Fields["label"]) != `"x"` {
+		t.Errorf("expected only the result of record 1, got %+v", saved)
+	}
+}